@@ -2,6 +2,7 @@ package mastobots
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
 	"math/rand"
 	"strings"
@@ -177,7 +178,7 @@ func (db DB) stockItems(bot *Persona) (inStock int, err error) {
 			continue
 		}
 
-		for _, w := range bot.Keywords {
+		for _, w := range bot.keywords() {
 			if result.contain(w) {
 				item.Keyword = w
 				myItems = append(myItems, item)
@@ -280,6 +281,10 @@ func (db DB) pickItem(bot *Persona) (item Item, err error) {
 			log.Printf("info: itemsテーブルから一行の情報取得に失敗しました：%s", err)
 			continue
 		}
+		// dry-runで投稿したことにしたアイテムは、削除しない代わりに二度選ばない
+		if bot.DryRun && bot.dryRunUsed(id) {
+			continue
+		}
 		items = append(items, Item{ID: id, Title: title, URL: url, Content: content})
 	}
 	err = rows.Err()
@@ -338,3 +343,285 @@ func (db DB) deleteItem(bot *Persona, item Item) (err error) {
 	}
 	return
 }
+
+// scheduledPostsは、データベースに登録された、botの有効な予約投稿を取得する。日時はbotのタイムゾーンの時刻とみなす。
+func (db DB) scheduledPosts(bot *Persona, loc *time.Location) (posts []ScheduledPost, err error) {
+	rows, err := db.Query(`
+		SELECT
+			id, status, visibility, spoiler_text, media, post_at, recurrence
+		FROM
+			scheduled_posts
+		WHERE
+			bot_id = ? AND enabled = 1`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s の予約投稿を集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var sp ScheduledPost
+		var visibility, spoiler, media, recurrence sql.NullString
+		var postAt sql.NullTime
+		if err := rows.Scan(&sp.ID, &sp.Status, &visibility, &spoiler, &media, &postAt, &recurrence); err != nil {
+			log.Printf("info: scheduled_postsテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		sp.Visibility = visibility.String
+		sp.SpoilerText = spoiler.String
+		sp.Schedule = recurrence.String
+		if media.String != "" {
+			sp.Media = strings.Split(strings.TrimSpace(media.String), "\n")
+		}
+		if postAt.Valid {
+			t := postAt.Time
+			sp.at = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+			sp.At = sp.at.Format("2006-01-02 15:04")
+		}
+		if err := sp.prepare(loc); err != nil {
+			log.Printf("info: %s の予約投稿 id:%d が不正です：%s", bot.Name, sp.ID, err)
+			continue
+		}
+		posts = append(posts, sp)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: scheduled_postsテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// claimScheduledPostは、予約投稿のその回の実行を記録する。既に記録があればfalseを返す。
+func (db DB) claimScheduledPost(bot *Persona, key string, fireAt time.Time) (claimed bool, err error) {
+	now := time.Now()
+	res, err := db.Exec(`
+		INSERT IGNORE INTO
+			scheduled_post_results (bot_id, post_key, fire_at, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?)`,
+		bot.DBID,
+		key,
+		fireAt,
+		now,
+		now,
+	)
+	if err != nil {
+		log.Printf("info: %s が予約投稿 %s の実行を記録できませんでした：%s", bot.Name, key, err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("info: %s が予約投稿 %s の実行記録を確認できませんでした：%s", bot.Name, key, err)
+		return
+	}
+	claimed = n > 0
+	return
+}
+
+// recordScheduledPostは、予約投稿の結果を記録する。
+func (db DB) recordScheduledPost(bot *Persona, key string, fireAt time.Time, statusID string, postErr error) (err error) {
+	_, err = db.Exec(`
+		UPDATE scheduled_post_results
+		SET status_id = ?, error = ?, updated_at = ?
+		WHERE bot_id = ? AND post_key = ? AND fire_at = ?`,
+		statusID,
+		truncateError(postErr),
+		time.Now(),
+		bot.DBID,
+		key,
+		fireAt,
+	)
+	if err != nil {
+		log.Printf("info: %s が予約投稿 %s の結果を記録できませんでした：%s", bot.Name, key, err)
+	}
+	return
+}
+
+// enqueueActionは、書き込みを送っている途中（sending）として残す。送っている間は、drainOutboxが送らない。
+// 同じIdempotency-Keyの書き込みが既にあれば残さず、idに0を返す。
+func (db DB) enqueueAction(bot *Persona, a outboxAction) (id int64, err error) {
+	payload, err := json.Marshal(outboxPayload{Toot: a.Toot, TargetID: a.TargetID})
+	if err != nil {
+		return
+	}
+	res, err := db.Exec(`
+		INSERT IGNORE INTO
+			outbox (bot_id, idempotency_key, kind, payload, priority, attempts, next_attempt_at, state, created_at, updated_at)
+		VALUES
+			(?, ?, ?, ?, ?, 0, ?, 'sending', ?, ?)`,
+		bot.DBID,
+		a.Key,
+		a.Kind,
+		string(payload),
+		int(a.Priority),
+		a.Created,
+		a.Created,
+		a.Created,
+	)
+	if err != nil {
+		log.Printf("info: %s の書き込みを送信待ちに残せませんでした：%s", bot.Name, err)
+		return
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// actionByKeyは、botのIdempotency-Keyがkeyの書き込みの状態と、送れていれば送った結果のIDを取得する。
+func (db DB) actionByKey(bot *Persona, key string) (state, resultID string, err error) {
+	var rid sql.NullString
+	err = db.QueryRow(`
+		SELECT
+			state, result_id
+		FROM
+			outbox
+		WHERE
+			bot_id = ? AND idempotency_key = ?`,
+		bot.DBID,
+		key,
+	).Scan(&state, &rid)
+	if err != nil {
+		log.Printf("info: %s が送信待ち %s の状態を取得できませんでした：%s", bot.Name, key, err)
+		return
+	}
+	resultID = rid.String
+	return
+}
+
+// dueActionsは、送り直す時刻になった送信待ちの書き込みを、優先度の高い順・古い順に最大limit件取得する。
+func (db DB) dueActions(bot *Persona, now time.Time, limit int) (actions []outboxAction, err error) {
+	rows, err := db.Query(`
+		SELECT
+			id, idempotency_key, kind, payload, priority, attempts, created_at
+		FROM
+			outbox
+		WHERE
+			bot_id = ? AND state = 'pending' AND next_attempt_at <= ?
+		ORDER BY
+			priority DESC, id
+		LIMIT ?`,
+		bot.DBID,
+		now,
+		limit,
+	)
+	if err != nil {
+		log.Printf("info: %s の送信待ちを集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a outboxAction
+		var payload string
+		var p int
+		if err := rows.Scan(&a.ID, &a.Key, &a.Kind, &payload, &p, &a.Attempts, &a.Created); err != nil {
+			log.Printf("info: outboxテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		var pl outboxPayload
+		if err := json.Unmarshal([]byte(payload), &pl); err != nil {
+			log.Printf("info: %s の送信待ち id:%d の中身が読めません：%s", bot.Name, a.ID, err)
+			continue
+		}
+		a.Toot, a.TargetID, a.Priority = pl.Toot, pl.TargetID, priority(p)
+		actions = append(actions, a)
+	}
+	err = rows.Err()
+	if err != nil {
+		log.Printf("info: outboxテーブルの行読み込みに結局失敗しました：%s", err)
+	}
+	return
+}
+
+// claimActionは、送信待ちの書き込みを送っている途中（sending）にする。他で先に送り始めていたらfalseを返す。
+func (db DB) claimAction(bot *Persona, id int64) (claimed bool, err error) {
+	res, err := db.Exec(`
+		UPDATE outbox
+		SET state = 'sending', updated_at = ?
+		WHERE id = ? AND bot_id = ? AND state = 'pending'`,
+		time.Now(),
+		id,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s が送信待ち id:%d を送り始められませんでした：%s", bot.Name, id, err)
+		return
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		log.Printf("info: %s が送信待ち id:%d を送り始めたか確認できませんでした：%s", bot.Name, id, err)
+		return
+	}
+	claimed = n > 0
+	return
+}
+
+// releaseActionsは、送っている途中（sending）のまま残ったbotの書き込みを、nowから送り直す送信待ちに戻す。
+// このプロセスでbotがまだ何も送っていない時にだけ使う。送っている最中のものを戻すと、二重に送ってしまう。
+func (db DB) releaseActions(bot *Persona, now time.Time) (err error) {
+	_, err = db.Exec(`
+		UPDATE outbox
+		SET state = 'pending', next_attempt_at = ?, updated_at = ?
+		WHERE bot_id = ? AND state = 'sending'`,
+		now,
+		time.Now(),
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s が送っている途中だった書き込みを送信待ちに戻せませんでした：%s", bot.Name, err)
+	}
+	return
+}
+
+// finishActionは、送信待ちの書き込みを、送れた（done）か諦めた（failed）ことにする。
+func (db DB) finishAction(bot *Persona, id int64, state, resultID string, sendErr error) (err error) {
+	_, err = db.Exec(`
+		UPDATE outbox
+		SET state = ?, result_id = ?, error = ?, updated_at = ?
+		WHERE id = ? AND bot_id = ?`,
+		state,
+		resultID,
+		truncateError(sendErr),
+		time.Now(),
+		id,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s が送信待ち id:%d の結果を記録できませんでした：%s", bot.Name, id, err)
+	}
+	return
+}
+
+// rescheduleActionは、送れなかった書き込みを送信待ち（pending）に戻し、nextに送り直すことにする。
+func (db DB) rescheduleAction(bot *Persona, id int64, attempts int, next time.Time, sendErr error) (err error) {
+	_, err = db.Exec(`
+		UPDATE outbox
+		SET state = 'pending', attempts = ?, next_attempt_at = ?, error = ?, updated_at = ?
+		WHERE id = ? AND bot_id = ?`,
+		attempts,
+		next,
+		truncateError(sendErr),
+		time.Now(),
+		id,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s が送信待ち id:%d の送り直しを記録できませんでした：%s", bot.Name, id, err)
+	}
+	return
+}
+
+// truncateErrorは、エラーをerror列（varchar(255)）に入る、255文字までの文字列にする。
+func truncateError(err error) string {
+	if err == nil {
+		return ""
+	}
+	rs := []rune(err.Error())
+	if len(rs) > 255 {
+		rs = rs[:255]
+	}
+	return string(rs)
+}
@@ -2,11 +2,16 @@ package mastobots
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	mastodon "github.com/hanage999/go-mastodon"
@@ -18,15 +23,25 @@ type Persona struct {
 	Instance        string
 	Client          *mastodon.Client
 	AccessToken     string
+	ClientKey       string
+	ClientSecret    string
 	MyID            mastodon.ID
 	Title           string
 	Starter         string
 	Assertion       string
 	FirstFire       int
 	Interval        int
+	Schedule        string
+	Jitter          int
 	ItemPool        int
 	Hashtags        []string
 	Keywords        []string
+	Timelines       []Timeline
+	FollowHashtags  []string
+	Lists           []string
+	SourceReactions map[string][]string
+	ReactionPolicy  ReactionPolicy
+	Streaming       string
 	Comments        []string
 	DBID            int
 	WakeHour        int
@@ -34,70 +49,146 @@ type Persona struct {
 	SleepHour       int
 	SleepMin        int
 	LivesWithSun    bool
+	Twilight        string
 	Latitude        float64
 	Longitude       float64
 	PlaceName       string
 	TimeZone        string
+	loc             *time.Location
+	Geocoder        string
+	geocoder        Geocoder
 	RandomToots     []string
 	RandomFrequency int
+	RandomSchedule  string
+	WeeklySchedule  map[string][]string
+	Holidays        []string
+	HolidayCalendar string
+	Vacations       []Vacation
+	ScheduledPosts  []ScheduledPost
+	Almanac         bool
+	Anniversaries   []Anniversary
+	DryRun          bool
+	Goodbye         string
 	Awake           time.Duration
+	newsSchedule    *cronSchedule
+	randomSchedule  *cronSchedule
+	newsTicks       int
+	weekly          map[string][]activeWindow
+	dryRunFired     sync.Map
+	awake           atomic.Bool
+	vocabMu         sync.RWMutex
+	health          health
+	reacted         recentIDs
+	reactions       reactionLog
+	startupErr      error
 	*commonSettings
 }
 
-// getID は、botのMastodonアカウントIDを取得する
+// getID は、botのMastodonアカウントIDを取得する。失敗したらmaxRetryを上限に再試行する。
 func (bot *Persona) getMastoID() (err error) {
 	ctx := context.Background()
+	return bot.retry(ctx, "アカウントIDの取得", func() error { return bot.verifyCredentials(ctx) })
+}
 
+// verifyCredentials は、botのMastodonサーバに一度だけ接続し、アカウントIDを取得する
+func (bot *Persona) verifyCredentials(ctx context.Context) (err error) {
 	bot.Client = mastodon.NewClient(&mastodon.Config{
 		Server:      bot.Instance,
 		AccessToken: bot.AccessToken,
 	})
+	bot.Client.Transport = bot.transport()
+	acc, err := bot.Client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return
+	}
+	bot.MyID = acc.ID
+	return
+}
+
+// setLocation は、botが暮らすタイムゾーンを決める。TimeZoneがなければ緯度経度から求める。
+func (bot *Persona) setLocation() (err error) {
+	if bot.TimeZone == "" && (bot.Latitude != 0 || bot.Longitude != 0) && f != nil {
+		bot.TimeZone = f.GetTimezoneName(bot.Longitude, bot.Latitude)
+	}
+	if bot.TimeZone == "" {
+		bot.loc = time.Local
+		return
+	}
+	if !strings.Contains(bot.TimeZone, "GMT") {
+		if _, err = time.LoadLocation(bot.TimeZone); err != nil {
+			return
+		}
+	}
+	bot.loc = locationOf(bot.TimeZone)
+	return
+}
+
+// location は、botが暮らすタイムゾーンを返す
+func (bot *Persona) location() *time.Location {
+	if bot.loc == nil {
+		return time.Local
+	}
+	return bot.loc
+}
 
-	var acc *mastodon.Account
-	for i := 0; i < bot.commonSettings.maxRetry+45; i++ {
-		acc, err = bot.Client.GetAccountCurrentUser(ctx)
-		if err == nil {
-			bot.MyID = acc.ID
+// live は、botの寝起きを繰り返す。最初の一回は、寝る・起きるのあいさつをしない。
+// 起動時に準備できなかったbotは、connectで準備し直してから活動を始める。準備を諦めたらエラーを返す。
+func (bot *Persona) live(ctx context.Context, db DB, connect func(db DB, bot *Persona) error) (err error) {
+	bot.awake.Store(false)
+	if bot.startupErr != nil {
+		if err = bot.reconnect(ctx, db, connect); err != nil {
 			return
 		}
-		log.Printf("alert: %s のアカウントIDが取得できません：%s", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
 	}
 
-	log.Printf("alert: %s のアカウントIDが取得できませんでした：%s", bot.Name, err)
+	// 送信待ちの書き込みは、寝ている間も送り直す
+	octx, stop := context.WithCancel(ctx)
+	defer stop()
+	bot.supervise(octx, "outbox", bot.drainOutbox)
+
+	firstLaunch, nextDayOfPolarNight := true, false
+	for ctx.Err() == nil {
+		sleep, active, nap := bot.spawn(ctx, firstLaunch, nextDayOfPolarNight)
+		nextDayOfPolarNight = bot.daylife(ctx, db, sleep, active, nap && !firstLaunch, firstLaunch, nextDayOfPolarNight)
+		firstLaunch = false
+	}
 	return
 }
 
-// spawn は、botの活動を開始する
-func (bot *Persona) spawn(ctx context.Context, db DB, firstLaunch bool, nextDayOfPolarNight bool) {
-	sleep, active := getDayCycle(bot.WakeHour, bot.WakeMin, bot.SleepHour, bot.SleepMin)
+// spawn は、botが次に起きるまでの時間と、起きている時間と、その眠りがひと休みかどうかを決める。
+// 太陽とともに暮らすbotの眠りは、いつも夜の眠り。
+func (bot *Persona) spawn(ctx context.Context, firstLaunch bool, nextDayOfPolarNight bool) (sleep, active time.Duration, nap bool) {
+	now := bot.clock().Now()
+	sleep, active, nap = bot.getWeeklyDayCycle(now)
 	bot.Awake = active
 
 	if bot.LivesWithSun {
-		sl, ac, cond, err := getDayCycleBySunMovement(bot.TimeZone, bot.Latitude, bot.Longitude)
-		if err == nil {
-			sleep, active = sl, ac
+		sl, ac, cond, err := getDayCycleBySunMovement(now, bot.location(), bot.Latitude, bot.Longitude, bot.Twilight)
+		if err == nil && bot.vacationOn(now.Add(sl)) != nil {
+			log.Printf("info: %s は休暇中なので、太陽が出ても起きません", bot.Name)
+		} else if err == nil {
+			sleep, active, nap = sl, ac, false
 			bot.Awake = ac
 			switch cond {
 			case "白夜":
 				log.Printf("info: %s がいる %s は今、白夜です", bot.Name, bot.PlaceName)
 				if !firstLaunch {
-					go func() {
+					bot.goSafe("post", func() {
 						toot := mastodon.Toot{Status: bot.PlaceName + "は、いま１日でいちばん暗い時間" + bot.Assertion + "。でも白夜だから寝ないの" + bot.Assertion + "よ"}
 						if err := bot.post(ctx, toot); err != nil {
 							log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
 						}
-					}()
+					})
 				}
 			case "極夜":
 				log.Printf("info: %s がいる %s は今、極夜です", bot.Name, bot.PlaceName)
 				if !firstLaunch && nextDayOfPolarNight {
-					go func() {
+					bot.goSafe("post", func() {
 						toot := mastodon.Toot{Status: bot.PlaceName + "は、いま１日でいちばん明るい時間" + bot.Assertion + "。でも極夜だから起きないの" + bot.Assertion + "よ💤……"}
 						if err := bot.post(ctx, toot); err != nil {
 							log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
 						}
-					}()
+					})
 				}
 			default:
 				log.Printf("info: %s の所在地、起床までの時間、起床後の活動時間：", bot.Name)
@@ -108,11 +199,12 @@ func (bot *Persona) spawn(ctx context.Context, db DB, firstLaunch bool, nextDayO
 		}
 	}
 
-	go bot.daylife(ctx, db, sleep, active, firstLaunch, nextDayOfPolarNight)
+	return
 }
 
-// daylife は、botの活動サイクルを作る
-func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, active time.Duration, firstLaunch bool, nextDayOfPolarNight bool) {
+// daylife は、botの活動サイクルを作る。napなら、眠りを同じ日の合間のひと休みとしてあいさつする。
+// 寝るまで戻らず、次の日が極夜の二日目以降かどうかを返す。
+func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, active time.Duration, nap bool, firstLaunch bool, nextDayOfPolarNight bool) bool {
 	wakeWithSun, sleepWithSun := "", ""
 	if bot.LivesWithSun {
 		wakeWithSun = "そろそろ明るくなってきた" + bot.Assertion + "ね。" + bot.PlaceName + "から"
@@ -120,31 +212,44 @@ func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, act
 	}
 
 	if sleep > 0 {
-		t := time.NewTimer(sleep)
+		t := bot.clock().NewTimer(sleep)
 		defer t.Stop()
-		if !firstLaunch && !nextDayOfPolarNight {
-			go func() {
-				toot := mastodon.Toot{Status: sleepWithSun + "おやすみなさい" + bot.Assertion + "💤……"}
+		now := bot.clock().Now()
+		msg := sleepWithSun + "おやすみなさい" + bot.Assertion + "💤……"
+		if v := bot.vacationBetween(now, now.Add(sleep)); v != nil {
+			msg = v.Farewell
+			if msg == "" {
+				_, m, d := v.to.Date()
+				msg = fmt.Sprintf("しばらくお休みする%sよ。%d月%d日まではお留守にする%sね。またね👋", bot.Assertion, int(m), d, bot.Assertion)
+			}
+			msg = bot.fillCalendar(msg)
+		} else if nap {
+			msg = "ちょっとひと休みする" + bot.Assertion + "ね💤"
+		}
+		if !firstLaunch && !nextDayOfPolarNight && bot.vacationOn(now) == nil {
+			bot.goSafe("post", func() {
+				toot := mastodon.Toot{Status: msg}
 				if err := bot.post(ctx, toot); err != nil {
 					log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
 				}
-			}()
+			})
 		}
 	LOOP:
 		for {
 			select {
-			case <-t.C:
+			case <-t.Chan():
 				break LOOP
 			case <-ctx.Done():
-				return
+				return nextDayOfPolarNight
 			}
 		}
 	}
 
-	newCtx, cancel := context.WithTimeout(ctx, active)
+	newCtx, cancel := withClockTimeout(ctx, bot.clock(), active)
 	defer cancel()
 
 	if active > 0 {
+		bot.awake.Store(true)
 		log.Printf("info: %s が起きたところ", bot.Name)
 		log.Printf("trace: Goroutines: %d", runtime.NumGoroutine())
 		nextDayOfPolarNight = false
@@ -152,8 +257,15 @@ func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, act
 		if err := bot.checkNotifications(newCtx); err != nil {
 			log.Printf("info: %s が通知を遡れませんでした。今回は諦めます……", bot.Name)
 		}
-		if sleep > 0 {
-			go func() {
+		if sleep > 0 && nap {
+			bot.goSafe("post", func() {
+				toot := mastodon.Toot{Status: "ひと休みおわり" + bot.Assertion + "！"}
+				if err := bot.post(newCtx, toot); err != nil {
+					log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
+				}
+			})
+		} else if sleep > 0 {
+			bot.goSafe("goodMorning", func() {
 				weatherStr := ""
 				data, err := GetLocationWeather(bot.commonSettings.weatherKey, bot.Latitude, bot.Longitude, 0)
 				if err != nil {
@@ -161,30 +273,40 @@ func (bot *Persona) daylife(ctx context.Context, db DB, sleep time.Duration, act
 				} else {
 					weatherStr = "。" + forecastMessage(bot.PlaceName, data, 0, bot.Assertion, true, false)
 				}
-				toot := mastodon.Toot{Status: wakeWithSun + "おはようございます" + bot.Assertion + weatherStr}
+				almanacStr := ""
+				if bot.Almanac {
+					almanacStr = "。" + bot.almanacOf(bot.clock().Now().In(bot.location())).message(bot.Assertion)
+				}
+				toot := mastodon.Toot{Status: wakeWithSun + "おはようございます" + bot.Assertion + almanacStr + weatherStr}
 				if err := bot.post(newCtx, toot); err != nil {
 					log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
 				}
-			}()
+			})
 		}
 	} else {
 		nextDayOfPolarNight = true
 	}
 
 	<-newCtx.Done()
+	if ctx.Err() != nil {
+		// 眠るのではなく止められたので、シャットダウンでお別れを言えるよう起きたままにしておく
+		return nextDayOfPolarNight
+	}
+	bot.awake.Store(false)
 	log.Printf("info: %s が寝たところ", bot.Name)
 	log.Printf("trace: Goroutines: %d", runtime.NumGoroutine())
-	if ctx.Err() == nil {
-		bot.spawn(ctx, db, false, nextDayOfPolarNight)
-	}
+	return nextDayOfPolarNight
 }
 
 // activities は、botの活動の全てを実行する
 func (bot *Persona) activities(ctx context.Context, db DB) {
-	go bot.periodicActivity(ctx, db)
-	go bot.monitor(ctx)
-	if len(bot.RandomToots) > 0 && bot.RandomFrequency > 0 {
-		go bot.randomToot(ctx)
+	bot.supervise(ctx, "periodicActivity", func(ctx context.Context) { bot.periodicActivity(ctx, db) })
+	for _, tl := range bot.timelines() {
+		bot.supervise(ctx, "monitor "+tl.name(), func(ctx context.Context) { bot.monitor(ctx, tl) })
+	}
+	bot.supervise(ctx, "scheduledPostActivity", func(ctx context.Context) { bot.scheduledPostActivity(ctx, db) })
+	if len(bot.randomToots()) > 0 && (bot.RandomFrequency > 0 || bot.randomSchedule != nil) {
+		bot.supervise(ctx, "randomToot", bot.randomToot)
 	}
 }
 
@@ -200,7 +322,9 @@ func (bot *Persona) checkNotifications(ctx context.Context) (err error) {
 	for _, n := range ns {
 		switch n.Type {
 		case "mention":
-			if err = bot.respondToMention(ctx, n.Account, n.Status); err != nil {
+			// 送信待ちに残した反応は、後で送られるので、通知は削除してよい
+			mctx := withIdempotencyKey(ctx, deriveIdempotencyKey(bot.Name, "notification", string(n.ID)))
+			if err = bot.respondToMention(mctx, n.Account, n.Status); err != nil && !errors.Is(err, errQueued) {
 				log.Printf("info: %s がメンションに反応できませんでした：%s", bot.Name, err)
 				return
 			}
@@ -236,110 +360,127 @@ func (ns Notifications) Less(i, j int) bool {
 	return iv < jv
 }
 
-// postはトゥートを投稿する。失敗したらmaxRetryを上限に再試行する。
+// postはトゥートを投稿する。失敗したらmaxRetryを上限に再試行し、それでも送れなければ送信待ちに残す。
 func (bot *Persona) post(ctx context.Context, toot mastodon.Toot) (err error) {
-	time.Sleep(time.Duration(rand.Intn(5000)+3000) * time.Millisecond)
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		_, err = bot.Client.PostStatus(ctx, &toot)
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s がトゥートできません：%s\n %s", bot.Name, toot.Status, err)
-		time.Sleep(bot.commonSettings.retryInterval)
-	}
+	_, err = bot.postStatus(ctx, toot)
+	return
+}
 
-	log.Printf("info: %s のトゥートがリトライ上限に達しました：%s\n %s", bot.Name, toot.Status, err)
+// postStatusはトゥートを投稿し、投稿されたステータスを返す。失敗したらmaxRetryを上限に再試行し、
+// それでも送れなければ送信待ちに残してerrQueuedを返す。
+func (bot *Persona) postStatus(ctx context.Context, toot mastodon.Toot) (st *mastodon.Status, err error) {
+	wctx, done, err := bot.begin(ctx)
+	if err != nil {
+		return
+	}
+	defer done()
+	if bot.DryRun {
+		return bot.dryRunPost(toot), nil
+	}
+	if err = bot.pause(ctx, 3, 8); err != nil {
+		return
+	}
+	st, err = bot.send(wctx, outboxAction{Kind: "post", Toot: &toot})
+	if err != nil && !errors.Is(err, errQueued) {
+		log.Printf("info: %s がトゥートできませんでした：%s", bot.Name, toot.Status)
+	}
 	return
 }
 
-// favは、ステータスをふぁぼる。失敗したらmaxRetryを上限に再試行する。
+// favは、ステータスをふぁぼる。失敗したらmaxRetryを上限に再試行し、それでも送れなければ送信待ちに残す。
 func (bot *Persona) fav(ctx context.Context, id mastodon.ID) (err error) {
-	time.Sleep(time.Duration(rand.Intn(2000)+1000) * time.Millisecond)
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		_, err = bot.Client.Favourite(ctx, id)
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s がふぁぼれません：%s", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
+	wctx, done, err := bot.begin(ctx)
+	if err != nil {
+		return
 	}
-
-	log.Printf("info: %s のふぁぼがリトライ上限に達しました：%s", bot.Name, err)
+	defer done()
+	if bot.DryRun {
+		bot.recordDryRun(Action{Kind: "favourite", TargetID: string(id)})
+		return
+	}
+	if err = bot.pause(ctx, 1, 3); err != nil {
+		return
+	}
+	_, err = bot.send(wctx, outboxAction{Kind: "favourite", TargetID: id})
 	return
 }
 
-// boostは、ステータスをブーストする。失敗したらmaxRetryを上限に再試行する。
+// boostは、ステータスをブーストする。失敗したらmaxRetryを上限に再試行し、それでも送れなければ送信待ちに残す。
 func (bot *Persona) boost(ctx context.Context, id mastodon.ID) (err error) {
-	time.Sleep(time.Duration(rand.Intn(5000)+3000) * time.Millisecond)
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		_, err = bot.Client.Reblog(ctx, id)
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s がブーストできません：%s\n", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
+	wctx, done, err := bot.begin(ctx)
+	if err != nil {
+		return
 	}
-
-	log.Printf("info: %s のブーストがリトライ上限に達しました：%s\n", bot.Name, err)
+	defer done()
+	if bot.DryRun {
+		bot.recordDryRun(Action{Kind: "reblog", TargetID: string(id)})
+		return
+	}
+	if err = bot.pause(ctx, 3, 8); err != nil {
+		return
+	}
+	_, err = bot.send(wctx, outboxAction{Kind: "reblog", TargetID: id})
 	return
 }
 
-// followは、アカウントをフォローする。失敗したらmaxRetryを上限に再試行する。
+// followは、アカウントをフォローする。失敗したらmaxRetryを上限に再試行し、それでも送れなければ送信待ちに残す。
 func (bot *Persona) follow(ctx context.Context, id mastodon.ID) (err error) {
-	time.Sleep(time.Duration(rand.Intn(2000)+1000) * time.Millisecond)
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		_, err = bot.Client.AccountFollow(ctx, id)
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s がフォローできません：%s", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
+	wctx, done, err := bot.begin(ctx)
+	if err != nil {
+		return
 	}
-
-	log.Printf("info: %s のフォローがリトライ上限に達しました：%s\n", bot.Name, err)
+	defer done()
+	if bot.DryRun {
+		bot.recordDryRun(Action{Kind: "follow", TargetID: string(id)})
+		return
+	}
+	if err = bot.pause(ctx, 1, 3); err != nil {
+		return
+	}
+	_, err = bot.send(wctx, outboxAction{Kind: "follow", TargetID: id})
 	return
 }
 
-// relationWithは、アカウントと自分との関係を取得する。失敗したらmaxRetryを上限に再実行する。
-func (bot *Persona) relationWith(ctx context.Context, id mastodon.ID) (rel []*mastodon.Relationship, err error) {
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		rel, err = bot.Client.GetAccountRelationships(ctx, []string{string(id)})
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s と id:%s の関係が取得できません：%s", bot.Name, string(id), err)
-		time.Sleep(bot.commonSettings.retryInterval)
+// pauseは、書き込みを送る前に、sendPauseのmin倍からmax倍までの間を置く。
+// 待っている間にシャットダウンや設定の読み直しでctxが終わったら、送るのをやめてctxのエラーを返す。
+func (bot *Persona) pause(ctx context.Context, min, max int) (err error) {
+	var d time.Duration
+	if bot.commonSettings != nil && bot.commonSettings.sendPause > 0 {
+		unit := bot.commonSettings.sendPause
+		d = unit*time.Duration(min) + time.Duration(rand.Int63n(int64(unit)*int64(max-min)))
 	}
+	return sleepContext(ctx, bot.clock(), d)
+}
 
-	log.Printf("info: %s と id:%s の関係取得がリトライ上限に達しました：%s", bot.Name, string(id), err)
+// relationWithは、アカウントと自分との関係を取得する。失敗したらmaxRetryを上限に再試行する。
+func (bot *Persona) relationWith(ctx context.Context, id mastodon.ID) (rel []*mastodon.Relationship, err error) {
+	err = bot.retry(ctx, "id:"+string(id)+" との関係取得", func() (err error) {
+		rel, err = bot.Client.GetAccountRelationships(ctx, []string{string(id)})
+		return
+	})
 	return
 }
 
 func (bot *Persona) notifications(ctx context.Context) (ns Notifications, err error) {
 	var pg mastodon.Pagination
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
+	err = bot.retry(ctx, "通知一覧の取得", func() (err error) {
 		ns, err = bot.Client.GetNotifications(ctx, &pg)
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s が通知一覧を取得できません：%s", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
-	}
-
-	log.Printf("info: %s の通知一覧取得がリトライ上限に達しました：%s", bot.Name, err)
+		return
+	})
 	return
 }
 
 func (bot *Persona) dismissNotification(ctx context.Context, id mastodon.ID) (err error) {
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		err = bot.Client.DismissNotification(ctx, id)
-		if err == nil {
-			return
-		}
-		log.Printf("info: %s が id:%s の通知を削除できません：%s", bot.Name, string(id), err)
-		time.Sleep(bot.commonSettings.retryInterval)
+	ctx, done, err := bot.begin(ctx)
+	if err != nil {
+		return
 	}
-
-	log.Printf("info: %s が id:%s の通知削除がリトライ上限に達しました：%s", bot.Name, string(id), err)
-	return err
+	defer done()
+	if bot.DryRun {
+		bot.recordDryRun(Action{Kind: "dismiss", TargetID: string(id)})
+		return
+	}
+	return bot.retry(ctx, "id:"+string(id)+" の通知削除", func() error {
+		return bot.Client.DismissNotification(ctx, id)
+	})
 }
@@ -0,0 +1,253 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+const (
+	// authScopes は、botがMastodonアプリに求める権限
+	authScopes = "read write follow push"
+	// oobRedirectURI は、認可コードをブラウザに表示させて、手で入力してもらうためのリダイレクト先
+	oobRedirectURI = "urn:ietf:wg:oauth:2.0:oob"
+	appWebsite     = "https://github.com/hanage999/mastobots"
+)
+
+// LoadPersona は、config.ymlから名前がnameのbotの設定だけを読み込み、設定ファイルのパスと一緒に返す。
+// AccessTokenがまだないbotも読み込めるように、設定の確認はしない。AccessTokenは env:・file: の参照のまま返す。
+func LoadPersona(name string) (bot *Persona, path string, err error) {
+	setupLog()
+	conf := newConfig()
+	if err = conf.ReadInConfig(); err != nil {
+		return
+	}
+	path = conf.ConfigFileUsed()
+	var bots []*Persona
+	if err = conf.UnmarshalKey("Personae", &bots); err != nil {
+		return
+	}
+	if bot, err = FindBot(bots, name); err != nil {
+		return
+	}
+	if bot.Instance == "" {
+		return nil, path, fmt.Errorf("%s の Instance が設定されていません", name)
+	}
+	for _, v := range []*string{&bot.ClientKey, &bot.ClientSecret} {
+		if *v, err = resolveSecret(*v); err != nil {
+			return nil, path, err
+		}
+	}
+	return
+}
+
+// RegisterApp は、botのMastodonサーバにアプリを登録し、承認用のURLを含むアプリの情報を返す。
+// ClientKeyとClientSecretが設定済みなら、登録し直さずにそれを使う。
+func (bot *Persona) RegisterApp(ctx context.Context) (app *mastodon.Application, err error) {
+	if bot.ClientKey != "" && bot.ClientSecret != "" {
+		app = &mastodon.Application{ClientID: bot.ClientKey, ClientSecret: bot.ClientSecret, RedirectURI: oobRedirectURI}
+	} else {
+		app, err = mastodon.RegisterApp(ctx, &mastodon.AppConfig{
+			Server:       bot.Instance,
+			ClientName:   "mastobots（" + bot.Name + "）",
+			RedirectURIs: oobRedirectURI,
+			Scopes:       authScopes,
+			Website:      appWebsite,
+		})
+		if err != nil {
+			return
+		}
+	}
+	u, err := url.Parse(bot.Instance)
+	if err != nil {
+		return
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/oauth/authorize"
+	u.RawQuery = url.Values{
+		"client_id":     {app.ClientID},
+		"redirect_uri":  {app.RedirectURI},
+		"response_type": {"code"},
+		"scope":         {authScopes},
+	}.Encode()
+	app.AuthURI = u.String()
+	bot.ClientKey, bot.ClientSecret = app.ClientID, app.ClientSecret
+	return
+}
+
+// Authorize は、承認画面で表示された認可コードをアクセストークンに換え、botのアカウントを確かめる
+func (bot *Persona) Authorize(ctx context.Context, app *mastodon.Application, code string) (acc *mastodon.Account, err error) {
+	c := mastodon.NewClient(&mastodon.Config{
+		Server:       bot.Instance,
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
+	})
+	if err = c.GetUserAccessToken(ctx, strings.TrimSpace(code), app.RedirectURI); err != nil {
+		return
+	}
+	if acc, err = c.GetAccountCurrentUser(ctx); err != nil {
+		return
+	}
+	bot.Client = c
+	bot.AccessToken = c.Config.AccessToken
+	bot.MyID = acc.ID
+	return
+}
+
+// SaveCredentials は、設定ファイルpathのbotの AccessToken をtokenに書き換える。
+// tokenは、アクセストークンそのものか、env:・file: の参照。saveAppがtrueなら、登録したアプリの ClientKey と ClientSecret も書き込む。
+// コメントや他のbotの設定はそのまま残す。
+func (bot *Persona) SaveCredentials(path, token string, saveApp bool) (err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	kvs := [][2]string{{"AccessToken", token}}
+	if saveApp {
+		kvs = append(kvs, [2]string{"ClientKey", bot.ClientKey}, [2]string{"ClientSecret", bot.ClientSecret})
+	}
+	out, err := setBotValues(string(b), bot.Name, kvs)
+	if err != nil {
+		return
+	}
+	return writeFileAtomic(path, []byte(out))
+}
+
+// SaveToken は、botのアクセストークンだけをファイルpathに書き込む。設定ファイルでは file:path として参照する。
+func (bot *Persona) SaveToken(path string) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+	return writeFileAtomic(path, []byte(bot.AccessToken+"\n"))
+}
+
+// writeFileAtomic は、一時ファイルに書いてから置き換える。元のファイルがあればその権限を引き継ぎ、なければ本人だけが読めるようにする。
+func writeFileAtomic(path string, data []byte) (err error) {
+	mode := os.FileMode(0600)
+	if fi, err := os.Stat(path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, mode); err != nil {
+		return
+	}
+	return os.Rename(tmp, path)
+}
+
+var (
+	itemLine  = regexp.MustCompile(`^(\s*)-(\s+|$)`)
+	nameValue = regexp.MustCompile(`^Name:\s*["']?([^"'#]*?)["']?\s*(#.*)?$`)
+	keyValue  = regexp.MustCompile(`^([A-Za-z]+):(\s*)([^#]*?)(\s+#.*)?$`)
+)
+
+// personaItem は、YAMLの Personae のbot一体分の行の範囲[start, end)と、その項目が始まる桁
+type personaItem struct {
+	start, end, col int
+}
+
+// keyAt は、lineの桁colから項目が始まっていれば、その前の部分（インデントや「- 」）と項目を返す
+func keyAt(line string, col int) (prefix, rest string, ok bool) {
+	if len(line) <= col || line[col] == ' ' || strings.Trim(line[:col], " -") != "" {
+		return
+	}
+	return line[:col], line[col:], true
+}
+
+// personaItems は、YAMLの Personae の「- 」で始まるbotごとの行の範囲を返す
+func personaItems(lines []string) (items []personaItem) {
+	from := -1
+	for i, l := range lines {
+		if strings.HasPrefix(l, "Personae:") {
+			from = i + 1
+			break
+		}
+	}
+	if from < 0 {
+		return
+	}
+	dash := -1
+	for i := from; i < len(lines); i++ {
+		l := lines[i]
+		t := strings.TrimSpace(l)
+		if t == "" || strings.HasPrefix(t, "#") {
+			continue
+		}
+		indent := len(l) - len(strings.TrimLeft(l, " "))
+		m := itemLine.FindStringSubmatch(l)
+		if dash < 0 && m != nil {
+			dash = indent
+		}
+		// Personae より浅いか、同じ深さの「- 」で、一体分が終わる
+		if indent == 0 || indent < dash || (m != nil && indent == dash) {
+			if len(items) > 0 {
+				items[len(items)-1].end = i
+			}
+			if indent == 0 || indent < dash {
+				return
+			}
+			col := len(m[0])
+			if len(l) == col {
+				col = -1 // 「-」だけの行なら、次の行の深さで決める
+			}
+			items = append(items, personaItem{start: i, end: len(lines), col: col})
+			continue
+		}
+		if len(items) == 0 {
+			continue
+		}
+		if it := &items[len(items)-1]; it.col < 0 {
+			it.col = indent
+		}
+	}
+	return
+}
+
+// setBotValues は、YAMLの Personae のうち、名前がnameのbotの項目を書き換える。なければ Name の次の行に足す。
+// botの項目は、そのbotの「- 」から次の「- 」までの、Name と同じ深さの行だけを見る。
+func setBotValues(yaml, name string, kvs [][2]string) (out string, err error) {
+	lines := strings.Split(yaml, "\n")
+	var item personaItem
+	nameAt := -1
+	for _, it := range personaItems(lines) {
+		for i := it.start; i < it.end && it.col >= 0; i++ {
+			if _, rest, ok := keyAt(lines[i], it.col); ok {
+				if m := nameValue.FindStringSubmatch(rest); m != nil && m[1] == name {
+					item, nameAt = it, i
+				}
+			}
+		}
+		if nameAt >= 0 {
+			break
+		}
+	}
+	if nameAt < 0 {
+		return "", fmt.Errorf("設定ファイルに %s というbotが見つかりません", name)
+	}
+
+	at := nameAt + 1
+	for _, kv := range kvs {
+		found := false
+		for i := item.start; i < item.end; i++ {
+			prefix, rest, ok := keyAt(lines[i], item.col)
+			if !ok {
+				continue
+			}
+			if m := keyValue.FindStringSubmatch(rest); m != nil && m[1] == kv[0] {
+				lines[i] = prefix + m[1] + ": " + kv[1] + m[4]
+				found = true
+				break
+			}
+		}
+		if !found {
+			lines = append(lines[:at], append([]string{strings.Repeat(" ", item.col) + kv[0] + ": " + kv[1]}, lines[at:]...)...)
+			at++
+			item.end++
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
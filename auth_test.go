@@ -0,0 +1,159 @@
+package mastobots
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestAuthorize(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	acc := srv.AddAccount("alice-token", mastodon.Account{Username: "alice", Bot: true})
+	ctx := context.Background()
+
+	bot := &Persona{Name: "alice", Instance: srv.URL}
+	app, err := bot.RegisterApp(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.ClientKey == "" || bot.ClientSecret == "" || app.AuthURI == "" {
+		t.Fatalf("アプリの情報が足りません：%+v", app)
+	}
+
+	if _, err := bot.Authorize(ctx, app, "wrong"); err == nil {
+		t.Error("間違った認可コードでアクセストークンが取得できてしまいました")
+	}
+	got, err := bot.Authorize(ctx, app, srv.IssueCode("alice-token")+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != acc.ID || bot.AccessToken != "alice-token" || bot.MyID != acc.ID {
+		t.Errorf("Authorize() = %+v、AccessToken %q", got, bot.AccessToken)
+	}
+
+	// 登録済みのアプリは使い回す
+	again, err := bot.RegisterApp(ctx)
+	if err != nil || again.ClientID != app.ClientID {
+		t.Errorf("RegisterApp() = %+v, %v, want ClientID %s", again, err, app.ClientID)
+	}
+}
+
+func TestSetBotValues(t *testing.T) {
+	in := `Personae:   # 各botの情報
+    -   Name: mybot
+        Instance: https://example.com
+        AccessToken: xxx    # 「開発」から生成
+        WakeHour: 6
+        Hashtags:
+            - mybot
+
+    -
+        Name: "mybot2"
+        Instance: https://example.com
+        AccessToken: yyy
+Other: 1
+`
+	out, err := setBotValues(in, "mybot", [][2]string{{"AccessToken", "newtoken"}, {"ClientKey", "key"}, {"ClientSecret", "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Personae:   # 各botの情報
+    -   Name: mybot
+        ClientKey: key
+        ClientSecret: secret
+        Instance: https://example.com
+        AccessToken: newtoken    # 「開発」から生成
+        WakeHour: 6
+        Hashtags:
+            - mybot
+
+    -
+        Name: "mybot2"
+        Instance: https://example.com
+        AccessToken: yyy
+Other: 1
+`
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	out, err = setBotValues(in, "mybot2", [][2]string{{"AccessToken", "env:TOKEN"}, {"ClientKey", "key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = `Personae:   # 各botの情報
+    -   Name: mybot
+        Instance: https://example.com
+        AccessToken: xxx    # 「開発」から生成
+        WakeHour: 6
+        Hashtags:
+            - mybot
+
+    -
+        Name: "mybot2"
+        ClientKey: key
+        Instance: https://example.com
+        AccessToken: env:TOKEN
+Other: 1
+`
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	if _, err := setBotValues(in, "nobody", nil); err == nil {
+		t.Error("いないbotの設定を書き換えられてしまいました")
+	}
+}
+
+func TestSetBotValuesWholeItem(t *testing.T) {
+	// 既にある項目は Name より前にあっても書き換え、入れ子の Name は別のbotと見なさない
+	in := `Personae:
+    -   AccessToken: old
+        ClientKey: oldkey   # 前のアプリ
+        Anniversaries:
+            -   Date: "04-01"
+                Name: mybot
+        Name: other
+    -   ClientSecret: s
+        AccessToken: xxx
+        Name: mybot
+        Instance: https://example.com
+`
+	out, err := setBotValues(in, "mybot", [][2]string{{"AccessToken", "newtoken"}, {"ClientKey", "key"}, {"ClientSecret", "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `Personae:
+    -   AccessToken: old
+        ClientKey: oldkey   # 前のアプリ
+        Anniversaries:
+            -   Date: "04-01"
+                Name: mybot
+        Name: other
+    -   ClientSecret: secret
+        AccessToken: newtoken
+        Name: mybot
+        ClientKey: key
+        Instance: https://example.com
+`
+	if out != want {
+		t.Errorf("got:\n%s\nwant:\n%s", out, want)
+	}
+
+	out, err = setBotValues(in, "other", [][2]string{{"AccessToken", "t"}, {"ClientKey", "key"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(out, "AccessToken: t\n") != 1 || !strings.Contains(out, "ClientKey: key   # 前のアプリ") || strings.Count(out, "AccessToken") != 2 {
+		t.Errorf("got:\n%s", out)
+	}
+
+	// Personae の外の Name は見ない
+	if _, err := setBotValues("Name: mybot\nPersonae:\n    - Name: other\n", "mybot", nil); err == nil {
+		t.Error("Personae の外の Name を書き換え先にしました")
+	}
+}
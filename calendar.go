@@ -0,0 +1,278 @@
+package mastobots
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Anniversary は、botが覚えている記念日を格納する。Dateは "01-02" または "2006-01-02" の形式。
+type Anniversary struct {
+	Date string
+	Name string
+}
+
+// almanac は、ある一日の暦と空の情報を格納する
+type almanac struct {
+	date          time.Time
+	moonAge       float64
+	moonPhase     string
+	sekki         string // 今日が二十四節気の日ならその名前
+	season        string // 今日が属する二十四節気
+	holiday       string
+	anniversaries []string
+}
+
+const synodicMonth = 29.530588853
+
+// 太陽黄経0度（春分）から15度ごとの二十四節気
+var sekkiNames = [24]string{
+	"春分", "清明", "穀雨", "立夏", "小満", "芒種",
+	"夏至", "小暑", "大暑", "立秋", "処暑", "白露",
+	"秋分", "寒露", "霜降", "立冬", "小雪", "大雪",
+	"冬至", "小寒", "大寒", "立春", "雨水", "啓蟄",
+}
+
+var moonPhaseNames = [8]string{"新月", "三日月", "上弦の月", "十三夜月", "満月", "寝待月", "下弦の月", "有明月"}
+
+var weekdayNames = [7]string{"日", "月", "火", "水", "木", "金", "土"}
+
+// moonAge は、時刻tにおける月齢を返す
+func moonAge(t time.Time) float64 {
+	// 2000-01-06 18:14 UTCの新月を起点とする
+	cycles := (julianDay(t) - 2451550.26) / synodicMonth
+	return (cycles - math.Floor(cycles)) * synodicMonth
+}
+
+// moonPhaseName は、月齢に対応する月の呼び名を返す
+func moonPhaseName(age float64) string {
+	idx := int(math.Floor(age/synodicMonth*8+0.5)) % 8
+	return moonPhaseNames[idx]
+}
+
+// solarLongitude は、時刻tにおける太陽の視黄経（度）を返す。
+// 節気の日付を正しく出すため、寝起きの計算より精度の高い、その日の春分点を基準とする式を使う。
+func solarLongitude(t time.Time) float64 {
+	days := julianDay(t) - jdJ2000
+	g := 357.528 + 0.9856003*days
+	l := 280.460 + 0.9856474*days
+	lambda := l + 1.915*sinDeg(g) + 0.020*sinDeg(2*g) - 0.00569 - 0.00478*sinDeg(125.04-0.052954*days)
+	return math.Mod(math.Mod(lambda, 360)+360, 360)
+}
+
+// sekkiOf は、dateの日に二十四節気を迎えるならその名前を、またその日が属する節気を返す
+func sekkiOf(date time.Time) (sekki, season string) {
+	y, m, d := date.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, date.Location())
+	end := start.AddDate(0, 0, 1)
+
+	from := int(math.Floor(solarLongitude(start) / 15))
+	to := int(math.Floor(solarLongitude(end) / 15))
+	season = sekkiNames[to%24]
+	if from != to {
+		sekki = season
+	}
+	return
+}
+
+// specialHolidays は、法律で一度だけ休日になった日
+var specialHolidays = map[string]string{
+	"1989-02-24": "昭和天皇の大喪の礼",
+	"1990-11-12": "即位礼正殿の儀",
+	"1993-06-09": "皇太子徳仁親王の結婚の儀",
+	"2019-05-01": "天皇の即位の日",
+	"2019-10-22": "即位礼正殿の儀",
+}
+
+// japaneseHolidays は、その年の日本の国民の祝日（振替休日・国民の休日を含む）を返す。
+// 1989年以降の祝日法の改正と、東京オリンピック・パラリンピックに伴う2020・2021年の移動に従う。
+// キーは "2006-01-02" 形式の日付。
+func japaneseHolidays(year int) (hs map[string]string) {
+	jst := time.FixedZone("JST", 9*60*60)
+	hs = make(map[string]string)
+	set := func(t time.Time, name string) {
+		hs[t.Format("2006-01-02")] = name
+	}
+	day := func(m time.Month, d int) time.Time {
+		return time.Date(year, m, d, 0, 0, 0, 0, jst)
+	}
+	// m月の第n月曜日
+	monday := func(m time.Month, n int) time.Time {
+		t := day(m, 1)
+		offset := (int(time.Monday) - int(t.Weekday()) + 7) % 7
+		return t.AddDate(0, 0, offset+7*(n-1))
+	}
+	// 春分・秋分を迎える日
+	equinox := func(m time.Month, name string) {
+		for d := 18; d <= 24; d++ {
+			if s, _ := sekkiOf(day(m, d)); s == name {
+				set(day(m, d), name+"の日")
+				return
+			}
+		}
+	}
+
+	set(day(time.January, 1), "元日")
+	if year >= 2000 {
+		set(monday(time.January, 2), "成人の日")
+	} else {
+		set(day(time.January, 15), "成人の日")
+	}
+	set(day(time.February, 11), "建国記念の日")
+	switch {
+	case year >= 2020:
+		set(day(time.February, 23), "天皇誕生日")
+	case year <= 2018:
+		set(day(time.December, 23), "天皇誕生日")
+	}
+	equinox(time.March, "春分")
+	if year >= 2007 {
+		set(day(time.April, 29), "昭和の日")
+		set(day(time.May, 4), "みどりの日")
+	} else {
+		set(day(time.April, 29), "みどりの日")
+	}
+	set(day(time.May, 3), "憲法記念日")
+	set(day(time.May, 5), "こどもの日")
+	switch {
+	case year == 2020:
+		set(day(time.July, 23), "海の日")
+	case year == 2021:
+		set(day(time.July, 22), "海の日")
+	case year >= 2003:
+		set(monday(time.July, 3), "海の日")
+	case year >= 1996:
+		set(day(time.July, 20), "海の日")
+	}
+	switch {
+	case year == 2020:
+		set(day(time.August, 10), "山の日")
+	case year == 2021:
+		set(day(time.August, 8), "山の日")
+	case year >= 2016:
+		set(day(time.August, 11), "山の日")
+	}
+	if year >= 2003 {
+		set(monday(time.September, 3), "敬老の日")
+	} else {
+		set(day(time.September, 15), "敬老の日")
+	}
+	equinox(time.September, "秋分")
+	switch {
+	case year == 2020:
+		set(day(time.July, 24), "スポーツの日")
+	case year == 2021:
+		set(day(time.July, 23), "スポーツの日")
+	case year >= 2022:
+		set(monday(time.October, 2), "スポーツの日")
+	case year >= 2000:
+		set(monday(time.October, 2), "体育の日")
+	default:
+		set(day(time.October, 10), "体育の日")
+	}
+	set(day(time.November, 3), "文化の日")
+	set(day(time.November, 23), "勤労感謝の日")
+	for key, name := range specialHolidays {
+		if strings.HasPrefix(key, fmt.Sprintf("%d-", year)) {
+			hs[key] = name
+		}
+	}
+
+	// 国民の休日（祝日に挟まれた平日）。挟むのは祝日だけなので、決めた休日は後で加える
+	var extra []time.Time
+	for t := day(time.January, 2); t.Year() == year; t = t.AddDate(0, 0, 1) {
+		_, prev := hs[t.AddDate(0, 0, -1).Format("2006-01-02")]
+		_, next := hs[t.AddDate(0, 0, 1).Format("2006-01-02")]
+		_, today := hs[t.Format("2006-01-02")]
+		if prev && next && !today && t.Weekday() != time.Sunday {
+			extra = append(extra, t)
+		}
+	}
+	for _, t := range extra {
+		set(t, "国民の休日")
+	}
+
+	// 振替休日（日曜日の祝日の後の、最初の祝日でない日。2006年までは翌日の月曜日だけ）
+	extra = extra[:0]
+	for key := range hs {
+		t, _ := time.ParseInLocation("2006-01-02", key, jst)
+		if t.Weekday() != time.Sunday {
+			continue
+		}
+		for t = t.AddDate(0, 0, 1); ; t = t.AddDate(0, 0, 1) {
+			if _, ok := hs[t.Format("2006-01-02")]; !ok {
+				extra = append(extra, t)
+				break
+			}
+			if year < 2007 {
+				break
+			}
+		}
+	}
+	for _, t := range extra {
+		if t.Year() == year {
+			set(t, "振替休日")
+		}
+	}
+
+	return
+}
+
+// almanacOf は、botから見たdateの日の暦と空の情報を返す
+func (bot *Persona) almanacOf(date time.Time) (a almanac) {
+	y, m, d := date.Date()
+	a.date = date
+	a.moonAge = moonAge(time.Date(y, m, d, 12, 0, 0, 0, date.Location()))
+	a.moonPhase = moonPhaseName(a.moonAge)
+	a.sekki, a.season = sekkiOf(date)
+	a.holiday = bot.holidayName(date)
+
+	for _, an := range bot.Anniversaries {
+		if an.Date == date.Format("01-02") || an.Date == date.Format("2006-01-02") {
+			a.anniversaries = append(a.anniversaries, an.Name)
+		}
+	}
+	return
+}
+
+// message は、今日は何の日かを告げる文を返す
+func (a almanac) message(assertion string) (msg string) {
+	_, m, d := a.date.Date()
+	msg = fmt.Sprintf("今日は%d月%d日（%s）", int(m), d, weekdayNames[a.date.Weekday()])
+	specials := make([]string, 0)
+	if a.holiday != "" {
+		specials = append(specials, a.holiday)
+	}
+	specials = append(specials, a.anniversaries...)
+	if a.sekki != "" {
+		specials = append(specials, "二十四節気の"+a.sekki)
+	}
+	if len(specials) > 0 {
+		msg += "、" + strings.Join(specials, "、")
+	}
+	msg += assertion + fmt.Sprintf("。月齢は%.1f、%s", a.moonAge, a.moonPhase) + assertion + "ね"
+	return
+}
+
+// fillCalendar は、文中の暦のプレースホルダを今日の値で置換する
+func (bot *Persona) fillCalendar(msg string) string {
+	if !strings.Contains(msg, "_") {
+		return msg
+	}
+	a := bot.almanacOf(bot.clock().Now().In(bot.location()))
+	_, m, d := a.date.Date()
+	special := a.holiday
+	if special == "" && len(a.anniversaries) > 0 {
+		special = a.anniversaries[0]
+	}
+	r := strings.NewReplacer(
+		"_date_", fmt.Sprintf("%d月%d日", int(m), d),
+		"_weekday_", weekdayNames[a.date.Weekday()],
+		"_moonphase_", a.moonPhase,
+		"_moonage_", fmt.Sprintf("%.1f", a.moonAge),
+		"_sekki_", a.season,
+		"_holiday_", special,
+	)
+	return r.Replace(msg)
+}
@@ -0,0 +1,111 @@
+package mastobots
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestJapaneseHolidays(t *testing.T) {
+	tests := []struct {
+		date string
+		want string
+	}{
+		{"2024-01-01", "元日"},
+		{"2024-01-08", "成人の日"},
+		{"1999-01-15", "成人の日"},
+		{"2023-01-02", "振替休日"},
+		{"2024-02-23", "天皇誕生日"},
+		{"2019-02-23", ""},
+		{"2018-12-23", "天皇誕生日"},
+		{"2018-12-24", "振替休日"},
+		{"2019-12-23", ""},
+		{"2024-03-20", "春分の日"},
+		{"2025-03-20", "春分の日"},
+		{"2006-04-29", "みどりの日"},
+		{"2006-05-04", "国民の休日"},
+		{"2007-04-29", "昭和の日"},
+		{"2007-04-30", "振替休日"},
+		{"2008-05-06", "振替休日"},
+		{"2019-04-30", "国民の休日"},
+		{"2019-05-01", "天皇の即位の日"},
+		{"2019-05-02", "国民の休日"},
+		{"2019-05-06", "振替休日"},
+		{"2019-10-14", "体育の日"},
+		{"2019-10-22", "即位礼正殿の儀"},
+		{"2020-07-20", ""},
+		{"2020-07-23", "海の日"},
+		{"2020-07-24", "スポーツの日"},
+		{"2020-08-10", "山の日"},
+		{"2020-08-11", ""},
+		{"2020-10-12", ""},
+		{"2021-07-22", "海の日"},
+		{"2021-07-23", "スポーツの日"},
+		{"2021-08-08", "山の日"},
+		{"2021-08-09", "振替休日"},
+		{"2022-10-10", "スポーツの日"},
+		{"2002-07-20", "海の日"},
+		{"2002-09-15", "敬老の日"},
+		{"2009-09-22", "国民の休日"},
+		{"2015-09-22", "国民の休日"},
+		{"2026-09-22", "国民の休日"},
+		{"2024-09-22", "秋分の日"},
+		{"2024-09-23", "振替休日"},
+		{"2024-11-04", "振替休日"},
+		{"2024-12-23", ""},
+	}
+	for _, tt := range tests {
+		d, _ := time.Parse("2006-01-02", tt.date)
+		if got := japaneseHolidays(d.Year())[tt.date]; got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.date, got, tt.want)
+		}
+	}
+}
+
+func TestSekkiOf(t *testing.T) {
+	jst := time.FixedZone("JST", 9*60*60)
+	tests := []struct {
+		date   string
+		sekki  string
+		season string
+	}{
+		{"2024-02-04", "立春", "立春"},
+		{"2024-02-05", "", "立春"},
+		{"2024-06-21", "夏至", "夏至"},
+		{"2024-12-21", "冬至", "冬至"},
+		{"2025-03-20", "春分", "春分"},
+		{"2023-09-23", "秋分", "秋分"},
+		{"2024-01-06", "小寒", "小寒"},
+	}
+	for _, tt := range tests {
+		d, _ := time.ParseInLocation("2006-01-02", tt.date, jst)
+		if sekki, season := sekkiOf(d); sekki != tt.sekki || season != tt.season {
+			t.Errorf("%s = %q, %q, want %q, %q", tt.date, sekki, season, tt.sekki, tt.season)
+		}
+	}
+}
+
+func TestMoonPhase(t *testing.T) {
+	tests := []struct {
+		at    time.Time
+		age   float64
+		phase string
+	}{
+		{time.Date(2024, 1, 11, 11, 57, 0, 0, time.UTC), 0, "新月"},
+		{time.Date(2024, 1, 18, 3, 53, 0, 0, time.UTC), 7.4, "上弦の月"},
+		{time.Date(2024, 1, 25, 17, 54, 0, 0, time.UTC), 14.8, "満月"},
+		{time.Date(2024, 2, 2, 23, 18, 0, 0, time.UTC), 22.1, "下弦の月"},
+	}
+	for _, tt := range tests {
+		age := moonAge(tt.at)
+		// 新月の直前なら29.5に近い
+		diff := math.Abs(age - tt.age)
+		diff = math.Min(diff, synodicMonth-diff)
+		if diff > 0.7 {
+			t.Errorf("%s の月齢 = %.2f, want %.1f", tt.at, age, tt.age)
+		}
+		if got := moonPhaseName(age); got != tt.phase {
+			t.Errorf("%s = %s, want %s", tt.at, got, tt.phase)
+		}
+	}
+}
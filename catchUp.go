@@ -0,0 +1,171 @@
+package mastobots
+
+import (
+	"context"
+	"log"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+const (
+	// catchUpPage は、取りこぼしを取り戻す時に一度に取得するステータス・通知の数
+	catchUpPage = 40
+	// catchUpMax は、一回の再接続で取り戻すステータス・通知の数の上限。これより古いものは諦める。
+	catchUpMax = 200
+)
+
+// streamCursor は、ストリーミングで受け取った一番新しいステータスと通知のID。再接続した時に、これより新しいものを取り戻す。
+// IDが空でも、known なら「まだ一つもない」ことが分かっているので、届いたものを全て取り戻す。
+// 遅れて連合してきたステータスは一番新しいものより古いIDで届くので、受け取ったかどうかは最近のIDで見分ける。
+type streamCursor struct {
+	status            mastodon.ID
+	notification      mastodon.ID
+	statusKnown       bool
+	notificationKnown bool
+	seenStatuses      recentIDs
+	seenNotifications recentIDs
+}
+
+// newerID は、aがbより新しいIDかどうかを返す。IDは数字の文字列なので、桁数が多い方が新しい。
+func newerID(a, b mastodon.ID) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// seeStatus は、ステータスidを受け取ったことを覚える。既に受け取ったものならfalseを返す。
+func (c *streamCursor) seeStatus(id mastodon.ID) bool {
+	if !c.seenStatuses.add(id) {
+		return false
+	}
+	if c.status == "" || newerID(id, c.status) {
+		c.status = id
+	}
+	c.statusKnown = true
+	return true
+}
+
+// seeNotification は、通知idを受け取ったことを覚える。既に受け取ったものならfalseを返す。
+func (c *streamCursor) seeNotification(id mastodon.ID) bool {
+	if !c.seenNotifications.add(id) {
+		return false
+	}
+	if c.notification == "" || newerID(id, c.notification) {
+		c.notification = id
+	}
+	c.notificationKnown = true
+	return true
+}
+
+// seeded は、タイムラインtlで取りこぼしを取り戻す起点が、全て分かっているかどうかを返す
+func (c *streamCursor) seeded(tl Timeline) bool {
+	return (tl.notificationsOnly || c.statusKnown) && (tl.Type != "home" || c.notificationKnown)
+}
+
+// seedCursor は、タイムラインtl（ホームタイムラインなら通知も）の最新のIDを、curでまだ分かっていない取りこぼしを取り戻す起点にする。
+// 取得できなければ、その分は最初の切断の後に取り戻せない。ポーリングでは、分かるまで取得し直す。
+func (bot *Persona) seedCursor(ctx context.Context, tl Timeline, cur *streamCursor) {
+	pg := func() *mastodon.Pagination { return &mastodon.Pagination{Limit: 1} }
+	if !tl.notificationsOnly && !cur.statusKnown {
+		var sts []*mastodon.Status
+		if err := bot.retry(ctx, tl.name()+"の取得", func() (err error) {
+			sts, err = bot.fetchTimeline(ctx, tl, pg())
+			return
+		}); err == nil {
+			cur.statusKnown = true
+			if len(sts) > 0 {
+				cur.status = sts[0].ID
+			}
+		}
+	}
+	if tl.Type != "home" || cur.notificationKnown {
+		return
+	}
+	var ns []*mastodon.Notification
+	if err := bot.retry(ctx, "通知一覧の取得", func() (err error) {
+		ns, err = bot.Client.GetNotifications(ctx, pg())
+		return
+	}); err == nil {
+		cur.notificationKnown = true
+		if len(ns) > 0 {
+			cur.notification = ns[0].ID
+		}
+	}
+	return
+}
+
+// missedStatuses は、タイムラインtlでsinceより新しいステータスを、古い順に最大catchUpMax件返す
+func (bot *Persona) missedStatuses(ctx context.Context, tl Timeline, since mastodon.ID) (sts []*mastodon.Status, err error) {
+	for min := since; len(sts) < catchUpMax; {
+		var page []*mastodon.Status
+		err = bot.retry(ctx, "取りこぼしたステータスの取得", func() (err error) {
+			page, err = bot.fetchTimeline(ctx, tl, &mastodon.Pagination{MinID: min, Limit: catchUpPage})
+			return
+		})
+		if err != nil || len(page) == 0 {
+			return
+		}
+		// 新しい順に返ってくる
+		for i := len(page) - 1; i >= 0 && len(sts) < catchUpMax; i-- {
+			sts = append(sts, page[i])
+		}
+		min = page[0].ID
+	}
+	log.Printf("info: %s の%sで取りこぼしたステータスが多すぎるので、%d件で打ち切ります", bot.Name, tl.name(), catchUpMax)
+	return
+}
+
+// missedNotifications は、sinceより新しい通知を、古い順に最大catchUpMax件返す
+func (bot *Persona) missedNotifications(ctx context.Context, since mastodon.ID) (ns []*mastodon.Notification, err error) {
+	for min := since; len(ns) < catchUpMax; {
+		var page []*mastodon.Notification
+		err = bot.retry(ctx, "取りこぼした通知の取得", func() (err error) {
+			page, err = bot.Client.GetNotifications(ctx, &mastodon.Pagination{MinID: min, Limit: catchUpPage})
+			return
+		})
+		if err != nil || len(page) == 0 {
+			return
+		}
+		for i := len(page) - 1; i >= 0 && len(ns) < catchUpMax; i-- {
+			ns = append(ns, page[i])
+		}
+		min = page[0].ID
+	}
+	log.Printf("info: %s の取りこぼした通知が多すぎるので、%d件で打ち切ります", bot.Name, catchUpMax)
+	return
+}
+
+// catchUp は、curより後にタイムラインtlに届いたステータスと通知を取得して、ストリーミングで受け取ったのと同じように反応する。
+// ストリーミングが切れていた間の取りこぼしを取り戻すのと、ポーリングに使う。取得できなかったら、そのエラーを返す。
+func (bot *Persona) catchUp(ctx context.Context, tl Timeline, cur *streamCursor) (err error) {
+	if cur.statusKnown {
+		sts, serr := bot.missedStatuses(ctx, tl, cur.status)
+		if serr != nil {
+			log.Printf("info: %s が%sで取りこぼしたステータスを取得できませんでした：%s", bot.Name, tl.name(), serr)
+			err = serr
+		}
+		if len(sts) > 0 {
+			log.Printf("info: %s が%sのステータス%d件を取り戻しました", bot.Name, tl.name(), len(sts))
+		}
+		for _, st := range sts {
+			bot.handleEvent(ctx, tl, cur, &mastodon.UpdateEvent{Status: st})
+		}
+	}
+	if cur.notificationKnown {
+		ns, nerr := bot.missedNotifications(ctx, cur.notification)
+		if nerr != nil {
+			log.Printf("info: %s が取りこぼした通知を取得できませんでした：%s", bot.Name, nerr)
+			if err == nil {
+				err = nerr
+			}
+		}
+		if len(ns) > 0 {
+			log.Printf("info: %s が通知%d件を取り戻しました", bot.Name, len(ns))
+		}
+		for _, n := range ns {
+			bot.handleEvent(ctx, tl, cur, &mastodon.NotificationEvent{Notification: n})
+		}
+	}
+	return
+}
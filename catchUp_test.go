@@ -0,0 +1,147 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestNewerID(t *testing.T) {
+	tests := []struct {
+		a, b mastodon.ID
+		want bool
+	}{
+		{"2", "1", true},
+		{"1", "2", false},
+		{"10", "9", true},
+		{"9", "10", false},
+		{"5", "5", false},
+		{"110000000000000001", "109999999999999999", true},
+	}
+	for _, tt := range tests {
+		if got := newerID(tt.a, tt.b); got != tt.want {
+			t.Errorf("newerID(%s, %s) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestStreamCursor(t *testing.T) {
+	var cur streamCursor
+	for _, tt := range []struct {
+		id   mastodon.ID
+		want bool
+	}{{"5", true}, {"5", false}, {"12", true}, {"9", true}, {"9", false}, {"12", false}} {
+		if got := cur.seeStatus(tt.id); got != tt.want {
+			t.Errorf("seeStatus(%s) = %t, want %t", tt.id, got, tt.want)
+		}
+	}
+	// 遅れて届いた古いIDも受け取るが、取り戻す起点は一番新しいIDのまま
+	if cur.status != "12" {
+		t.Errorf("取り戻す起点 = %s, want 12", cur.status)
+	}
+	if !cur.seeNotification("3") || cur.seeNotification("3") {
+		t.Error("通知とステータスのIDは別々に覚えるはずです")
+	}
+}
+
+func TestMissedStatusesPages(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	author := mastodon.Account{ID: "7", Username: "human", Acct: "human@example.com"}
+
+	first := srv.PushStatus("alice", mastodon.Status{Account: author, Content: "<p>0</p>"})
+	var want []mastodon.ID
+	for i := 1; i <= catchUpPage+5; i++ {
+		want = append(want, srv.PushStatus("alice", mastodon.Status{Account: author, Content: fmt.Sprintf("<p>%d</p>", i)}).ID)
+	}
+
+	sts, err := bot.missedStatuses(context.Background(), Timeline{Type: "home"}, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != len(want) {
+		t.Fatalf("%d件取り戻しました, want %d", len(sts), len(want))
+	}
+	for i, st := range sts {
+		if st.ID != want[i] {
+			t.Fatalf("%d件目は %s, want %s（古い順）", i, st.ID, want[i])
+		}
+	}
+}
+
+func TestIntegrationStreamingCatchUp(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.Keywords = []string{"coffee"}
+		bot.Comments = []string{"_keyword1_!"}
+	})
+	human := mastodon.Account{ID: "7", Username: "human", Acct: "human@example.com"}
+	// 監視を始める前のトゥートには反応しない
+	srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Yesterday's coffee</p>"})
+
+	stop := runBots(t, clk, db, 60, bot)
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 1 }) {
+		stop()
+		t.Fatal("ストリーミングに接続しませんでした")
+	}
+	live := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Morning coffee</p>"})
+	if !srv.WaitFor(parseWait, func() bool { return len(srv.Favourited("alice")) == 1 }) {
+		stop()
+		t.Fatal("ストリーミングで受け取ったトゥートに反応しませんでした")
+	}
+
+	// 切れている間のトゥートとメンションは、再接続した時に取り戻す
+	srv.DisconnectStreams("alice")
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 0 }) {
+		stop()
+		t.Fatal("切断できませんでした")
+	}
+	missed := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Afternoon coffee</p>"})
+	fan := mastodon.Account{ID: "42", Username: "fan", Acct: "fan@example.com"}
+	n := srv.PushNotification("alice", mastodon.Notification{
+		Type:    "mention",
+		Account: fan,
+		Status:  &mastodon.Status{Account: fan, Content: "<p>@alice hello</p>"},
+	})
+
+	for i := 0; i < 50 && srv.Streams("alice") == 0; i++ {
+		clk.Advance(2 * streamBackoffMin)
+		time.Sleep(20 * time.Millisecond)
+	}
+	ok := srv.WaitFor(parseWait, func() bool {
+		return len(srv.Favourited("alice")) == 3 && len(srv.Dismissed("alice")) == 1
+	})
+	time.Sleep(100 * time.Millisecond)
+	stop()
+
+	if !ok {
+		t.Fatalf("切断中のトゥートと通知を取り戻しませんでした：ふぁぼ %v、削除 %v", srv.Favourited("alice"), srv.Dismissed("alice"))
+	}
+	want := []mastodon.ID{live.ID, missed.ID, n.Status.ID}
+	got := srv.Favourited("alice")
+	if len(got) != len(want) {
+		t.Fatalf("ふぁぼったのは %v, want %v", got, want)
+	}
+	favs := map[mastodon.ID]bool{}
+	for _, id := range got {
+		favs[id] = true
+	}
+	for _, id := range want {
+		if !favs[id] {
+			t.Errorf("ふぁぼったのは %v, want %v", got, want)
+		}
+	}
+	if got := srv.Dismissed("alice")[0]; got != n.ID {
+		t.Errorf("削除した通知は %s, want %s", got, n.ID)
+	}
+}
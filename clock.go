@@ -0,0 +1,65 @@
+package mastobots
+
+import (
+	"context"
+	"time"
+)
+
+// Clock は、現在時刻とタイマーを提供する。テストでは時刻を自由に進められる時計に差し替える。
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer は、Clockが作るタイマー
+type Timer interface {
+	Chan() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker は、Clockが作るティッカー
+type Ticker interface {
+	Chan() <-chan time.Time
+	Stop()
+}
+
+// realClock は、実際の時刻に従うClock
+type realClock struct{}
+
+type realTimer struct{ *time.Timer }
+
+type realTicker struct{ *time.Ticker }
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer { return realTimer{time.NewTimer(d)} }
+
+func (realClock) NewTicker(d time.Duration) Ticker { return realTicker{time.NewTicker(d)} }
+
+func (t realTimer) Chan() <-chan time.Time { return t.C }
+
+func (t realTicker) Chan() <-chan time.Time { return t.C }
+
+// clock は、botが使うClockを返す
+func (bot *Persona) clock() Clock {
+	if bot.commonSettings == nil || bot.commonSettings.clk == nil {
+		return realClock{}
+	}
+	return bot.commonSettings.clk
+}
+
+// withClockTimeout は、clkの時刻でdが経過したらキャンセルされるContextを返す
+func withClockTimeout(ctx context.Context, clk Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	newCtx, cancel := context.WithCancel(ctx)
+	t := clk.NewTimer(d)
+	go func() {
+		defer t.Stop()
+		select {
+		case <-t.Chan():
+			cancel()
+		case <-newCtx.Done():
+		}
+	}()
+	return newCtx, cancel
+}
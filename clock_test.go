@@ -0,0 +1,175 @@
+package mastobots
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock は、Advanceを呼んだ時だけ進むテスト用のClock。Sleepはすぐに戻る。
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clk     *fakeClock
+	c       chan time.Time
+	at      time.Time
+	period  time.Duration
+	stopped bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+func (c *fakeClock) newTimer(d, period time.Duration) *fakeTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{clk: c, c: make(chan time.Time, 1), at: c.now.Add(d), period: period}
+	if d <= 0 && period == 0 {
+		t.c <- c.now
+		t.stopped = true
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance は、時計をdだけ進め、その間に期限を迎えたタイマーを期限順に発火させる
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	target := c.now.Add(d)
+	for {
+		active := c.activeLocked()
+		sort.Slice(active, func(i, j int) bool { return active[i].at.Before(active[j].at) })
+		if len(active) == 0 || active[0].at.After(target) {
+			break
+		}
+		t := active[0]
+		c.now = t.at
+		select {
+		case t.c <- t.at:
+		default:
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			t.stopped = true
+		}
+	}
+	c.now = target
+}
+
+func (c *fakeClock) activeLocked() (active []*fakeTimer) {
+	for _, t := range c.timers {
+		if !t.stopped {
+			active = append(active, t)
+		}
+	}
+	return
+}
+
+// waitForTimers は、動いているタイマーがn個になるまで待つ
+func (c *fakeClock) waitForTimers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		active := len(c.activeLocked())
+		c.mu.Unlock()
+		if active >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("タイマーが%d個になりませんでした", n)
+}
+
+func (t *fakeTimer) Chan() <-chan time.Time { return t.c }
+
+func (t *fakeTimer) Stop() bool {
+	t.clk.mu.Lock()
+	defer t.clk.mu.Unlock()
+	was := !t.stopped
+	t.stopped = true
+	return was
+}
+
+type fakeTicker struct{ *fakeTimer }
+
+func (t fakeTicker) Stop() { t.fakeTimer.Stop() }
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("タイムゾーン %s が読み込めません：%s", name, err)
+	}
+	return loc
+}
+
+func TestWithClockTimeout(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 1, 1, 23, 59, 0, 0, time.UTC))
+	ctx, cancel := withClockTimeout(context.Background(), clk, 2*time.Minute)
+	defer cancel()
+	clk.waitForTimers(t, 1)
+
+	clk.Advance(time.Minute)
+	select {
+	case <-ctx.Done():
+		t.Fatal("期限前にキャンセルされました")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.Advance(time.Minute)
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("期限を過ぎてもキャンセルされませんでした")
+	}
+}
+
+func TestActivateBotsTimeout(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 3, 10, 1, 59, 30, 0, mustLoadLocation(t, "America/New_York")))
+	done := make(chan error, 1)
+	go func() {
+		done <- activateBots(context.Background(), nil, DB{}, 1, clk, nil, nil)
+	}()
+	clk.waitForTimers(t, 1)
+
+	clk.Advance(59 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("-p で指定した時間の前に終了しました")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("エラーで終了しました：%s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("-p で指定した時間が経っても終了しませんでした")
+	}
+}
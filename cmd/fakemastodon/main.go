@@ -0,0 +1,44 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func main() {
+	os.Exit(run())
+}
+
+func run() (exitCode int) {
+	// フラグ読み込み
+	var addr = flag.String("addr", "localhost:3000", "待ち受けるアドレス")
+	var tokens = flag.String("tokens", "", "受け付けるアクセストークン（「トークン:ユーザ名」をカンマ区切り）")
+	flag.Parse()
+
+	s := mastotest.New()
+	s.URL = "http://" + *addr
+	for _, pair := range strings.Split(*tokens, ",") {
+		if pair == "" {
+			continue
+		}
+		token, name, _ := strings.Cut(pair, ":")
+		if name == "" {
+			name = token
+		}
+		acc := s.AddAccount(token, mastodon.Account{Username: name, DisplayName: name, Bot: true})
+		log.Printf("info: アカウント %s（id:%s）をトークン %s で登録しました", name, acc.ID, token)
+	}
+
+	log.Printf("info: 偽のMastodonサーバを %s で起動します", s.URL)
+	if err := http.ListenAndServe(*addr, s); err != nil {
+		log.Printf("alert: 偽のMastodonサーバが停止しました：%s", err)
+		exitCode = 1
+	}
+	return
+}
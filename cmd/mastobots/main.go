@@ -1,41 +1,391 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
 	"github.com/hanage999/mastobots"
 )
 
+// command は、サブコマンドの説明と実行する関数を格納する
+type command struct {
+	usage string
+	run   func(args []string) int
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"run":           {"[-p 分] [-dry-run]　botたちを活動させる（サブコマンド省略時も同じ）", runBots},
+		"check-config":  {"　設定ファイルを読み込んで確認する（サーバには接続しない。問題があれば終了コード1）", checkConfig},
+		"list-bots":     {"　botの一覧と、次に起きる・寝る時刻を表示する", listBots},
+		"post":          {"[-visibility 公開範囲] [-dry-run] <bot> <テキスト>　botとして投稿する", post},
+		"preview":       {"<bot>　次のニューストゥートを投稿せずに表示する", preview},
+		"candidates":    {"<bot>　ストックしている投稿候補を表示する", candidates},
+		"reset-checked": {"<bot> [アイテムID]　RSSアイテムをどこまで見たかの記録を戻す（省略時は0）", resetChecked},
+		"weather":       {"[-when -1〜2] [-bot 名前] <地名>　天気予報を表示する", weather},
+		"whoami":        {"<bot>　botのMastodonアカウントを表示する", whoami},
+		"auth":          {"[-token-file パス] <bot>　Mastodonサーバにアプリを登録し、botのアクセストークンを取得して設定ファイルに書き込む", auth},
+	}
+}
+
+var order = []string{"run", "check-config", "list-bots", "post", "preview", "candidates", "reset-checked", "weather", "whoami", "auth"}
+
 func main() {
-	os.Exit(run())
+	os.Exit(run(os.Args[1:]))
 }
 
-func run() (exitCode int) {
-	exitCode = 0
+func run(args []string) (exitCode int) {
+	name := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage()
+		return 2
+	}
+	return cmd.run(args)
+}
 
-	// 初期化
+func usage() {
+	fmt.Fprintln(os.Stderr, "使い方：mastobots <サブコマンド> [引数]")
+	for _, name := range order {
+		fmt.Fprintf(os.Stderr, "  %s %s\n", name, commands[name].usage)
+	}
+}
 
-	// フラグ読み込み
-	var p = flag.Int("p", 0, "実行終了までの時間（分）")
-	flag.Parse()
+// parseFlags は、サブコマンドのフラグを解析し、必要な数の引数があるか確かめる
+func parseFlags(fs *flag.FlagSet, args []string, nArgs int) bool {
+	if err := fs.Parse(args); err != nil {
+		return false
+	}
+	if fs.NArg() < nArgs {
+		fmt.Fprintf(os.Stderr, "使い方：mastobots %s %s\n", fs.Name(), commands[fs.Name()].usage)
+		return false
+	}
+	return true
+}
+
+// loadBot は、設定ファイルを読み込み、名前がnameのbotを返す
+func loadBot(name string) (bots []*mastobots.Persona, bot *mastobots.Persona, err error) {
+	bots, err = mastobots.LoadConfig()
+	if err != nil {
+		log.Printf("alert: 設定ファイルが読み込めませんでした：%s", err)
+		return
+	}
+	if bot, err = mastobots.FindBot(bots, name); err != nil {
+		log.Printf("alert: %s", err)
+	}
+	return
+}
+
+func runBots(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	var p = fs.Int("p", 0, "実行終了までの時間（分）")
+	var dryRun = fs.Bool("dry-run", false, "投稿・ふぁぼ・ブースト・フォロー・通知削除を実際には行わず、DryRunSinkに記録する")
+	if !parseFlags(fs, args, 0) {
+		return 2
+	}
 
 	// もろもろ準備
+	mastobots.SetDryRun(*dryRun)
 	bots, db, err := mastobots.Initialize()
 	if err != nil {
 		log.Printf("alert: 初期化に失敗しました：%s", err)
-		exitCode = 1
-		return
+		return 1
 	}
 	defer db.Close()
 
+	// dry-run
+	for _, bot := range bots {
+		if bot.DryRun {
+			log.Printf("info: %s はdry-runで動きます。実際には投稿しません", bot.Name)
+		}
+	}
+
 	// 活動開始
 	if err = mastobots.ActivateBots(bots, db, *p); err != nil {
+		var errs mastobots.BotErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				log.Printf("alert: %s", e)
+			}
+			err = errors.New("全てのbotが活動を続けられなくなりました")
+		}
 		log.Printf("alert: 停止しました：%s", err)
-		exitCode = 1
-		return
+		return 1
+	}
+
+	return
+}
+
+func checkConfig(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	if !parseFlags(fs, args, 0) {
+		return 2
+	}
+	bots, err := mastobots.LoadConfig()
+	var errs mastobots.ConfigErrors
+	switch {
+	case errors.As(err, &errs):
+		for _, e := range errs {
+			fmt.Printf("NG：%s\n", e)
+		}
+		fmt.Printf("%d件の問題があります\n", len(errs))
+		return 1
+	case err != nil:
+		fmt.Printf("NG：%s\n", err)
+		return 1
+	}
+	fmt.Printf("OK：%d体のbotの設定を読み込みました\n", len(bots))
+	return
+}
+
+func listBots(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("list-bots", flag.ContinueOnError)
+	if !parseFlags(fs, args, 0) {
+		return 2
+	}
+	bots, err := mastobots.LoadConfig()
+	if err != nil {
+		log.Printf("alert: 設定ファイルが読み込めませんでした：%s", err)
+		return 1
+	}
+	for _, bot := range bots {
+		fmt.Print(bot.Describe())
+	}
+	return
+}
+
+func post(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("post", flag.ContinueOnError)
+	var visibility = fs.String("visibility", "", "公開範囲（public, unlisted, private, direct）")
+	var dryRun = fs.Bool("dry-run", false, "実際には投稿せず、DryRunSinkに記録する")
+	if !parseFlags(fs, args, 2) {
+		return 2
+	}
+	_, bot, err := loadBot(fs.Arg(0))
+	if err != nil {
+		return 1
+	}
+	if *dryRun {
+		bot.DryRun = true
+	}
+	url, err := bot.Post(context.Background(), strings.Join(fs.Args()[1:], " "), *visibility)
+	if err != nil {
+		log.Printf("alert: %s が投稿できませんでした：%s", bot.Name, err)
+		return 1
+	}
+	fmt.Println(url)
+	return
+}
+
+func preview(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("preview", flag.ContinueOnError)
+	if !parseFlags(fs, args, 1) {
+		return 2
+	}
+	_, bot, err := loadBot(fs.Arg(0))
+	if err != nil {
+		return 1
+	}
+	db, err := mastobots.LookupDB([]*mastobots.Persona{bot})
+	if err != nil {
+		return 1
+	}
+	defer db.Close()
+
+	toot, item, err := bot.PreviewNewsToot(db)
+	if err != nil {
+		log.Printf("alert: %s", err)
+		return 1
+	}
+	fmt.Printf("アイテム id:%d %s\n\n%s\n", item.ID, item.Title, toot.Status)
+	return
+}
+
+func candidates(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("candidates", flag.ContinueOnError)
+	if !parseFlags(fs, args, 1) {
+		return 2
+	}
+	_, bot, err := loadBot(fs.Arg(0))
+	if err != nil {
+		return 1
+	}
+	db, err := mastobots.LookupDB([]*mastobots.Persona{bot})
+	if err != nil {
+		return 1
+	}
+	defer db.Close()
+
+	cds, err := db.Candidates(bot)
+	if err != nil {
+		log.Printf("alert: %s", err)
+		return 1
+	}
+	for _, c := range cds {
+		fmt.Printf("%6d  %s  %-10s  %3d %-12s  %s\n", c.ID, c.StockedAt.Format("01-02 15:04"), c.Keyword, c.Score, c.Word, c.Title)
+	}
+	fmt.Printf("%d件\n", len(cds))
+	return
+}
+
+func resetChecked(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("reset-checked", flag.ContinueOnError)
+	if !parseFlags(fs, args, 1) {
+		return 2
+	}
+	until := 0
+	if fs.NArg() > 1 {
+		var err error
+		if until, err = strconv.Atoi(fs.Arg(1)); err != nil || until < 0 {
+			fmt.Fprintf(os.Stderr, "アイテムID %q が不正です\n", fs.Arg(1))
+			return 2
+		}
+	}
+	_, bot, err := loadBot(fs.Arg(0))
+	if err != nil {
+		return 1
+	}
+	db, err := mastobots.OpenDB([]*mastobots.Persona{bot})
+	if err != nil {
+		return 1
+	}
+	defer db.Close()
+
+	if err = db.ResetChecked(bot, until); err != nil {
+		return 1
+	}
+	fmt.Printf("%s は、アイテムid %d より後を見直します\n", bot.Name, until)
+	return
+}
+
+func weather(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("weather", flag.ContinueOnError)
+	var when = fs.Int("when", -1, "-1は今、0は今日、1は明日、2は明後日")
+	var name = fs.String("bot", "", "口調と地名検索に使うbot（省略時は最初のbot）")
+	if !parseFlags(fs, args, 1) {
+		return 2
+	}
+	if *when < -1 || *when > 2 {
+		fmt.Fprintln(os.Stderr, "-when は -1〜2 で指定してください")
+		return 2
+	}
+	bots, err := mastobots.LoadConfig()
+	if err != nil {
+		log.Printf("alert: 設定ファイルが読み込めませんでした：%s", err)
+		return 1
+	}
+	if len(bots) == 0 {
+		log.Printf("alert: botが一体も設定されていません")
+		return 1
+	}
+	bot := bots[0]
+	if *name != "" {
+		if bot, err = mastobots.FindBot(bots, *name); err != nil {
+			log.Printf("alert: %s", err)
+			return 1
+		}
+	}
+	msg, err := bot.Forecast(strings.Join(fs.Args(), ""), *when)
+	if err != nil {
+		log.Printf("alert: 天気予報が取得できませんでした：%s", err)
+		return 1
+	}
+	fmt.Println(msg)
+	return
+}
+
+func whoami(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("whoami", flag.ContinueOnError)
+	if !parseFlags(fs, args, 1) {
+		return 2
+	}
+	_, bot, err := loadBot(fs.Arg(0))
+	if err != nil {
+		return 1
+	}
+	acc, err := bot.WhoAmI(context.Background())
+	if err != nil {
+		log.Printf("alert: %s のアカウントが取得できませんでした：%s", bot.Name, err)
+		return 1
+	}
+	fmt.Printf("%s（@%s、id:%s）\n%s\n", acc.DisplayName, acc.Acct, acc.ID, acc.URL)
+	return
+}
+
+func auth(args []string) (exitCode int) {
+	fs := flag.NewFlagSet("auth", flag.ContinueOnError)
+	var tokenFile = fs.String("token-file", "", "アクセストークンを書き込むファイル（設定ファイルには file:パス として書く）")
+	if !parseFlags(fs, args, 1) {
+		return 2
+	}
+	bot, cfgPath, err := mastobots.LoadPersona(fs.Arg(0))
+	if err != nil {
+		log.Printf("alert: %s", err)
+		return 1
+	}
+	ctx := context.Background()
+
+	// アプリの登録
+	newApp := bot.ClientKey == "" || bot.ClientSecret == ""
+	app, err := bot.RegisterApp(ctx)
+	if err != nil {
+		log.Printf("alert: %s にアプリを登録できませんでした：%s", bot.Instance, err)
+		return 1
+	}
+
+	// 承認
+	fmt.Printf("%s としてログインしたブラウザで次のURLを開き、mastobotsを承認してください：\n\n%s\n\n", bot.Name, app.AuthURI)
+	fmt.Print("表示された認可コード：")
+	code, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && code == "" {
+		log.Printf("alert: 認可コードが読み込めませんでした：%s", err)
+		return 1
+	}
+	ref := bot.AccessToken
+	acc, err := bot.Authorize(ctx, app, code)
+	if err != nil {
+		log.Printf("alert: アクセストークンが取得できませんでした：%s", err)
+		return 1
+	}
+
+	// アクセストークンの保存。設定ファイルが env:・file: で参照していたら、そちらに合わせる
+	switch {
+	case *tokenFile != "":
+		path, _ := filepath.Abs(*tokenFile)
+		if err = bot.SaveToken(path); err != nil {
+			log.Printf("alert: アクセストークンを %s に書き込めませんでした：%s", path, err)
+			return 1
+		}
+		ref = "file:" + path
+	case strings.HasPrefix(ref, "file:"):
+		path := os.ExpandEnv(strings.TrimPrefix(ref, "file:"))
+		if err = bot.SaveToken(path); err != nil {
+			log.Printf("alert: アクセストークンを %s に書き込めませんでした：%s", path, err)
+			return 1
+		}
+	case strings.HasPrefix(ref, "env:"):
+		fmt.Printf("環境変数 %s に、次のアクセストークンを設定してください：\n%s\n", strings.TrimPrefix(ref, "env:"), bot.AccessToken)
+	default:
+		ref = bot.AccessToken
+	}
+	if err = bot.SaveCredentials(cfgPath, ref, newApp); err != nil {
+		log.Printf("alert: 設定ファイル %s に書き込めませんでした：%s", cfgPath, err)
+		return 1
 	}
 
+	fmt.Printf("%s は @%s（id:%s）として承認されました。%s を更新しました\n", bot.Name, acc.Acct, acc.ID, cfgPath)
 	return
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testConfig は、サーバにもデータベースにもつながらない、dry-run用の設定ファイル
+const testConfig = `
+DBCredentials:
+    Database: rss
+    Password: none
+    Server: 127.0.0.1:1
+    User: rss
+Geocoding:
+    Default: gsi
+DryRunSink:
+    Type: jsonl
+    Path: dryrun.jsonl
+Personae:
+    -   Name: mybot
+        Instance: http://127.0.0.1:1
+        AccessToken: token
+        WakeHour: 6
+        SleepHour: 22
+        Latitude: 35.685175
+        Longitude: 139.7528
+        TimeZone: Asia/Tokyo
+        Interval: 60
+        Comments:
+            - _keyword1_！
+`
+
+// inConfigDir は、testConfigを書いた一時ディレクトリで、テストを実行する
+func inConfigDir(t *testing.T) (dir string) {
+	t.Helper()
+	dir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "config.yml"), []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return
+}
+
+func TestRunArguments(t *testing.T) {
+	tests := []struct {
+		args []string
+		want int
+	}{
+		{[]string{"no-such-command"}, 2},
+		{[]string{"post"}, 2},
+		{[]string{"post", "mybot"}, 2},
+		{[]string{"post", "-no-such-flag", "mybot", "hello"}, 2},
+		{[]string{"preview"}, 2},
+		{[]string{"candidates"}, 2},
+		{[]string{"reset-checked", "mybot", "-1"}, 2},
+		{[]string{"reset-checked", "mybot", "x"}, 2},
+		{[]string{"weather", "-when", "3", "東京"}, 2},
+		{[]string{"whoami"}, 2},
+		{[]string{"auth"}, 2},
+		{[]string{"run", "-p", "x"}, 2},
+	}
+	for _, tt := range tests {
+		if got := run(tt.args); got != tt.want {
+			t.Errorf("mastobots %s の終了コード = %d, want %d", strings.Join(tt.args, " "), got, tt.want)
+		}
+	}
+}
+
+func TestPostDryRun(t *testing.T) {
+	dir := inConfigDir(t)
+
+	if got := run([]string{"post", "-dry-run", "-visibility", "unlisted", "mybot", "こんにちは", "世界"}); got != 0 {
+		t.Fatalf("終了コード = %d, want 0", got)
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "dryrun.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var a struct {
+		Bot, Kind, Status, Visibility string
+	}
+	if err := json.Unmarshal(b, &a); err != nil {
+		t.Fatal(err)
+	}
+	if a.Bot != "mybot" || a.Kind != "post" || a.Status != "こんにちは 世界" || a.Visibility != "unlisted" {
+		t.Errorf("dry-runの記録 = %+v", a)
+	}
+
+	// いないbotには投稿しない
+	if got := run([]string{"post", "-dry-run", "nobot", "hello"}); got != 1 {
+		t.Errorf("いないbotの終了コード = %d, want 1", got)
+	}
+}
+
+func TestPreviewWithoutDatabase(t *testing.T) {
+	inConfigDir(t)
+
+	// データベースにつながらなければ、何も書き込まずに終了コード1
+	for _, cmd := range []string{"preview", "candidates"} {
+		if got := run([]string{cmd, "mybot"}); got != 1 {
+			t.Errorf("%s の終了コード = %d, want 1", cmd, got)
+		}
+		if got := run([]string{cmd, "nobot"}); got != 1 {
+			t.Errorf("いないbotの %s の終了コード = %d, want 1", cmd, got)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// Candidate は、botがストックしている投稿候補と、その中でbotが一番あげつらいたい単語を格納する
+type Candidate struct {
+	Item
+	StockedAt time.Time
+	Word      string
+	Score     int
+}
+
+// FindBot は、名前がnameのbotを返す
+func FindBot(bots []*Persona, name string) (bot *Persona, err error) {
+	for _, b := range bots {
+		if b.Name == name {
+			return b, nil
+		}
+	}
+	names := make([]string, 0, len(bots))
+	for _, b := range bots {
+		names = append(names, b.Name)
+	}
+	return nil, fmt.Errorf("%s というbotはいません（%s）", name, strings.Join(names, "、"))
+}
+
+// Connect は、botをMastodonサーバに接続し、アカウントIDを取得する
+func (bot *Persona) Connect() error {
+	return bot.getMastoID()
+}
+
+// WhoAmI は、botのアクセストークンに対応するMastodonアカウントを返す
+func (bot *Persona) WhoAmI(ctx context.Context) (acc *mastodon.Account, err error) {
+	if bot.Client == nil {
+		if err = bot.Connect(); err != nil {
+			return
+		}
+	}
+	return bot.Client.GetAccountCurrentUser(ctx)
+}
+
+// Post は、botとしてテキストを投稿し、投稿のURLを返す。DryRunの時は投稿せずにSinkに記録する。
+func (bot *Persona) Post(ctx context.Context, text string, visibility string) (url string, err error) {
+	if bot.Client == nil && !bot.DryRun {
+		if err = bot.Connect(); err != nil {
+			return
+		}
+	}
+	st, err := bot.postStatus(ctx, mastodon.Toot{Status: bot.fillCalendar(text), Visibility: visibility})
+	if err != nil {
+		return
+	}
+	url = st.URL
+	if url == "" {
+		url = string(st.ID)
+	}
+	return
+}
+
+// PreviewNewsToot は、次のニューストゥートを投稿せずに作って返す。候補はストックに残る。
+func (bot *Persona) PreviewNewsToot(db DB) (toot mastodon.Toot, item Item, err error) {
+	toot, item, err = bot.createNewsToot(db)
+	if err == nil && item.Title == "" {
+		err = fmt.Errorf("%s の投稿候補がストックされていません", bot.Name)
+	}
+	return
+}
+
+// Candidates は、botがストックしている投稿候補を、あげつらう単語とその優先度つきで返す
+func (db DB) Candidates(bot *Persona) (cds []Candidate, err error) {
+	rows, err := db.Query(`
+		SELECT
+			candidates.item_id, items.title, items.url, items.summary, candidates.keyword, candidates.updated_at
+		FROM
+			candidates
+		INNER JOIN
+			items
+		ON
+			candidates.item_id = items.id
+		WHERE
+			candidates.bot_id = ?
+		ORDER BY
+			candidates.updated_at DESC`,
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s の投稿候補を集め損ねました：%s", bot.Name, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c Candidate
+		var summary, keyword *string
+		if err := rows.Scan(&c.ID, &c.Title, &c.URL, &summary, &keyword, &c.StockedAt); err != nil {
+			log.Printf("info: candidatesテーブルから一行の情報取得に失敗しました：%s", err)
+			continue
+		}
+		if summary != nil {
+			c.Summary = *summary
+		}
+		if keyword != nil {
+			c.Keyword = *keyword
+		}
+		cds = append(cds, c)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("info: candidatesテーブルの行読み込みに結局失敗しました：%s", err)
+		return
+	}
+	rows.Close()
+
+	for i := range cds {
+		txt := cds[i].Title
+		if cds[i].Summary != "" && cds[i].Summary != cds[i].Title {
+			txt += "。\n" + textContent(cds[i].Summary)
+		}
+		result, err := parse(bot.commonSettings.langJobPool, txt)
+		if err != nil {
+			continue
+		}
+		if best, err := bestCandidate(result.candidates()); err == nil {
+			cds[i].Word = best.surface
+			cds[i].Score = best.priority
+		}
+	}
+	return
+}
+
+// ResetChecked は、botがRSSアイテムをどこまで見たかの記録をuntilに戻す。0なら全てのアイテムを見直す。
+func (db DB) ResetChecked(bot *Persona, until int) (err error) {
+	_, err = db.Exec(`
+		UPDATE bots
+		SET checked_until = ?, updated_at = ?
+		WHERE id = ?`,
+		until,
+		time.Now(),
+		bot.DBID,
+	)
+	if err != nil {
+		log.Printf("info: %s のchecked_untilが更新できませんでした：%s", bot.Name, err)
+	}
+	return
+}
+
+// Forecast は、地名placeの天気予報をbotの口調で返す。whenは GetLocationWeather と同じ。
+func (bot *Persona) Forecast(place string, when int) (msg string, err error) {
+	name, lat, lng, err := getLocDataFromString(bot.geocoder, []string{place})
+	if err != nil {
+		return
+	}
+	data, err := GetLocationWeather(bot.commonSettings.weatherKey, lat, lng, when)
+	if err != nil {
+		return
+	}
+	return forecastMessage(name, data, when, bot.Assertion, false, false), nil
+}
+
+// Describe は、botの設定と、次に起きる・寝る時刻の概要を返す
+func (bot *Persona) Describe() string {
+	var b strings.Builder
+	now := bot.clock().Now().In(bot.location())
+	fmt.Fprintf(&b, "%s（%s）\n", bot.Name, bot.Instance)
+	fmt.Fprintf(&b, "  タイムゾーン：%s\n", bot.location())
+	sleep, active, _ := bot.getWeeklyDayCycle(now)
+	if bot.LivesWithSun {
+		if sl, ac, _, err := getDayCycleBySunMovement(now, bot.location(), bot.Latitude, bot.Longitude, bot.Twilight); err == nil {
+			sleep, active = sl, ac
+		}
+	}
+	const layout = "01-02 15:04 MST"
+	switch {
+	case active == 0:
+		fmt.Fprintf(&b, "  活動：当分お休み（%s に見直し）\n", now.Add(sleep).Format(layout))
+	case sleep == 0:
+		fmt.Fprintf(&b, "  活動：起きている（%s まで）\n", now.Add(active).Format(layout))
+	default:
+		fmt.Fprintf(&b, "  活動：寝ている（%s 〜 %s）\n", now.Add(sleep).Format(layout), now.Add(sleep+active).Format(layout))
+	}
+	if bot.newsSchedule != nil {
+		fmt.Fprintf(&b, "  定期トゥート：%s\n", bot.newsSchedule)
+	} else if bot.Interval > 0 {
+		fmt.Fprintf(&b, "  定期トゥート：%d分から%d分ごと\n", bot.FirstFire, bot.Interval)
+	}
+	if bot.randomSchedule != nil {
+		fmt.Fprintf(&b, "  ランダムトゥート：%s\n", bot.randomSchedule)
+	} else if bot.RandomFrequency > 0 {
+		fmt.Fprintf(&b, "  ランダムトゥート：一日約%d回\n", bot.RandomFrequency)
+	}
+	if len(bot.ScheduledPosts) > 0 {
+		fmt.Fprintf(&b, "  予約投稿：%d件\n", len(bot.ScheduledPosts))
+	}
+	if bot.DryRun {
+		fmt.Fprintf(&b, "  dry-run\n")
+	}
+	return b.String()
+}
@@ -41,3 +41,51 @@ CREATE TABLE `rss_feeds` (
   PRIMARY KEY (`id`),
   UNIQUE KEY `url` (`url`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+
+CREATE TABLE `scheduled_posts` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `status` text NOT NULL,
+  `visibility` varchar(16) DEFAULT NULL,
+  `spoiler_text` varchar(255) DEFAULT NULL,
+  `media` text DEFAULT NULL,
+  `post_at` datetime DEFAULT NULL,
+  `recurrence` varchar(100) DEFAULT NULL,
+  `enabled` tinyint(1) unsigned NOT NULL DEFAULT '1',
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `bot_id` (`bot_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `scheduled_post_results` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `post_key` varchar(64) NOT NULL,
+  `fire_at` datetime NOT NULL,
+  `status_id` varchar(64) DEFAULT NULL,
+  `error` varchar(255) DEFAULT NULL,
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `post_per_fire` (`bot_id`,`post_key`,`fire_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE `outbox` (
+  `id` int(11) unsigned NOT NULL AUTO_INCREMENT,
+  `bot_id` int(11) unsigned NOT NULL,
+  `idempotency_key` varchar(64) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `payload` text NOT NULL,
+  `priority` tinyint(4) NOT NULL DEFAULT '0',
+  `attempts` int(11) unsigned NOT NULL DEFAULT '0',
+  `next_attempt_at` datetime NOT NULL,
+  `state` varchar(16) NOT NULL DEFAULT 'pending',
+  `result_id` varchar(64) DEFAULT NULL,
+  `error` varchar(255) DEFAULT NULL,
+  `created_at` datetime DEFAULT NULL,
+  `updated_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `action_per_bot` (`bot_id`,`idempotency_key`),
+  KEY `pending` (`bot_id`,`state`,`next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -0,0 +1,259 @@
+package mastobots
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Vacation は、botが完全にお休みする期間を格納する。From・Toは "2006-01-02" 形式で、両日とも休む。
+type Vacation struct {
+	From     string
+	To       string
+	Farewell string
+	from     time.Time
+	to       time.Time
+}
+
+// activeWindow は、一日のうちの活動時間帯を0時からの分で格納する。endが24*60を超えれば翌日にまたがる。
+type activeWindow struct {
+	start int
+	end   int
+}
+
+var weekdayKeys = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseWindow は、"06:00-12:00" の形式の活動時間帯を解析する
+func parseWindow(s string) (w activeWindow, err error) {
+	ends := strings.SplitN(strings.TrimSpace(s), "-", 2)
+	if len(ends) != 2 {
+		err = fmt.Errorf("活動時間帯 %q は「06:00-12:00」の形式で指定してください", s)
+		return
+	}
+	if w.start, err = parseClock(ends[0]); err != nil {
+		return
+	}
+	if w.end, err = parseClock(ends[1]); err != nil {
+		return
+	}
+	if w.end <= w.start {
+		w.end += 24 * 60
+	}
+	return
+}
+
+// parseClock は、"06:00" の形式の時刻を0時からの分に変換する。"24:00" も受け付ける。
+func parseClock(s string) (min int, err error) {
+	hm := strings.SplitN(strings.TrimSpace(s), ":", 2)
+	if len(hm) != 2 {
+		return 0, fmt.Errorf("時刻 %q は「06:00」の形式で指定してください", s)
+	}
+	h, err := strconv.Atoi(hm[0])
+	if err != nil {
+		return 0, fmt.Errorf("時刻 %q が不正です", s)
+	}
+	m, err := strconv.Atoi(hm[1])
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("時刻 %q が不正です", s)
+	}
+	return h*60 + m, nil
+}
+
+// parseDaySchedule は、曜日ごとの活動時間帯と休暇を解析する。
+// WeeklyScheduleがなければ、WakeHour〜SleepMinの時刻を毎日の活動時間帯とする。
+func (bot *Persona) parseDaySchedule() error {
+	var errs ConfigErrors
+	bot.weekly = make(map[string][]activeWindow)
+	if len(bot.WeeklySchedule) == 0 {
+		w := activeWindow{bot.WakeHour*60 + bot.WakeMin, bot.SleepHour*60 + bot.SleepMin}
+		if w.end <= w.start {
+			w.end += 24 * 60
+		}
+		bot.weekly["default"] = []activeWindow{w}
+	}
+	for key, specs := range bot.WeeklySchedule {
+		key = strings.ToLower(key)
+		if key != "default" && key != "holiday" && !isWeekdayKey(key) {
+			errs.add(bot.Name, "WeeklySchedule", "%s は曜日（mon〜sun）、holiday、default のいずれかにしてください", key)
+			continue
+		}
+		ws := make([]activeWindow, 0, len(specs))
+		for _, spec := range specs {
+			w, err := parseWindow(spec)
+			if err != nil {
+				errs.add(bot.Name, "WeeklySchedule."+key, "%s", err)
+				continue
+			}
+			ws = append(ws, w)
+		}
+		bot.weekly[key] = ws
+	}
+
+	for _, h := range bot.Holidays {
+		if _, err := time.Parse("2006-01-02", h); err != nil {
+			errs.add(bot.Name, "Holidays", "日付 %q が不正です（2006-01-02 の形式で指定してください）", h)
+		}
+	}
+
+	loc := bot.location()
+	for i := range bot.Vacations {
+		v := &bot.Vacations[i]
+		var err error
+		if v.from, err = time.ParseInLocation("2006-01-02", v.From, loc); err != nil {
+			errs.add(bot.Name, "Vacations", "休暇の開始日 %q が不正です", v.From)
+			continue
+		}
+		if v.to, err = time.ParseInLocation("2006-01-02", v.To, loc); err != nil {
+			errs.add(bot.Name, "Vacations", "休暇の終了日 %q が不正です", v.To)
+			continue
+		}
+		if v.to.Before(v.from) {
+			errs.add(bot.Name, "Vacations", "休暇 %s〜%s の終了日が開始日より前です", v.From, v.To)
+		}
+	}
+	return errs.err()
+}
+
+func isWeekdayKey(key string) bool {
+	for _, k := range weekdayKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// holidayCalendars は、HolidayCalendar に指定できる祝日の暦
+var holidayCalendars = []string{"japan", "none"}
+
+// holidayCalendar は、botが従う祝日の暦を返す。
+// HolidayCalendar を省略したら、日本時間で暮らすbotは日本の祝日に従い、それ以外のbotは祝日を休まない。
+func (bot *Persona) holidayCalendar() string {
+	if bot.HolidayCalendar != "" {
+		return strings.ToLower(bot.HolidayCalendar)
+	}
+	if zone, _ := time.Date(2000, 1, 1, 0, 0, 0, 0, bot.location()).Zone(); zone == "JST" {
+		return "japan"
+	}
+	return "none"
+}
+
+// holidayName は、その日がbotの暦で祝日ならその名前を返す
+func (bot *Persona) holidayName(date time.Time) string {
+	if bot.holidayCalendar() != "japan" {
+		return ""
+	}
+	return japaneseHolidays(date.Year())[date.Format("2006-01-02")]
+}
+
+// isHoliday は、その日がbotの暦で祝日か、Holidaysで指定された休日かを返す
+func (bot *Persona) isHoliday(date time.Time) bool {
+	d := date.Format("2006-01-02")
+	for _, h := range bot.Holidays {
+		if h == d {
+			return true
+		}
+	}
+	return bot.holidayName(date) != ""
+}
+
+// vacationOn は、その日が休暇中ならその休暇を返す
+func (bot *Persona) vacationOn(date time.Time) *Vacation {
+	y, m, d := date.Date()
+	day := time.Date(y, m, d, 0, 0, 0, 0, bot.location())
+	for i := range bot.Vacations {
+		v := &bot.Vacations[i]
+		if !day.Before(v.from) && !day.After(v.to) {
+			return v
+		}
+	}
+	return nil
+}
+
+// vacationBetween は、fromより後、to以前に始まる休暇があればそれを返す
+func (bot *Persona) vacationBetween(from, to time.Time) *Vacation {
+	for i := range bot.Vacations {
+		v := &bot.Vacations[i]
+		if v.from.After(from) && !v.from.After(to) {
+			return v
+		}
+	}
+	return nil
+}
+
+// windowsOn は、その日に始まる活動時間帯を返す。休暇中は空、祝日はholiday、なければ曜日、それもなければdefaultの指定を使う。
+func (bot *Persona) windowsOn(date time.Time) []activeWindow {
+	if bot.vacationOn(date) != nil {
+		return nil
+	}
+	if ws, ok := bot.weekly["holiday"]; ok && bot.isHoliday(date) {
+		return ws
+	}
+	if ws, ok := bot.weekly[weekdayKeys[date.Weekday()]]; ok {
+		return ws
+	}
+	return bot.weekly["default"]
+}
+
+// getWeeklyDayCycle は、曜日ごとの活動時間帯と休暇から、次に起きるまでの時間と起きている時間を返す。
+// 連続した活動時間帯はつなげ、起きている時間は最大24時間で区切る。
+// 次に起きるまでの眠りが、同じ日の活動時間帯の合間なら、napをtrueにする。
+func (bot *Persona) getWeeklyDayCycle(now time.Time) (sleep, active time.Duration, nap bool) {
+	now = now.In(bot.location())
+	y, m, d := now.Date()
+
+	// 前日から最大60日先までの活動時間帯を、実際の時刻の区間に直す。startDay・endDayは、始まり・終わりの活動時間帯がどの日のものか
+	type span struct {
+		start, end       time.Time
+		startDay, endDay int
+	}
+	spans := make([]span, 0)
+	for i := -1; i <= 60; i++ {
+		for _, w := range bot.windowsOn(time.Date(y, m, d+i, 12, 0, 0, 0, now.Location())) {
+			s := time.Date(y, m, d+i, 0, w.start, 0, 0, now.Location())
+			e := time.Date(y, m, d+i, 0, w.end, 0, 0, now.Location())
+			spans = append(spans, span{s, e, i, i})
+		}
+	}
+
+	// 開始時刻順に並べて、重なりや切れ目のないものをつなげる
+	for i := 1; i < len(spans); i++ {
+		for j := i; j > 0 && spans[j].start.Before(spans[j-1].start); j-- {
+			spans[j], spans[j-1] = spans[j-1], spans[j]
+		}
+	}
+	merged := make([]span, 0, len(spans))
+	for _, sp := range spans {
+		if n := len(merged); n > 0 && !sp.start.After(merged[n-1].end) {
+			if sp.end.After(merged[n-1].end) {
+				merged[n-1].end = sp.end
+				merged[n-1].endDay = sp.endDay
+			}
+			continue
+		}
+		merged = append(merged, sp)
+	}
+
+	for i, sp := range merged {
+		if !sp.end.After(now) {
+			continue
+		}
+		if sp.start.After(now) {
+			sleep = sp.start.Sub(now)
+			active = sp.end.Sub(sp.start)
+			nap = i > 0 && merged[i-1].endDay == sp.startDay
+		} else {
+			active = sp.end.Sub(now)
+		}
+		if active > 24*time.Hour {
+			active = 24 * time.Hour
+		}
+		return
+	}
+
+	// 当分起きる予定がなければ、一日寝てから考え直す
+	sleep = 24 * time.Hour
+	active = 0
+	return
+}
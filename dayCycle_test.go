@@ -0,0 +1,127 @@
+package mastobots
+
+import (
+	"testing"
+	"time"
+)
+
+func newScheduledBot(t *testing.T, loc *time.Location, configure func(bot *Persona)) *Persona {
+	t.Helper()
+	bot := &Persona{Name: "test", loc: loc}
+	configure(bot)
+	if err := bot.parseDaySchedule(); err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+func TestWeeklyDayCycleAcrossMidnight(t *testing.T) {
+	bot := newScheduledBot(t, time.UTC, func(bot *Persona) {
+		bot.WakeHour, bot.SleepHour = 22, 6
+	})
+
+	cases := []struct {
+		now           time.Time
+		sleep, active time.Duration
+	}{
+		{time.Date(2024, 5, 1, 21, 0, 0, 0, time.UTC), time.Hour, 8 * time.Hour},
+		{time.Date(2024, 5, 1, 23, 0, 0, 0, time.UTC), 0, 7 * time.Hour},
+		{time.Date(2024, 5, 2, 2, 0, 0, 0, time.UTC), 0, 4 * time.Hour},
+		{time.Date(2024, 5, 2, 7, 0, 0, 0, time.UTC), 15 * time.Hour, 8 * time.Hour},
+	}
+	for _, c := range cases {
+		sleep, active, _ := bot.getWeeklyDayCycle(c.now)
+		if sleep != c.sleep || active != c.active {
+			t.Errorf("%s: got %s, %s, want %s, %s", c.now.Format("01-02 15:04"), sleep, active, c.sleep, c.active)
+		}
+	}
+}
+
+func TestWeeklyDayCycleAcrossDST(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	bot := newScheduledBot(t, ny, func(bot *Persona) {
+		bot.WakeHour, bot.SleepHour = 1, 4
+	})
+
+	// 夏時間の始まる日は1時間短く、終わる日は1時間長く起きている
+	cases := []struct {
+		now           time.Time
+		sleep, active time.Duration
+	}{
+		{time.Date(2024, 3, 10, 0, 0, 0, 0, ny), time.Hour, 2 * time.Hour},
+		{time.Date(2024, 11, 3, 0, 0, 0, 0, ny), time.Hour, 4 * time.Hour},
+	}
+	for _, c := range cases {
+		sleep, active, _ := bot.getWeeklyDayCycle(c.now)
+		if sleep != c.sleep || active != c.active {
+			t.Errorf("%s: got %s, %s, want %s, %s", c.now.Format("01-02 15:04"), sleep, active, c.sleep, c.active)
+		}
+	}
+}
+
+func TestWeeklyDayCycleVacationAndHoliday(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	bot := newScheduledBot(t, tokyo, func(bot *Persona) {
+		bot.WeeklySchedule = map[string][]string{
+			"default": {"07:00-12:00", "13:00-22:00"},
+			"holiday": {"10:00-22:00"},
+		}
+		bot.Vacations = []Vacation{{From: "2024-08-13", To: "2024-08-15"}}
+	})
+
+	cases := []struct {
+		name          string
+		now           time.Time
+		sleep, active time.Duration
+		nap           bool
+	}{
+		{"昼休み", time.Date(2024, 8, 5, 12, 0, 0, 0, tokyo), time.Hour, 9 * time.Hour, true},
+		{"夜", time.Date(2024, 8, 5, 22, 0, 0, 0, tokyo), 9 * time.Hour, 5 * time.Hour, false},
+		{"祝日（山の日の振替休日）", time.Date(2024, 8, 12, 8, 0, 0, 0, tokyo), 2 * time.Hour, 12 * time.Hour, false},
+		{"休暇明け", time.Date(2024, 8, 12, 23, 0, 0, 0, tokyo), 80 * time.Hour, 5 * time.Hour, false},
+	}
+	for _, c := range cases {
+		sleep, active, nap := bot.getWeeklyDayCycle(c.now)
+		if sleep != c.sleep || active != c.active || nap != c.nap {
+			t.Errorf("%s: got %s, %s, %v, want %s, %s, %v", c.name, sleep, active, nap, c.sleep, c.active, c.nap)
+		}
+	}
+}
+
+func TestWeeklyDayCycleShortNight(t *testing.T) {
+	// 夜の眠りは、短くてもひと休みではない
+	bot := newScheduledBot(t, time.UTC, func(bot *Persona) {
+		bot.WeeklySchedule = map[string][]string{"default": {"04:00-02:00"}}
+	})
+	sleep, active, nap := bot.getWeeklyDayCycle(time.Date(2024, 5, 2, 2, 0, 0, 0, time.UTC))
+	if sleep != 2*time.Hour || active != 22*time.Hour || nap {
+		t.Errorf("got %s, %s, %v, want 2h, 22h, false", sleep, active, nap)
+	}
+}
+
+func TestHolidayCalendar(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	london := mustLoadLocation(t, "Europe/London")
+	// 2024-08-12 は日本の振替休日
+	tests := []struct {
+		name     string
+		loc      *time.Location
+		calendar string
+		want     bool
+	}{
+		{"日本時間", tokyo, "", true},
+		{"ロンドン", london, "", false},
+		{"ロンドンで日本の暦", london, "japan", true},
+		{"日本時間で暦なし", tokyo, "none", false},
+	}
+	for _, tt := range tests {
+		bot := newScheduledBot(t, tt.loc, func(bot *Persona) { bot.HolidayCalendar = tt.calendar })
+		if got := bot.isHoliday(time.Date(2024, 8, 12, 12, 0, 0, 0, tt.loc)); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	bot := newScheduledBot(t, london, func(bot *Persona) { bot.Holidays = []string{"2024-08-26"} })
+	if !bot.isHoliday(time.Date(2024, 8, 26, 12, 0, 0, 0, london)) {
+		t.Error("Holidays の日が休日になりません")
+	}
+}
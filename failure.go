@@ -0,0 +1,97 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// reconnectBackoffMin は、準備できなかったbotを最初に準備し直すまでの待ち時間。失敗するたびに倍にする。
+	reconnectBackoffMin = 30 * time.Second
+	// reconnectBackoffMax は、準備し直すまでの待ち時間の上限
+	reconnectBackoffMax = 30 * time.Minute
+)
+
+// BotError は、一つのbotが活動できなくなった理由を格納する
+type BotError struct {
+	Bot string
+	Err error
+}
+
+func (e BotError) Error() string {
+	return fmt.Sprintf("%s：%s", e.Bot, e.Err)
+}
+
+func (e BotError) Unwrap() error {
+	return e.Err
+}
+
+// BotErrors は、活動できなくなったbotたちの理由をまとめて格納する
+type BotErrors []BotError
+
+func (es BotErrors) Error() string {
+	lines := make([]string, 0, len(es))
+	for _, e := range es {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// reconnect は、起動時に準備できなかったbotを、connectが成功するまで待ち時間を延ばしながら準備し直す。
+// アクセストークンが無効などで見込みがなければ諦めてエラーを返す。
+func (bot *Persona) reconnect(ctx context.Context, db DB, connect func(db DB, bot *Persona) error) (err error) {
+	backoff := reconnectBackoffMin
+	err = bot.startupErr
+	for {
+		bot.health.setProblem(err)
+		if permanent(err) {
+			return err
+		}
+		log.Printf("info: %s の準備を %s 後にやり直します：%s", bot.Name, backoff, err)
+		if sleepContext(ctx, bot.clock(), backoff) != nil {
+			return nil
+		}
+		if err = connect(db, bot); err == nil {
+			bot.health.setProblem(nil)
+			log.Printf("info: %s の準備ができたので、活動を始めます", bot.Name)
+			return
+		}
+		if backoff *= 2; backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+	}
+}
+
+// lose は、活動を続けられなくなったbotを止めて、理由を覚えておく。
+// 活動中のbotがいなくなったら、allLostで知らせる。
+func (r *roster) lose(bot *Persona, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if rb, ok := r.running[bot.Name]; !ok || rb.bot != bot {
+		return
+	}
+	r.running[bot.Name].cancel()
+	delete(r.running, bot.Name)
+	bot.health.setProblem(err)
+	r.lost = append(r.lost, BotError{Bot: bot.Name, Err: err})
+	log.Printf("alert: %s は活動を続けられなくなりました：%s", bot.Name, err)
+	if len(r.running) == 0 {
+		select {
+		case r.allLost <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deadErr は、活動中のbotが一つもいなければ、それぞれが活動できなくなった理由をまとめて返す
+func (r *roster) deadErr() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.running) > 0 || len(r.lost) == 0 {
+		return nil
+	}
+	return append(BotErrors(nil), r.lost...)
+}
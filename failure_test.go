@@ -0,0 +1,86 @@
+package mastobots
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestActivateBotsAllLost(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := &Persona{Name: "alice", Instance: srv.URL, AccessToken: "wrong", loc: time.UTC, commonSettings: &commonSettings{clk: clk}}
+	bot.startupErr = bot.verifyCredentials(context.Background())
+	if !permanent(bot.startupErr) {
+		t.Fatalf("無効なトークンのエラーが見込みなしと判定されません：%v", bot.startupErr)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- activateBots(context.Background(), []*Persona{bot}, db, 0, clk, nil, nil) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("全てのbotが活動できないのに終了しませんでした")
+	}
+	var errs BotErrors
+	if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Bot != "alice" {
+		t.Fatalf("activateBots() = %v", err)
+	}
+	if h := bot.Health(); h.Problem == "" {
+		t.Error("活動をやめた理由が記録されていません")
+	}
+}
+
+func TestRosterRetriesUnhealthyBot(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	alice := integrationBot(t, srv, clk, "alice", nil)
+	bob := integrationBot(t, srv, clk, "bob", nil)
+	bob.startupErr = errors.New("サーバが落ちています")
+	var tries atomic.Int32
+	r := newRoster(ctx, db, alice.commonSettings)
+	r.connect = func(db DB, bot *Persona) error {
+		if tries.Add(1) == 1 {
+			return errors.New("まだ落ちています")
+		}
+		return bot.getMastoID()
+	}
+	r.mu.Lock()
+	r.start(alice)
+	r.start(bob)
+	r.mu.Unlock()
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 1 }) {
+		t.Fatal("準備できたbotが動き出しません")
+	}
+	if h := bob.Health(); h.Problem == "" {
+		t.Error("準備できていない理由が記録されていません")
+	}
+
+	// 30秒後に一度失敗し、さらに60秒後に準備できる
+	for i := 0; i < 10 && srv.Streams("bob") == 0; i++ {
+		clk.Advance(reconnectBackoffMin)
+		srv.WaitFor(200*time.Millisecond, func() bool { return srv.Streams("bob") == 1 })
+	}
+	if srv.Streams("bob") != 1 {
+		t.Fatalf("準備し直したbotが動き出しません（%d 回試しました）", tries.Load())
+	}
+	if n := tries.Load(); n != 2 {
+		t.Errorf("準備を %d 回試しました、want 2", n)
+	}
+	if h := bob.Health(); h.Problem != "" {
+		t.Errorf("準備できたのに問題が残っています：%s", h.Problem)
+	}
+}
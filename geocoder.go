@@ -0,0 +1,427 @@
+package mastobots
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Geocoder は、地名と座標を相互に変換するジオコーディングサービスのインターフェースを提供する。
+type Geocoder interface {
+	// Reverse は、座標からその地点の地名を返す
+	Reverse(lat, lng float64) (name string, err error)
+	// Forward は、地名からその正式な名前と座標を返す
+	Forward(query string) (placeName string, lat, lng float64, err error)
+}
+
+// GeocoderSettings は、ジオコーディングサービスの設定を格納する
+type GeocoderSettings struct {
+	Default   string
+	Yahoo     yahooGeocoder
+	Nominatim nominatimGeocoder
+	GSI       gsiGeocoder
+}
+
+// newGeocoders は、設定に従って利用可能なジオコーダを名前つきで返す。
+// Nominatimの利用制限を守るため、ジオコーダは全botで共有する。
+func newGeocoders(gs GeocoderSettings, yahooClientID string) (gcs map[string]Geocoder) {
+	y := gs.Yahoo
+	y.ClientID = yahooClientID
+	if y.Endpoint == "" {
+		y.Endpoint = "https://map.yahooapis.jp"
+	}
+
+	n := gs.Nominatim
+	if n.Endpoint == "" {
+		n.Endpoint = "https://nominatim.openstreetmap.org"
+	}
+	if n.Language == "" {
+		n.Language = "ja"
+	}
+	n.lastRequest = new(time.Time)
+	n.mu = new(sync.Mutex)
+
+	g := gs.GSI
+	if g.SearchEndpoint == "" {
+		g.SearchEndpoint = "https://msearch.gsi.go.jp/address-search/AddressSearch"
+	}
+	if g.ReverseEndpoint == "" {
+		g.ReverseEndpoint = "https://mreversegeocoder.gsi.go.jp/reverse-geocoder/LonLatToAddress"
+	}
+	if g.MuniEndpoint == "" {
+		g.MuniEndpoint = "https://maps.gsi.go.jp/js/muni.js"
+	}
+	g.munis = new(muniTable)
+
+	gcs = map[string]Geocoder{
+		"yahoo":     y,
+		"nominatim": n,
+		"gsi":       g,
+	}
+	return
+}
+
+// geocoderFor は、名前に該当するジオコーダを返す。名前が空ならデフォルトのものを返す。
+func (cmn *commonSettings) geocoderFor(name string) (g Geocoder, err error) {
+	if name == "" {
+		name = cmn.defaultGeo
+	}
+	g, ok := cmn.geocoders[strings.ToLower(name)]
+	if !ok {
+		err = fmt.Errorf("%s というジオコーダはありません", name)
+	}
+	return
+}
+
+// getGeoJSON は、ジオコーディングサービスにGETリクエストを送り、結果のJSONをresにデコードする。
+func getGeoJSON(service, query, userAgent string, res interface{}) (err error) {
+	req, err := http.NewRequest(http.MethodGet, query, nil)
+	if err != nil {
+		log.Printf("info: %sへのリクエストが作成できませんでした：%s", service, err)
+		return
+	}
+	if userAgent != "" {
+		req.Header.Set("User-Agent", userAgent)
+	}
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("info: %sへのリクエストに失敗しました：%s", service, err)
+		return
+	}
+	defer r.Body.Close()
+	if code := r.StatusCode; code >= 400 {
+		err = fmt.Errorf("%sへの接続エラーです(%d)", service, code)
+		log.Printf("info: %s", err)
+		return
+	}
+	if err = json.NewDecoder(r.Body).Decode(res); err != nil {
+		log.Printf("info: %sからのレスポンスがデコードできませんでした：%s", service, err)
+	}
+	return
+}
+
+// yahooGeocoder は、Yahoo! YOLP APIによるジオコーダ。
+type yahooGeocoder struct {
+	Endpoint string
+	ClientID string
+}
+
+// YahooPlaceInfoResults は、Yahoo場所情報APIからのデータを格納する
+type YahooPlaceInfoResults struct {
+	ResultSet struct {
+		Result []struct {
+			Name     string `json:"Name"`
+			Where    string `json:"Where"`
+			Combined string `json:"Combined"`
+		} `json:"Result"`
+	} `json:"ResultSet"`
+}
+
+// YahooContentsGeoCoderResults は、YahooコンテンツジオコーダAPIからのデータを格納する
+type YahooContentsGeoCoderResults struct {
+	ResultInfo struct {
+		Count int `json:"Count"`
+	} `json:"ResultInfo"`
+	Feature []struct {
+		Name     string `json:"Name"`
+		Geometry struct {
+			Coordinates string `json:"Coordinates"`
+		} `json:"Geometry"`
+		Property struct {
+			Address string `json:"Address"`
+		} `json:"Property"`
+	}
+}
+
+// Reverse は、Yahoo場所情報APIで座標から地名を取得する
+func (y yahooGeocoder) Reverse(lat, lng float64) (name string, err error) {
+	key := url.QueryEscape(y.ClientID)
+	query := strings.TrimSuffix(y.Endpoint, "/") + "/placeinfo/V1/get?lat=" + fmt.Sprint(lat) + "&lon=" + fmt.Sprint(lng) + "&appid=" + key + "&sort=-score&output=json"
+
+	var yr YahooPlaceInfoResults
+	if err = getGeoJSON("map.yahooapis.jp", query, "", &yr); err != nil {
+		return
+	}
+
+	if len(yr.ResultSet.Result) == 0 {
+		return
+	}
+	if yr.ResultSet.Result[0].Name == "" {
+		name = yr.ResultSet.Result[0].Where
+	} else {
+		name = yr.ResultSet.Result[0].Where + "の" + yr.ResultSet.Result[0].Name
+	}
+	return
+}
+
+// Forward は、YahooジオコーダAPIとコンテンツジオコーダAPIで地名から座標を取得する
+func (y yahooGeocoder) Forward(area string) (placeName string, lat, lng float64, err error) {
+	areaq := url.QueryEscape(area)
+	key := url.QueryEscape(y.ClientID)
+	endpoint := strings.TrimSuffix(y.Endpoint, "/")
+	categories := [3]string{"address", "world", "landmark"}
+	for _, category := range categories {
+		query := ""
+		if category == "address" {
+			query = endpoint + "/geocode/V1/geoCoder?appid=" + key + "&output=json&sort=address2&query=" + areaq
+		} else {
+			query = endpoint + "/geocode/cont/V1/contentsGeoCoder?appid=" + key + "&category=" + category + "&output=json&query=" + areaq
+		}
+
+		var yc YahooContentsGeoCoderResults
+		if err = getGeoJSON("Yahoo API", query, "", &yc); err != nil {
+			return
+		}
+
+		if yc.ResultInfo.Count > 0 && len(yc.Feature) > 0 {
+			if category == "address" {
+				placeName = yc.Feature[0].Name
+			} else {
+				placeName = yc.Feature[0].Property.Address + "の" + yc.Feature[0].Name
+			}
+			coorinates := strings.Split(yc.Feature[0].Geometry.Coordinates, ",")
+			if len(coorinates) < 2 {
+				err = fmt.Errorf("座標データが不正です：%s", yc.Feature[0].Geometry.Coordinates)
+				log.Printf("info: %s", err)
+				return
+			}
+			lat, err = strconv.ParseFloat(coorinates[1], 64)
+			if err != nil {
+				log.Printf("info: 緯度データが不正です %s", err)
+				return
+			}
+			lng, err = strconv.ParseFloat(coorinates[0], 64)
+			if err != nil {
+				log.Printf("info: 経度データが不正です %s", err)
+				return
+			}
+			return
+		}
+	}
+
+	err = errNoSuchPlace
+	return
+}
+
+// nominatimGeocoder は、OpenStreetMapのNominatimによるジオコーダ。
+// 利用規約に従い、リクエストは1秒に1回までに抑え、連絡先入りのUser-Agentを送る。
+type nominatimGeocoder struct {
+	Endpoint    string
+	Email       string
+	Language    string
+	mu          *sync.Mutex
+	lastRequest *time.Time
+}
+
+// NominatimPlace は、Nominatimからのデータを格納する
+type NominatimPlace struct {
+	Lat         string `json:"lat"`
+	Lon         string `json:"lon"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+	Address     struct {
+		City    string `json:"city"`
+		Town    string `json:"town"`
+		Village string `json:"village"`
+		County  string `json:"county"`
+		State   string `json:"state"`
+		Country string `json:"country"`
+	} `json:"address"`
+}
+
+// wait は、前回のリクエストから1秒以上空くまで待つ
+func (n nominatimGeocoder) wait() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if d := time.Until(n.lastRequest.Add(1001 * time.Millisecond)); d > 0 {
+		time.Sleep(d)
+	}
+	*n.lastRequest = time.Now()
+}
+
+func (n nominatimGeocoder) userAgent() string {
+	ua := "mastobots/" + version
+	if n.Email != "" {
+		ua += " (" + n.Email + ")"
+	}
+	return ua
+}
+
+// Reverse は、Nominatimで座標から地名を取得する
+func (n nominatimGeocoder) Reverse(lat, lng float64) (name string, err error) {
+	query := strings.TrimSuffix(n.Endpoint, "/") + "/reverse?format=jsonv2&zoom=14&lat=" + fmt.Sprint(lat) + "&lon=" + fmt.Sprint(lng) + "&accept-language=" + url.QueryEscape(n.Language)
+
+	n.wait()
+	var np NominatimPlace
+	if err = getGeoJSON("Nominatim", query, n.userAgent(), &np); err != nil {
+		return
+	}
+
+	where := np.Address.City
+	for _, s := range []string{np.Address.Town, np.Address.Village, np.Address.County, np.Address.State, np.Address.Country} {
+		if where != "" {
+			break
+		}
+		where = s
+	}
+
+	switch {
+	case np.Name == "" || np.Name == where:
+		name = where
+	case where == "":
+		name = np.Name
+	default:
+		name = where + "の" + np.Name
+	}
+	if name == "" {
+		name = np.DisplayName
+	}
+	return
+}
+
+// Forward は、Nominatimで地名から座標を取得する
+func (n nominatimGeocoder) Forward(area string) (placeName string, lat, lng float64, err error) {
+	query := strings.TrimSuffix(n.Endpoint, "/") + "/search?format=jsonv2&limit=1&q=" + url.QueryEscape(area) + "&accept-language=" + url.QueryEscape(n.Language)
+
+	n.wait()
+	var nps []NominatimPlace
+	if err = getGeoJSON("Nominatim", query, n.userAgent(), &nps); err != nil {
+		return
+	}
+	if len(nps) == 0 {
+		err = errNoSuchPlace
+		return
+	}
+
+	placeName = nps[0].Name
+	if placeName == "" {
+		placeName = nps[0].DisplayName
+	}
+	lat, err = strconv.ParseFloat(nps[0].Lat, 64)
+	if err != nil {
+		log.Printf("info: 緯度データが不正です %s", err)
+		return
+	}
+	lng, err = strconv.ParseFloat(nps[0].Lon, 64)
+	if err != nil {
+		log.Printf("info: 経度データが不正です %s", err)
+	}
+	return
+}
+
+// gsiGeocoder は、国土地理院の住所検索APIと逆ジオコーダによるジオコーダ。国内の地名のみ扱える。
+// 逆ジオコーダは市区町村をコードでしか返さないので、地理院地図の市区町村一覧（muni.js）で名前に直す。
+type gsiGeocoder struct {
+	SearchEndpoint  string
+	ReverseEndpoint string
+	MuniEndpoint    string
+	munis           *muniTable
+}
+
+// muniTable は、市区町村コードと市区町村名の対応を、初めて使う時に一度だけ取得して覚えておく
+type muniTable struct {
+	once  sync.Once
+	names map[string]string
+}
+
+// muniLine は、muni.js の一行（GSI.MUNI_ARRAY["1101"] = '1,北海道,1101,札幌市　中央区';）に合う
+var muniLine = regexp.MustCompile(`MUNI_ARRAY\["(\d+)"\]\s*=\s*'([^']*)'`)
+
+// name は、市区町村コードcdの市区町村名を返す。一覧を取得できないか、コードがなければ空文字列を返す。
+func (m *muniTable) name(endpoint, cd string) string {
+	m.once.Do(func() {
+		r, err := http.Get(endpoint)
+		if err != nil {
+			log.Printf("info: 市区町村一覧を取得できませんでした：%s", err)
+			return
+		}
+		defer r.Body.Close()
+		if r.StatusCode >= 400 {
+			log.Printf("info: 市区町村一覧への接続エラーです(%d)", r.StatusCode)
+			return
+		}
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Printf("info: 市区町村一覧を読み込めませんでした：%s", err)
+			return
+		}
+		m.names = parseMuni(string(b))
+	})
+	return m.names[strings.TrimLeft(cd, "0")]
+}
+
+// parseMuni は、muni.js から、先頭の0を除いた市区町村コードと市区町村名の対応を取り出す
+func parseMuni(js string) (names map[string]string) {
+	names = make(map[string]string)
+	for _, m := range muniLine.FindAllStringSubmatch(js, -1) {
+		fields := strings.Split(m[2], ",")
+		if len(fields) < 4 {
+			continue
+		}
+		names[strings.TrimLeft(m[1], "0")] = strings.ReplaceAll(fields[3], "　", "")
+	}
+	return
+}
+
+// GSIAddress は、国土地理院住所検索APIからのデータを格納する
+type GSIAddress struct {
+	Geometry struct {
+		Coordinates []float64 `json:"coordinates"`
+	} `json:"geometry"`
+	Properties struct {
+		Title string `json:"title"`
+	} `json:"properties"`
+}
+
+// GSIReverseResult は、国土地理院逆ジオコーダからのデータを格納する
+type GSIReverseResult struct {
+	Results struct {
+		MuniCd string `json:"muniCd"`
+		Lv01Nm string `json:"lv01Nm"`
+	} `json:"results"`
+}
+
+// Reverse は、国土地理院逆ジオコーダで座標から市区町村名と町字名を取得する。市区町村名が分からなければ町字名だけを返す。
+func (g gsiGeocoder) Reverse(lat, lng float64) (name string, err error) {
+	query := g.ReverseEndpoint + "?lat=" + fmt.Sprint(lat) + "&lon=" + fmt.Sprint(lng)
+
+	var gr GSIReverseResult
+	if err = getGeoJSON("国土地理院逆ジオコーダ", query, "", &gr); err != nil {
+		return
+	}
+	if gr.Results.Lv01Nm != "－" {
+		name = gr.Results.Lv01Nm
+	}
+	if g.munis != nil && gr.Results.MuniCd != "" {
+		name = g.munis.name(g.MuniEndpoint, gr.Results.MuniCd) + name
+	}
+	return
+}
+
+// Forward は、国土地理院住所検索APIで地名から座標を取得する
+func (g gsiGeocoder) Forward(area string) (placeName string, lat, lng float64, err error) {
+	query := g.SearchEndpoint + "?q=" + url.QueryEscape(area)
+
+	var gas []GSIAddress
+	if err = getGeoJSON("国土地理院住所検索API", query, "", &gas); err != nil {
+		return
+	}
+	if len(gas) == 0 || len(gas[0].Geometry.Coordinates) < 2 {
+		err = errNoSuchPlace
+		return
+	}
+
+	placeName = gas[0].Properties.Title
+	lng = gas[0].Geometry.Coordinates[0]
+	lat = gas[0].Geometry.Coordinates[1]
+	return
+}
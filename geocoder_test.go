@@ -0,0 +1,113 @@
+package mastobots
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// geoServer は、パスごとに決まった応答を返すジオコーディングサービスの代わりを立てる。受け取ったクエリはqueriesに残す。
+func geoServer(t *testing.T, responses map[string]string) (srv *httptest.Server, queries map[string]string) {
+	t.Helper()
+	queries = make(map[string]string)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := responses[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		queries[r.URL.Path] = r.URL.RawQuery
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return
+}
+
+func TestYahooGeocoder(t *testing.T) {
+	srv, queries := geoServer(t, map[string]string{
+		"/placeinfo/V1/get":                 `{"ResultSet":{"Result":[{"Name":"皇居","Where":"東京都千代田区"}]}}`,
+		"/geocode/V1/geoCoder":              `{"ResultInfo":{"Count":0},"Feature":[]}`,
+		"/geocode/cont/V1/contentsGeoCoder": `{"ResultInfo":{"Count":1},"Feature":[{"Name":"東京タワー","Geometry":{"Coordinates":"139.745433,35.658581"},"Property":{"Address":"東京都港区芝公園"}}]}`,
+	})
+	gcs := newGeocoders(GeocoderSettings{Yahoo: yahooGeocoder{Endpoint: srv.URL}}, "id")
+	y := gcs["yahoo"]
+
+	name, err := y.Reverse(35.685175, 139.7528)
+	if err != nil || name != "東京都千代田区の皇居" {
+		t.Errorf("Reverse = %q, %v", name, err)
+	}
+	if q := queries["/placeinfo/V1/get"]; q != "lat=35.685175&lon=139.7528&appid=id&sort=-score&output=json" {
+		t.Errorf("Reverse のクエリ = %s", q)
+	}
+
+	// 住所で見つからなければ、ランドマークなどを探す
+	place, lat, lng, err := y.Forward("東京タワー")
+	if err != nil || place != "東京都港区芝公園の東京タワー" || lat != 35.658581 || lng != 139.745433 {
+		t.Errorf("Forward = %q, %v, %v, %v", place, lat, lng, err)
+	}
+}
+
+func TestNominatimGeocoder(t *testing.T) {
+	srv, queries := geoServer(t, map[string]string{
+		"/reverse": `{"name":"皇居","display_name":"皇居, 千代田区, 東京都, 日本","address":{"city":"千代田区","state":"東京都"}}`,
+		"/search":  `[{"lat":"35.6585805","lon":"139.7454329","name":"東京タワー","display_name":"東京タワー, 港区"}]`,
+	})
+	gcs := newGeocoders(GeocoderSettings{Nominatim: nominatimGeocoder{Endpoint: srv.URL + "/", Email: "me@example.com"}}, "")
+	n := gcs["nominatim"]
+
+	name, err := n.Reverse(35.685175, 139.7528)
+	if err != nil || name != "千代田区の皇居" {
+		t.Errorf("Reverse = %q, %v", name, err)
+	}
+	if q := queries["/reverse"]; q != "format=jsonv2&zoom=14&lat=35.685175&lon=139.7528&accept-language=ja" {
+		t.Errorf("Reverse のクエリ = %s", q)
+	}
+
+	place, lat, lng, err := n.Forward("東京タワー")
+	if err != nil || place != "東京タワー" || lat != 35.6585805 || lng != 139.7454329 {
+		t.Errorf("Forward = %q, %v, %v, %v", place, lat, lng, err)
+	}
+}
+
+func TestGSIGeocoder(t *testing.T) {
+	srv, _ := geoServer(t, map[string]string{
+		"/reverse": `{"results":{"muniCd":"13101","lv01Nm":"千代田"}}`,
+		"/search":  `[{"geometry":{"coordinates":[139.745433,35.658581]},"properties":{"title":"東京都港区芝公園四丁目"}}]`,
+		"/muni.js": "GSI.MUNI_ARRAY[\"1101\"] = '1,北海道,1101,札幌市　中央区';\nGSI.MUNI_ARRAY[\"13101\"] = '13,東京都,13101,千代田区';\n",
+	})
+	gcs := newGeocoders(GeocoderSettings{GSI: gsiGeocoder{
+		SearchEndpoint:  srv.URL + "/search",
+		ReverseEndpoint: srv.URL + "/reverse",
+		MuniEndpoint:    srv.URL + "/muni.js",
+	}}, "")
+	g := gcs["gsi"]
+
+	name, err := g.Reverse(35.685175, 139.7528)
+	if err != nil || name != "千代田区千代田" {
+		t.Errorf("Reverse = %q, %v", name, err)
+	}
+
+	place, lat, lng, err := g.Forward("芝公園")
+	if err != nil || place != "東京都港区芝公園四丁目" || lat != 35.658581 || lng != 139.745433 {
+		t.Errorf("Forward = %q, %v, %v, %v", place, lat, lng, err)
+	}
+}
+
+func TestGSIReverseWithoutMuni(t *testing.T) {
+	srv, _ := geoServer(t, map[string]string{
+		"/reverse": `{"results":{"muniCd":"13101","lv01Nm":"千代田"}}`,
+	})
+	// 市区町村一覧が取得できなければ、町字名だけ
+	gcs := newGeocoders(GeocoderSettings{GSI: gsiGeocoder{ReverseEndpoint: srv.URL + "/reverse", MuniEndpoint: srv.URL + "/none"}}, "")
+	if name, err := gcs["gsi"].Reverse(35.685175, 139.7528); err != nil || name != "千代田" {
+		t.Errorf("Reverse = %q, %v", name, err)
+	}
+}
+
+func TestParseMuni(t *testing.T) {
+	names := parseMuni("GSI.MUNI_ARRAY[\"1101\"] = '1,北海道,1101,札幌市　中央区';\nGSI.MUNI_ARRAY[\"01202\"] = '1,北海道,01202,函館市';\nbroken")
+	if len(names) != 2 || names["1101"] != "札幌市中央区" || names["1202"] != "函館市" {
+		t.Errorf("parseMuni = %v", names)
+	}
+}
@@ -8,7 +8,9 @@ replace gopkg.in/jdkato/prose.v2 => github.com/jdkato/prose/v2 v2.0.0
 
 require (
 	github.com/comail/colog v0.0.0-20160416085026-fba8e7b1f46c
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/go-sql-driver/mysql v1.8.1
+	github.com/gorilla/websocket v1.5.3
 	github.com/hanage999/go-mastodon v0.0.5-0.20241102235614-74e9cd061858
 	github.com/ringsaturn/tzf v0.16.0
 	github.com/spf13/viper v1.19.0
@@ -19,8 +21,6 @@ require (
 require (
 	filippo.io/edwards25519 v1.1.0 // indirect
 	github.com/deckarep/golang-set v1.8.0 // indirect
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
 	github.com/mingrammer/commonregex v1.0.1 // indirect
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package mastobots
+
+import "os"
+
+// healthSignals を受けたら、botたちの様子をログに出す。SIGUSR1のない環境では使わない。
+var healthSignals []os.Signal
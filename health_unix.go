@@ -0,0 +1,11 @@
+//go:build unix
+
+package mastobots
+
+import (
+	"os"
+	"syscall"
+)
+
+// healthSignals を受けたら、botたちの様子をログに出す
+var healthSignals = []os.Signal{syscall.SIGUSR1}
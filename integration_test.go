@@ -0,0 +1,301 @@
+package mastobots
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+// unavailableDriver は、常に失敗するデータベースドライバ。データベースなしでbotを動かすのに使う。
+type unavailableDriver struct{}
+
+type unavailableConn struct{}
+
+var errNoDatabase = errors.New("テスト中はデータベースを使いません")
+
+func (unavailableDriver) Open(name string) (driver.Conn, error) { return unavailableConn{}, nil }
+
+func (unavailableConn) Prepare(query string) (driver.Stmt, error) { return nil, errNoDatabase }
+
+func (unavailableConn) Close() error { return nil }
+
+func (unavailableConn) Begin() (driver.Tx, error) { return nil, errNoDatabase }
+
+func init() {
+	sql.Register("mastobots-unavailable", unavailableDriver{})
+}
+
+func unavailableDB(t *testing.T) DB {
+	t.Helper()
+	dbase, err := sql.Open("mastobots-unavailable", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { dbase.Close() })
+	return DB{dbase}
+}
+
+// integrationBot は、偽のサーバに登録したbotを、fakeClockの時刻で一日中起きているように準備する
+func integrationBot(t *testing.T, srv *mastotest.Server, clk *fakeClock, token string, configure func(bot *Persona)) *Persona {
+	t.Helper()
+	srv.AddAccount(token, mastodon.Account{Username: token, DisplayName: token, Bot: true})
+	bot := &Persona{
+		Name:        token,
+		Instance:    srv.URL,
+		AccessToken: token,
+		Interval:    60,
+		Assertion:   "",
+		loc:         time.UTC,
+		commonSettings: &commonSettings{
+			maxRetry:    2,
+			langJobPool: make(chan int, 1),
+			clk:         clk,
+		},
+	}
+	if configure != nil {
+		configure(bot)
+	}
+	if err := bot.parseDaySchedule(); err != nil {
+		t.Fatal(err)
+	}
+	if err := bot.getMastoID(); err != nil {
+		t.Fatal(err)
+	}
+	return bot
+}
+
+// parseWait は、英語のメンションへの反応を待つ時間。proseは解析のたびにモデルを読み込むので、-raceだと時間がかかる
+const parseWait = 30 * time.Second
+
+// runBots は、botたちを-pで指定した分だけ動かし、終わるのを待つ関数を返す
+func runBots(t *testing.T, clk *fakeClock, db DB, p int, bots ...*Persona) (stop func()) {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() {
+		done <- activateBots(context.Background(), bots, db, p, clk, nil, nil)
+	}()
+	return func() {
+		t.Helper()
+		clk.Advance(time.Duration(p) * time.Minute)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("activateBots: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("-p で指定した時間が経っても終了しませんでした")
+		}
+	}
+}
+
+func TestIntegrationVerifyCredentials(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	if bot.MyID == "" {
+		t.Error("アカウントIDが取得できていません")
+	}
+
+	bot.AccessToken = "wrong"
+	if err := bot.getMastoID(); err == nil {
+		t.Error("不正なトークンでアカウントIDが取得できてしまいました")
+	}
+}
+
+func TestIntegrationNotificationsOnWake(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	fan := mastodon.Account{ID: "42", Username: "fan", Acct: "fan@example.com", DisplayName: "Fan"}
+	n := srv.PushNotification("alice", mastodon.Notification{
+		Type:    "mention",
+		Account: fan,
+		Status:  &mastodon.Status{Account: fan, Content: "<p>@alice hello there</p>"},
+	})
+
+	stop := runBots(t, clk, db, 10, bot)
+	ok := srv.WaitFor(parseWait, func() bool {
+		return len(srv.Dismissed("alice")) == 1 && len(srv.Favourited("alice")) == 1
+	})
+	stop()
+
+	if !ok {
+		t.Fatalf("起きた時に通知を処理しませんでした：ふぁぼ %v、削除 %v", srv.Favourited("alice"), srv.Dismissed("alice"))
+	}
+	if got := srv.Favourited("alice")[0]; got != n.Status.ID {
+		t.Errorf("ふぁぼったのは %s, want %s", got, n.Status.ID)
+	}
+	if got := srv.Dismissed("alice")[0]; got != n.ID {
+		t.Errorf("削除した通知は %s, want %s", got, n.ID)
+	}
+}
+
+func TestIntegrationStreamingKeyword(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.Keywords = []string{"coffee"}
+		bot.Comments = []string{"_keyword1_!"}
+	})
+
+	stop := runBots(t, clk, db, 10, bot)
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 1 }) {
+		stop()
+		t.Fatal("ストリーミングに接続しませんでした")
+	}
+
+	// 他のサーバの人間のトゥートはふぁぼるだけ
+	human := mastodon.Account{ID: "7", Username: "human", Acct: "human@example.com"}
+	st1 := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>I love coffee in the morning</p>"})
+	// 同じサーバのbotのトゥートは、ふぁぼってブーストして引用コメントする
+	friend := mastodon.Account{ID: "8", Username: "friend", Acct: "friend", Bot: true}
+	st2 := srv.PushStatus("alice", mastodon.Status{Account: friend, Content: "<p>Fresh coffee beans arrived</p>"})
+	// キーワードのないトゥートには反応しない
+	srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Tea time</p>"})
+
+	// proseの初回の読み込みには時間がかかる
+	ok := srv.WaitFor(30*time.Second, func() bool {
+		return len(srv.Favourited("alice")) == 2 && len(srv.Reblogged("alice")) == 1 && len(srv.Posted("alice")) == 1
+	})
+	stop()
+
+	if !ok {
+		t.Fatalf("キーワードに反応しませんでした：ふぁぼ %v、ブースト %v、投稿 %d件",
+			srv.Favourited("alice"), srv.Reblogged("alice"), len(srv.Posted("alice")))
+	}
+	favs := map[mastodon.ID]bool{}
+	for _, id := range srv.Favourited("alice") {
+		favs[id] = true
+	}
+	if !favs[st1.ID] || !favs[st2.ID] {
+		t.Errorf("ふぁぼったのは %v, want %s と %s", srv.Favourited("alice"), st1.ID, st2.ID)
+	}
+	if got := srv.Reblogged("alice")[0]; got != st2.ID {
+		t.Errorf("ブーストしたのは %s, want %s", got, st2.ID)
+	}
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 0 }) {
+		t.Error("終了後もストリーミングの接続が残っています")
+	}
+}
+
+func TestIntegrationRandomToot(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.RandomToots = []string{"今日は_weekday_曜日"}
+		bot.RandomSchedule = "30 12 * * *"
+	})
+	if err := bot.parseSchedules(); err != nil {
+		t.Fatal(err)
+	}
+
+	stop := runBots(t, clk, db, 60, bot)
+	// -pのタイマー、起きている時間のタイマー、定期トゥート、予約投稿、ランダムトゥートのタイマーが揃うのを待つ
+	clk.waitForTimers(t, 5)
+	clk.Advance(29 * time.Minute)
+	time.Sleep(20 * time.Millisecond)
+	if n := len(srv.Posted("alice")); n != 0 {
+		t.Errorf("予定の時刻より前に%d件投稿しました", n)
+	}
+	clk.Advance(time.Minute)
+	ok := srv.WaitFor(5*time.Second, func() bool { return len(srv.Posted("alice")) == 1 })
+	stop()
+
+	if !ok {
+		t.Fatal("予定の時刻にランダムトゥートしませんでした")
+	}
+	if got := srv.Posted("alice")[0].Content; !strings.HasPrefix(got, "<p>今日は水曜日") {
+		t.Errorf("投稿内容 = %q", got)
+	}
+}
+
+func TestIntegrationDryRun(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+	path := filepath.Join(t.TempDir(), "dryrun.jsonl")
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.DryRun = true
+		bot.commonSettings.sink = &jsonlSink{path: path}
+		bot.ScheduledPosts = []ScheduledPost{{Status: "お知らせ_date_", At: "2024-05-01 12:05", Visibility: "unlisted"}}
+	})
+	if err := bot.parseScheduledPosts(); err != nil {
+		t.Fatal(err)
+	}
+	fan := mastodon.Account{ID: "42", Username: "fan", Acct: "fan@example.com"}
+	srv.PushNotification("alice", mastodon.Notification{
+		Type:    "mention",
+		Account: fan,
+		Status:  &mastodon.Status{Account: fan, Content: "<p>@alice hello</p>"},
+	})
+
+	stop := runBots(t, clk, db, 60, bot)
+	clk.waitForTimers(t, 4)
+	clk.Advance(5 * time.Minute)
+
+	var actions []Action
+	ok := srv.WaitFor(parseWait, func() bool {
+		actions = readActions(t, path)
+		return len(actions) == 3
+	})
+	stop()
+
+	if !ok {
+		t.Fatalf("dry-runの記録が揃いませんでした：%+v", actions)
+	}
+	kinds := map[string]Action{}
+	for _, a := range actions {
+		kinds[a.Kind] = a
+	}
+	if a := kinds["post"]; a.Status != "お知らせ5月1日" || a.Visibility != "unlisted" {
+		t.Errorf("予約投稿の記録 = %+v", a)
+	}
+	if _, ok := kinds["favourite"]; !ok {
+		t.Error("ふぁぼが記録されていません")
+	}
+	if _, ok := kinds["dismiss"]; !ok {
+		t.Error("通知削除が記録されていません")
+	}
+	if len(srv.Posted("alice")) != 0 || len(srv.Favourited("alice")) != 0 || len(srv.Dismissed("alice")) != 0 {
+		t.Error("dry-runなのにサーバに書き込みました")
+	}
+}
+
+func readActions(t *testing.T, path string) (actions []Action) {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var a Action
+		if err := json.Unmarshal([]byte(line), &a); err != nil {
+			t.Fatalf("JSONLが読めません：%s", err)
+		}
+		actions = append(actions, a)
+	}
+	return
+}
@@ -2,9 +2,15 @@ package mastobots
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/comail/colog"
@@ -15,62 +21,169 @@ import (
 var (
 	version = "1"
 	f       tzf.F
+	logOnce sync.Once
+
+	// forceDryRun は、SetDryRunで全てのbotをdry-runにする時にtrue
+	forceDryRun bool
 )
 
 type commonSettings struct {
 	maxRetry      int
 	retryInterval time.Duration
+	sendPause     time.Duration // 書き込みを送る前に置く間の単位
 	yahooClientID string
 	weatherKey    string
 	langJobPool   chan int
+	geocoders     map[string]Geocoder
+	defaultGeo    string
+	clk           Clock
+	sink          Sink
+	dbCredentials map[string]string
+	inflight      inflight
+	limiters      rateLimiters
+	outboxDB      DB
 }
 
-// Initialize は、config.ymlに従ってbotとデータベース接続を初期化する。
-func Initialize() (bots []*Persona, db DB, err error) {
-	// colog 設定
-	if version == "" {
-		colog.SetDefaultLevel(colog.LDebug)
-		colog.SetMinLevel(colog.LTrace)
-		colog.SetFormatter(&colog.StdFormatter{
-			Colors: true,
-			Flag:   log.Ldate | log.Ltime | log.Lshortfile,
-		})
-	} else {
-		colog.SetDefaultLevel(colog.LDebug)
-		colog.SetMinLevel(colog.LInfo)
-		colog.SetFormatter(&colog.StdFormatter{
-			Colors: true,
-			Flag:   log.Ldate | log.Ltime,
-		})
-	}
-	colog.Register()
-
-	// 依存アプリの存在確認
-	for _, cmd := range []string{"jumanpp", "mysql"} {
-		_, err := exec.LookPath(cmd)
-		if err != nil {
-			log.Printf("alert: %s がインストールされていません！", cmd)
-			return nil, db, err
+// setupLog は、cologを設定する。何度呼んでも一度だけ設定する。
+func setupLog() {
+	logOnce.Do(func() {
+		if version == "" {
+			colog.SetDefaultLevel(colog.LDebug)
+			colog.SetMinLevel(colog.LTrace)
+			colog.SetFormatter(&colog.StdFormatter{
+				Colors: true,
+				Flag:   log.Ldate | log.Ltime | log.Lshortfile,
+			})
+		} else {
+			colog.SetDefaultLevel(colog.LDebug)
+			colog.SetMinLevel(colog.LInfo)
+			colog.SetFormatter(&colog.StdFormatter{
+				Colors: true,
+				Flag:   log.Ldate | log.Ltime,
+			})
 		}
-	}
+		colog.SetOutput(logRedactor)
+		colog.Register()
+	})
+}
 
-	var cr map[string]string
+// SetDryRun は、onがtrueなら、設定ファイルの DryRun にかかわらず全てのbotをdry-runで動かす。
+// 設定ファイルを読み直した時にも効く。
+func SetDryRun(on bool) {
+	forceDryRun = on
+}
 
-	// bot設定ファイル読み込み
+// newConfig は、config.ymlを読むviperを作る
+func newConfig() *viper.Viper {
 	conf := viper.New()
 	conf.SetConfigName("config")
 	conf.AddConfigPath(".")
 	conf.SetConfigType("yaml")
+	return conf
+}
+
+// LoadConfig は、config.ymlを読み込んでbotを準備する。Mastodonサーバやデータベースには接続しない。
+// 設定の問題は、見つかった分をまとめてConfigErrorsで返す。
+func LoadConfig() (bots []*Persona, err error) {
+	return loadConfig(newConfig(), nil)
+}
+
+// loadConfig は、confで設定ファイルを読み込んでbotを準備する。
+// commonがnilでなければ、全体の設定は読まずに、botたちにcommonを使わせる。
+func loadConfig(conf *viper.Viper, common *commonSettings) (bots []*Persona, err error) {
+	setupLog()
+
+	// bot設定ファイル読み込み
 	if err := conf.ReadInConfig(); err != nil {
 		log.Printf("alert: 設定ファイルが読み込めませんでした")
-		return nil, db, err
+		return nil, err
+	}
+	var errs ConfigErrors
+	if err := conf.UnmarshalKey("Personae", &bots); err != nil {
+		errs.add("", "Personae", "botの設定が読み込めませんでした：%s", err)
+		return nil, errs
+	}
+
+	// 全体の設定。読み直しの時は、起動時のものを使い続ける
+	cmn := common
+	if cmn == nil {
+		cmn = loadCommonSettings(conf, &errs)
+	}
+
+	// 各botの設定
+	for _, bot := range bots {
+		for _, sc := range []struct {
+			key string
+			v   *string
+		}{
+			{"AccessToken", &bot.AccessToken},
+			{"ClientKey", &bot.ClientKey},
+			{"ClientSecret", &bot.ClientSecret},
+		} {
+			if *sc.v, err = resolveSecret(*sc.v); err != nil {
+				errs.add(bot.Name, sc.key, "%s", err)
+			}
+		}
+	}
+	errs = append(errs, validateBots(bots)...)
+	for _, bot := range bots {
+		bot.commonSettings = cmn
+		bot.DryRun = bot.DryRun || forceDryRun
+		var err error
+		if bot.geocoder, err = cmn.geocoderFor(bot.Geocoder); err != nil {
+			errs.merge(bot.Name, "Geocoder", err)
+		}
+		errs.merge(bot.Name, "Schedule", bot.parseSchedules())
 	}
-	conf.UnmarshalKey("Personae", &bots)
-	var cmn commonSettings
+
+	// TZF（グローバル変数に設定）を初期化
+	f, err = tzf.NewDefaultFinder()
+	if err != nil {
+		log.Printf("info: %s", err)
+		return nil, err
+	}
+	defer func() { f = nil }()
+
+	// botのタイムゾーンを決め、予約投稿の日時と活動時間帯をbotのタイムゾーンで解釈
+	for _, bot := range bots {
+		if err := bot.setLocation(); err != nil {
+			errs.add(bot.Name, "TimeZone", "%s が読み込めませんでした：%s", bot.TimeZone, err)
+		}
+		errs.merge(bot.Name, "WeeklySchedule", bot.parseDaySchedule())
+		errs.merge(bot.Name, "ScheduledPosts", bot.parseScheduledPosts())
+	}
+
+	if err = errs.err(); err != nil {
+		return nil, err
+	}
+	for _, bot := range bots {
+		log.Printf("info: %s のタイムゾーンは %s です", bot.Name, bot.location())
+	}
+	return
+}
+
+// loadCommonSettings は、confから全体の設定を読む。問題があればerrsに加える。
+// 省略した時の既定値：リトライは5秒おきに5回、書き込みの前の間は1秒単位、NumConcurrentLangJobsは1（10まで）、
+// Geocoding.Defaultはyahoo、DryRunSink.Typeはlog
+func loadCommonSettings(conf *viper.Viper, errs *ConfigErrors) (cmn *commonSettings) {
+	var err error
+	cmn = &commonSettings{}
 	cmn.maxRetry = 5
 	cmn.retryInterval = time.Duration(5) * time.Second
-	cmn.yahooClientID = conf.GetString("YahooClientID")
-	cmn.weatherKey = conf.GetString("OpenWeatherMapKey")
+	cmn.sendPause = time.Second
+	cmn.clk = realClock{}
+	if cmn.yahooClientID, err = resolveSecret(conf.GetString("YahooClientID")); err != nil {
+		errs.add("", "YahooClientID", "%s", err)
+	}
+	if cmn.weatherKey, err = resolveSecret(conf.GetString("OpenWeatherMapKey")); err != nil {
+		errs.add("", "OpenWeatherMapKey", "%s", err)
+	}
+	cmn.dbCredentials = conf.GetStringMapString("DBCredentials")
+	if pw, ok := cmn.dbCredentials["password"]; ok {
+		if cmn.dbCredentials["password"], err = resolveSecret(pw); err != nil {
+			errs.add("", "DBCredentials.Password", "%s", err)
+		}
+	}
 	nOfJobs := conf.GetInt("NumConcurrentLangJobs")
 	if nOfJobs <= 0 {
 		nOfJobs = 1
@@ -78,30 +191,109 @@ func Initialize() (bots []*Persona, db DB, err error) {
 		nOfJobs = 10
 	}
 	cmn.langJobPool = make(chan int, nOfJobs)
-	for _, bot := range bots {
-		bot.commonSettings = &cmn
+	var gs GeocoderSettings
+	if err := conf.UnmarshalKey("Geocoding", &gs); err != nil {
+		errs.add("", "Geocoding", "ジオコーディングの設定が読み込めませんでした：%s", err)
+	}
+	cmn.geocoders = newGeocoders(gs, cmn.yahooClientID)
+	cmn.defaultGeo = gs.Default
+	if cmn.defaultGeo == "" {
+		cmn.defaultGeo = "yahoo"
 	}
-	cr = conf.GetStringMapString("DBCredentials")
+	var ss SinkSettings
+	if err := conf.UnmarshalKey("DryRunSink", &ss); err != nil {
+		errs.add("", "DryRunSink", "dry-runの出力先の設定が読み込めませんでした：%s", err)
+	} else if cmn.sink, err = newSink(ss); err != nil {
+		errs.add("", "DryRunSink.Type", "%s", err)
+	}
+	return
+}
 
-	// botをMastodonサーバに接続し、アカウントIDを取得
-	for _, bot := range bots {
-		if err := bot.getMastoID(); err != nil {
-			log.Printf("alert: %s のMastodonアカウントIDができませんでした。終了します", bot.Name)
+// Initialize は、config.ymlに従ってbotとデータベース接続を初期化する。
+func Initialize() (bots []*Persona, db DB, err error) {
+	setupLog()
+
+	// 依存アプリの存在確認
+	for _, cmd := range []string{"jumanpp", "mysql"} {
+		_, err := exec.LookPath(cmd)
+		if err != nil {
+			log.Printf("alert: %s がインストールされていません！", cmd)
 			return nil, db, err
 		}
 	}
 
+	bots, err = LoadConfig()
+	if err != nil {
+		var errs ConfigErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				log.Printf("alert: 設定の問題：%s", e)
+			}
+		}
+		return nil, db, err
+	}
+
+	// botをMastodonサーバに接続し、アカウントIDを取得。接続できなかったbotは、他のbotを動かしながら後で接続し直す
+	for _, bot := range bots {
+		if err := bot.verifyCredentials(context.Background()); err != nil {
+			bot.startupErr = fmt.Errorf("Mastodonサーバに接続できませんでした：%w", err)
+		}
+	}
+
 	// データベースへの接続
+	db, err = OpenDB(bots)
+	if err != nil {
+		return nil, db, err
+	}
+
+	// botの住処を登録
+	for _, bot := range bots {
+		if bot.LivesWithSun && bot.startupErr == nil {
+			log.Printf("info: %s の所在地を設定しています……", bot.Name)
+			time.Sleep(1001 * time.Millisecond)
+			var perr error
+			if bot.PlaceName, perr = getPlaceName(bot.geocoder, bot.Latitude, bot.Longitude); perr != nil {
+				bot.startupErr = fmt.Errorf("所在地情報の設定に失敗しました：%w", perr)
+			}
+		}
+	}
+
+	// 準備できなかったbotを報告
+	ready := 0
+	for _, bot := range bots {
+		if bot.startupErr != nil {
+			log.Printf("alert: %s は準備できませんでした。後でやり直します：%s", bot.Name, bot.startupErr)
+			continue
+		}
+		ready++
+	}
+	log.Printf("info: %d体のうち%d体のbotが準備できました", len(bots), ready)
+
+	return
+}
+
+// OpenDB は、データベースに接続し、botたちを登録してデータベース上のIDを取得する。
+func OpenDB(bots []*Persona) (db DB, err error) {
+	var cr map[string]string
+	if len(bots) > 0 {
+		cr = bots[0].commonSettings.dbCredentials
+	}
 	db, err = newDB(cr)
 	if err != nil {
 		log.Printf("alert: データベースへの接続が確保できませんでした")
-		return nil, db, err
+		return db, err
 	}
 
 	// botがまだデータベースに登録されていなかったら登録
+	if len(bots) == 0 {
+		return
+	}
+	for _, bot := range bots {
+		bot.commonSettings.outboxDB = db
+	}
 	if err = db.addNewBots(bots); err != nil {
 		log.Printf("alert: データベースにbotが登録できませんでした")
-		return nil, db, err
+		return db, err
 	}
 
 	// botのデータベース上のIDを取得
@@ -109,56 +301,114 @@ func Initialize() (bots []*Persona, db DB, err error) {
 		id, err := db.botID(bot)
 		if err != nil {
 			log.Printf("alert: botのデータベース上のIDが取得できませんでした")
-			return nil, db, err
+			return db, err
 		}
 		bot.DBID = id
+		// 前のプロセスが送っている途中で止まった書き込みを、どのbotも動き出す前に送信待ちに戻す
+		db.releaseActions(bot, time.Now())
 	}
+	return
+}
 
-	// TZF（グローバル変数に設定）を初期化
-	f, err = tzf.NewDefaultFinder()
+// LookupDB は、データベースに接続し、登録済みのbotのデータベース上のIDを取得する。
+// 見るだけのサブコマンド用で、botをデータベースに登録しない。まだ登録されていないbotがいたらエラーを返す。
+func LookupDB(bots []*Persona) (db DB, err error) {
+	var cr map[string]string
+	if len(bots) > 0 {
+		cr = bots[0].commonSettings.dbCredentials
+	}
+	db, err = newDB(cr)
 	if err != nil {
-		log.Printf("info: %s", err)
-		return nil, db, err
+		log.Printf("alert: データベースへの接続が確保できませんでした")
+		return db, err
 	}
-
-	// botの住処を登録
 	for _, bot := range bots {
-		if bot.LivesWithSun {
-			log.Printf("info: %s の所在地を設定しています……", bot.Name)
-			time.Sleep(1001 * time.Millisecond)
-			bot.PlaceName, bot.TimeZone, err = getLocDataFromCoordinates(bot.commonSettings.yahooClientID, bot.Latitude, bot.Longitude)
-			if err != nil {
-				log.Printf("alert: %s の所在地情報の設定に失敗しました：%s", bot.Name, err)
-				return nil, db, err
-			}
+		id, err := db.botID(bot)
+		if err != nil {
+			log.Printf("alert: %s はまだデータベースに登録されていません。一度 mastobots run で動かしてください", bot.Name)
+			db.Close()
+			return db, err
 		}
+		bot.DBID = id
 	}
-
-	f = nil
-
 	return
 }
 
-// ActivateBots は、botたちを活動させる。
+// ActivateBots は、botたちを活動させる。config.ymlが書き換えられたら、活動中のbotに反映する。
+// SIGINTかSIGTERMを受けたら、書き込みが終わるのを待ってから戻る。もう一度受けたらすぐに終了する。
+// SIGUSR1を受けたら、botたちの様子をログに出す。全てのbotが活動を続けられなくなったら、それぞれの理由をBotErrorsで返す。
 func ActivateBots(bots []*Persona, db DB, p int) (err error) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	var healths chan os.Signal
+	if len(healthSignals) > 0 {
+		healths = make(chan os.Signal, 1)
+		signal.Notify(healths, healthSignals...)
+		defer signal.Stop(healths)
+	}
+	var cmn *commonSettings
+	if len(bots) > 0 {
+		cmn = bots[0].commonSettings
+	}
+	return activateBots(ctx, bots, db, p, realClock{}, watchConfig(ctx, cmn), healths)
+}
+
+// activateBots は、clkの時刻に従ってbotたちを活動させ、reloadsから届いた設定を反映する。
+// healthsに合図が届いたら、botたちの様子をログに出す。
+// ctxが終わるか、-pで指定した時間が経つか、全てのbotが活動を続けられなくなったらシャットダウンする。
+func activateBots(ctx context.Context, bots []*Persona, db DB, p int, clk Clock, reloads <-chan []*Persona, healths <-chan os.Signal) (err error) {
 	// 全てをシャットダウンするタイムアウトの設定
-	ctx := context.Background()
-	var cancel context.CancelFunc
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	msg := "mastobots、時間無制限でスタートです！"
 	if p > 0 {
 		msg = "mastobots、" + strconv.Itoa(p) + "分間動きます！"
 		dur := time.Duration(p) * time.Minute
-		ctx, cancel = context.WithTimeout(ctx, dur)
+		runCtx, cancel = withClockTimeout(ctx, clk, dur)
 		defer cancel()
 	}
 	log.Printf("info: " + msg)
 
 	// 行ってらっしゃい
+	var cmn *commonSettings
+	if len(bots) > 0 {
+		cmn = bots[0].commonSettings
+	}
+	r := newRoster(runCtx, db, cmn)
+	r.mu.Lock()
 	for _, bot := range bots {
-		go bot.spawn(ctx, db, true, false)
+		r.start(bot)
+	}
+	r.mu.Unlock()
+
+LOOP:
+	for {
+		select {
+		case nbs := <-reloads:
+			r.apply(nbs)
+		case <-healths:
+			r.logHealth()
+		case <-r.allLost:
+			if err = r.deadErr(); err != nil {
+				break LOOP
+			}
+		case <-runCtx.Done():
+			break LOOP
+		}
 	}
 
-	<-ctx.Done()
-	log.Printf("info: %d分経ったのでシャットダウンします", p)
+	if err != nil {
+		log.Printf("alert: 活動を続けられるbotがいなくなったのでシャットダウンします")
+	} else if ctx.Err() != nil {
+		log.Printf("info: 終了の合図を受けたのでシャットダウンします")
+	} else {
+		log.Printf("info: %d分経ったのでシャットダウンします", p)
+	}
+	r.shutdown(clk)
+	log.Printf("info: mastobots、おしまいです")
 	return
 }
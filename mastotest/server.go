@@ -0,0 +1,919 @@
+// Package mastotest は、mastobotsが使うMastodon APIを模した偽のサーバを提供する。
+// 結合テストや、本物のインスタンスに投稿せずにbotを動かしてみる時に使う。
+package mastotest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// Request は、サーバが受け付けたAPIリクエストを記録する
+type Request struct {
+	Token  string
+	Method string
+	Path   string
+	Form   url.Values
+	Header http.Header
+}
+
+// failure は、指定した回数だけわざと失敗させるAPIを格納する
+type failure struct {
+	code  int
+	times int
+}
+
+// rateLimit は、アクセストークンごとのAPIの呼び出し回数の制限
+type rateLimit struct {
+	limit     int
+	remaining int
+	reset     time.Time
+}
+
+// user は、アクセストークンごとのアカウントと、その周りの状態を格納する
+type user struct {
+	account       *mastodon.Account
+	home          []*mastodon.Status
+	notifications []*mastodon.Notification
+	following     map[mastodon.ID]bool
+	followedBy    map[mastodon.ID]bool
+	posted        []*mastodon.Status
+	favourited    []mastodon.ID
+	reblogged     []mastodon.ID
+	followed      []mastodon.ID
+	dismissed     []mastodon.ID
+	streams       map[*stream]bool
+	idempotent    map[string]*mastodon.Status
+	lists         []*list
+}
+
+// list は、ユーザが作ったリストと、そこに入れたアカウント
+type list struct {
+	mastodon.List
+	members map[mastodon.ID]bool
+}
+
+// stream は、ストリーミングの一つの接続
+type stream struct {
+	name string
+	tag  string
+	ch   chan mastodon.Stream
+	done chan struct{}
+}
+
+// Server は、偽のMastodonサーバ
+type Server struct {
+	URL string
+
+	mu       sync.Mutex
+	users    map[string]*user
+	statuses map[mastodon.ID]*mastodon.Status
+	public   []*mastodon.Status
+	failures map[string]*failure
+	limits   map[string]*rateLimit
+	apps     map[string]string
+	codes    map[string]string
+	requests []Request
+	nextID   int
+	mux      *http.ServeMux
+	ts       *httptest.Server
+	closed   chan struct{}
+}
+
+var upgrader = websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+
+// New は、偽のサーバを作る。http.Handlerとして好きなアドレスで待ち受けられる。
+func New() (s *Server) {
+	s = &Server{
+		users:    make(map[string]*user),
+		statuses: make(map[mastodon.ID]*mastodon.Status),
+		failures: make(map[string]*failure),
+		limits:   make(map[string]*rateLimit),
+		apps:     make(map[string]string),
+		codes:    make(map[string]string),
+		mux:      http.NewServeMux(),
+		closed:   make(chan struct{}),
+	}
+	s.mux.HandleFunc("GET /api/v1/accounts/verify_credentials", s.verifyCredentials)
+	s.mux.HandleFunc("GET /api/v1/accounts/relationships", s.relationships)
+	s.mux.HandleFunc("POST /api/v1/accounts/{id}/follow", s.follow)
+	s.mux.HandleFunc("POST /api/v1/statuses", s.postStatus)
+	s.mux.HandleFunc("GET /api/v1/statuses/{id}", s.getStatus)
+	s.mux.HandleFunc("POST /api/v1/statuses/{id}/favourite", s.favourite)
+	s.mux.HandleFunc("POST /api/v1/statuses/{id}/reblog", s.reblog)
+	s.mux.HandleFunc("POST /api/v1/media", s.uploadMedia)
+	s.mux.HandleFunc("GET /api/v1/notifications", s.getNotifications)
+	s.mux.HandleFunc("POST /api/v1/notifications/{id}/dismiss", s.dismissNotification)
+	s.mux.HandleFunc("GET /api/v1/timelines/home", s.homeTimeline)
+	s.mux.HandleFunc("GET /api/v1/timelines/public", s.publicTimeline)
+	s.mux.HandleFunc("GET /api/v1/timelines/tag/{tag}", s.tagTimeline)
+	s.mux.HandleFunc("GET /api/v1/timelines/list/{id}", s.listTimeline)
+	s.mux.HandleFunc("GET /api/v1/lists", s.getLists)
+	s.mux.HandleFunc("GET /api/v1/streaming", s.streaming)
+	s.mux.HandleFunc("GET /api/v1/streaming/{kind...}", s.eventStream)
+	s.mux.HandleFunc("POST /api/v1/apps", s.registerApp)
+	s.mux.HandleFunc("GET /oauth/authorize", s.authorize)
+	s.mux.HandleFunc("POST /oauth/token", s.issueToken)
+	return
+}
+
+// NewServer は、偽のサーバをローカルのポートで起動する。使い終わったらCloseすること。
+func NewServer() (s *Server) {
+	s = New()
+	s.ts = httptest.NewServer(s)
+	s.URL = s.ts.URL
+	return
+}
+
+// Close は、ストリーミングの接続を全て切ってサーバを止める
+func (s *Server) Close() {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+	default:
+		close(s.closed)
+	}
+	s.mu.Unlock()
+	if s.ts != nil {
+		s.ts.Close()
+	}
+}
+
+// AddAccount は、アクセストークンtokenで使えるアカウントを登録する。IDが空なら採番する。
+func (s *Server) AddAccount(token string, acc mastodon.Account) *mastodon.Account {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if acc.ID == "" {
+		acc.ID = s.newIDLocked()
+	}
+	if acc.Acct == "" {
+		acc.Acct = acc.Username
+	}
+	s.users[token] = &user{
+		account:    &acc,
+		following:  make(map[mastodon.ID]bool),
+		followedBy: make(map[mastodon.ID]bool),
+		streams:    make(map[*stream]bool),
+	}
+	return &acc
+}
+
+// IssueCode は、アクセストークンtokenのアカウントがアプリを承認したことにして、認可コードを返す
+func (s *Server) IssueCode(token string) (code string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issueCodeLocked(token)
+}
+
+func (s *Server) issueCodeLocked(token string) (code string) {
+	code = "code-" + string(s.newIDLocked())
+	s.codes[code] = token
+	return
+}
+
+// AddStatus は、ステータスを登録する。IDが空なら採番する。
+func (s *Server) AddStatus(st mastodon.Status) *mastodon.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addStatusLocked(st)
+}
+
+func (s *Server) addStatusLocked(st mastodon.Status) *mastodon.Status {
+	if st.ID == "" {
+		st.ID = s.newIDLocked()
+	}
+	if st.CreatedAt.IsZero() {
+		st.CreatedAt = time.Now().UTC()
+	}
+	if st.URL == "" {
+		st.URL = s.URL + "/@" + st.Account.Username + "/" + string(st.ID)
+	}
+	if st.Visibility == "" {
+		st.Visibility = "public"
+	}
+	s.statuses[st.ID] = &st
+	return &st
+}
+
+// PushStatus は、ステータスをtokenのユーザのホームタイムラインに載せ、ストリーミングでも流す
+func (s *Server) PushStatus(token string, st mastodon.Status) *mastodon.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := s.addStatusLocked(st)
+	u := s.users[token]
+	if u == nil {
+		return added
+	}
+	u.home = append(u.home, added)
+	s.sendLocked(u, "user", "update", added)
+	return added
+}
+
+// PushPublic は、ステータスを連合タイムラインに載せ、公開・ローカル・ハッシュタグ・リストのストリーミングでも流す。
+// 投稿者のAcctに「@」がなければ、このサーバのローカルの投稿とみなす。
+func (s *Server) PushPublic(st mastodon.Status) *mastodon.Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	added := s.addStatusLocked(st)
+	s.public = append(s.public, added)
+	b, err := json.Marshal(added)
+	if err != nil {
+		return added
+	}
+	for _, u := range s.users {
+		for st := range u.streams {
+			if !u.receives(st, added) {
+				continue
+			}
+			select {
+			case st.ch <- mastodon.Stream{Event: "update", Payload: string(b)}:
+			default:
+			}
+		}
+	}
+	return added
+}
+
+// AddList は、tokenのユーザのリストを作り、membersのアカウントを入れる。リストのIDを返す。
+func (s *Server) AddList(token, title string, members ...mastodon.ID) mastodon.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l := &list{List: mastodon.List{ID: s.newIDLocked(), Title: title}, members: make(map[mastodon.ID]bool)}
+	for _, id := range members {
+		l.members[id] = true
+	}
+	if u := s.users[token]; u != nil {
+		u.lists = append(u.lists, l)
+	}
+	return l.ID
+}
+
+// PushNotification は、tokenのユーザに通知を届け、ストリーミングでも流す
+func (s *Server) PushNotification(token string, n mastodon.Notification) *mastodon.Notification {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n.ID == "" {
+		n.ID = s.newIDLocked()
+	}
+	if n.CreatedAt.IsZero() {
+		n.CreatedAt = time.Now().UTC()
+	}
+	if n.Status != nil {
+		n.Status = s.addStatusLocked(*n.Status)
+	}
+	u := s.users[token]
+	if u == nil {
+		return &n
+	}
+	u.notifications = append(u.notifications, &n)
+	s.sendLocked(u, "user", "notification", &n)
+	return &n
+}
+
+// SetFollowing は、tokenのユーザがアカウントidをフォローしているかどうかを設定する
+func (s *Server) SetFollowing(token string, id mastodon.ID, following bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[token]; u != nil {
+		u.following[id] = following
+	}
+}
+
+// SetFollowedBy は、アカウントidがtokenのユーザをフォローしているかどうかを設定する
+func (s *Server) SetFollowedBy(token string, id mastodon.ID, followedBy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[token]; u != nil {
+		u.followedBy[id] = followedBy
+	}
+}
+
+// Fail は、methodとpathに合うリクエストを、times回だけステータスコードcodeで失敗させる
+func (s *Server) Fail(method, path string, code, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[method+" "+path] = &failure{code, times}
+}
+
+// SetRateLimit は、tokenのユーザのAPIリクエストを、resetまでにlimit回に制限する。
+// 応答には X-RateLimit-Limit・X-RateLimit-Remaining・X-RateLimit-Reset をつけ、使い切ったら429を返す。
+// resetを過ぎても回数は戻らないので、もう一度呼んで戻すこと。ストリーミングは数えない。
+func (s *Server) SetRateLimit(token string, limit int, reset time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.limits[token] = &rateLimit{limit: limit, remaining: limit, reset: reset}
+}
+
+// DisconnectStreams は、tokenのユーザのストリーミング接続を全て切る
+func (s *Server) DisconnectStreams(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.users[token]
+	if u == nil {
+		return
+	}
+	for st := range u.streams {
+		close(st.done)
+		delete(u.streams, st)
+	}
+}
+
+// Posted は、tokenのユーザが投稿したステータスを返す
+func (s *Server) Posted(token string) (sts []*mastodon.Status) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[token]; u != nil {
+		sts = append(sts, u.posted...)
+	}
+	return
+}
+
+// Favourited は、tokenのユーザがふぁぼったステータスのIDを返す
+func (s *Server) Favourited(token string) []mastodon.ID {
+	return s.ids(token, func(u *user) []mastodon.ID { return u.favourited })
+}
+
+// Reblogged は、tokenのユーザがブーストしたステータスのIDを返す
+func (s *Server) Reblogged(token string) []mastodon.ID {
+	return s.ids(token, func(u *user) []mastodon.ID { return u.reblogged })
+}
+
+// Followed は、tokenのユーザがフォローしたアカウントのIDを返す
+func (s *Server) Followed(token string) []mastodon.ID {
+	return s.ids(token, func(u *user) []mastodon.ID { return u.followed })
+}
+
+// Dismissed は、tokenのユーザが削除した通知のIDを返す
+func (s *Server) Dismissed(token string) []mastodon.ID {
+	return s.ids(token, func(u *user) []mastodon.ID { return u.dismissed })
+}
+
+func (s *Server) ids(token string, get func(u *user) []mastodon.ID) (ids []mastodon.ID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[token]; u != nil {
+		ids = append(ids, get(u)...)
+	}
+	return
+}
+
+// Streams は、tokenのユーザがいま開いているストリーミング接続の数を返す
+func (s *Server) Streams(token string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u := s.users[token]; u != nil {
+		return len(u.streams)
+	}
+	return 0
+}
+
+// Requests は、これまでに受け付けたリクエストを返す
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request{}, s.requests...)
+}
+
+// WaitFor は、condが真になるまでtimeoutを上限に待つ
+func (s *Server) WaitFor(timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		if cond() {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Server) newIDLocked() mastodon.ID {
+	s.nextID++
+	return mastodon.ID(strconv.Itoa(100000 + s.nextID))
+}
+
+func (s *Server) sendLocked(u *user, name, event string, payload interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return
+	}
+	for st := range u.streams {
+		if st.name != name {
+			continue
+		}
+		select {
+		case st.ch <- mastodon.Stream{Event: event, Payload: string(b)}:
+		default:
+		}
+	}
+}
+
+// ServeHTTP は、リクエストを記録し、認証と失敗の指定を処理してから各APIに振り分ける
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.Form.Get("access_token")
+	}
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{token, r.Method, r.URL.Path, r.Form, r.Header.Clone()})
+	f := s.failures[r.Method+" "+r.URL.Path]
+	if f != nil && f.times > 0 {
+		f.times--
+		s.mu.Unlock()
+		writeError(w, f.code, http.StatusText(f.code))
+		return
+	}
+	_, ok := s.users[token]
+	limited := false
+	if l := s.limits[token]; l != nil && ok && !strings.HasPrefix(r.URL.Path, "/api/v1/streaming") {
+		if l.remaining > 0 {
+			l.remaining--
+		} else {
+			limited = true
+		}
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(l.remaining))
+		w.Header().Set("X-RateLimit-Reset", l.reset.UTC().Format(time.RFC3339Nano))
+	}
+	s.mu.Unlock()
+	if !ok && !isPublic(r.URL.Path) {
+		writeError(w, http.StatusUnauthorized, "The access token is invalid")
+		return
+	}
+	if limited {
+		writeError(w, http.StatusTooManyRequests, "Too many requests")
+		return
+	}
+
+	s.mux.ServeHTTP(w, r)
+}
+
+// isPublic は、アクセストークンなしで使えるAPIならtrueを返す
+func isPublic(path string) bool {
+	return path == "/api/v1/apps" || strings.HasPrefix(path, "/oauth/")
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
+
+// userOf は、リクエストのアクセストークンのユーザを返す。ServeHTTPで認証済みであること。
+func (s *Server) userOf(r *http.Request) *user {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.Form.Get("access_token")
+	}
+	return s.users[token]
+}
+
+func (s *Server) verifyCredentials(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	acc := *s.userOf(r).account
+	s.mu.Unlock()
+	writeJSON(w, acc)
+}
+
+func (s *Server) relationships(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userOf(r)
+	rels := make([]mastodon.Relationship, 0)
+	for _, id := range r.Form["id[]"] {
+		rels = append(rels, mastodon.Relationship{ID: mastodon.ID(id), Following: u.following[mastodon.ID(id)], FollowedBy: u.followedBy[mastodon.ID(id)]})
+	}
+	writeJSON(w, rels)
+}
+
+func (s *Server) follow(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userOf(r)
+	id := mastodon.ID(r.PathValue("id"))
+	u.following[id] = true
+	u.followed = append(u.followed, id)
+	writeJSON(w, mastodon.Relationship{ID: id, Following: true})
+}
+
+func (s *Server) postStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userOf(r)
+	// 同じ Idempotency-Key の投稿は、新しく作らずに前と同じステータスを返す
+	key := r.Header.Get("Idempotency-Key")
+	if st, ok := u.idempotent[key]; ok && key != "" {
+		writeJSON(w, st)
+		return
+	}
+	st := mastodon.Status{
+		Account:     *u.account,
+		Content:     "<p>" + r.Form.Get("status") + "</p>",
+		SpoilerText: r.Form.Get("spoiler_text"),
+		Visibility:  r.Form.Get("visibility"),
+		Language:    r.Form.Get("language"),
+		Sensitive:   r.Form.Get("sensitive") == "true",
+	}
+	if id := r.Form.Get("in_reply_to_id"); id != "" {
+		st.InReplyToID = id
+	}
+	for _, id := range r.Form["media_ids[]"] {
+		st.MediaAttachments = append(st.MediaAttachments, mastodon.Attachment{ID: mastodon.ID(id), Type: "image"})
+	}
+	added := s.addStatusLocked(st)
+	if key != "" {
+		if u.idempotent == nil {
+			u.idempotent = make(map[string]*mastodon.Status)
+		}
+		u.idempotent[key] = added
+	}
+	u.posted = append(u.posted, added)
+	u.home = append(u.home, added)
+	s.sendLocked(u, "user", "update", added)
+	writeJSON(w, added)
+}
+
+func (s *Server) getStatus(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	st, ok := s.statuses[mastodon.ID(r.PathValue("id"))]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "Record not found")
+		return
+	}
+	writeJSON(w, st)
+}
+
+func (s *Server) favourite(w http.ResponseWriter, r *http.Request) {
+	s.react(w, r, func(u *user, st *mastodon.Status) {
+		u.favourited = append(u.favourited, st.ID)
+		st.Favourited = true
+		st.FavouritesCount++
+	})
+}
+
+func (s *Server) reblog(w http.ResponseWriter, r *http.Request) {
+	s.react(w, r, func(u *user, st *mastodon.Status) {
+		u.reblogged = append(u.reblogged, st.ID)
+		st.Reblogged = true
+		st.ReblogsCount++
+	})
+}
+
+func (s *Server) react(w http.ResponseWriter, r *http.Request, do func(u *user, st *mastodon.Status)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.statuses[mastodon.ID(r.PathValue("id"))]
+	if !ok {
+		writeError(w, http.StatusNotFound, "Record not found")
+		return
+	}
+	do(s.userOf(r), st)
+	writeJSON(w, st)
+}
+
+func (s *Server) uploadMedia(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	s.mu.Lock()
+	id := s.newIDLocked()
+	s.mu.Unlock()
+	writeJSON(w, mastodon.Attachment{ID: id, Type: "image", URL: fmt.Sprintf("%s/media/%s", s.URL, id)})
+}
+
+func (s *Server) getNotifications(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userOf(r)
+	ids := make([]mastodon.ID, len(u.notifications))
+	for i, n := range u.notifications {
+		ids[i] = n.ID
+	}
+	ns := make([]*mastodon.Notification, 0)
+	for _, i := range paginate(r, ids) {
+		ns = append(ns, u.notifications[i])
+	}
+	writeJSON(w, ns)
+}
+
+func (s *Server) dismissNotification(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userOf(r)
+	id := mastodon.ID(r.PathValue("id"))
+	for i, n := range u.notifications {
+		if n.ID == id {
+			u.notifications = append(u.notifications[:i], u.notifications[i+1:]...)
+			break
+		}
+	}
+	u.dismissed = append(u.dismissed, id)
+	writeJSON(w, struct{}{})
+}
+
+func (s *Server) homeTimeline(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := s.userOf(r)
+	ids := make([]mastodon.ID, len(u.home))
+	for i, st := range u.home {
+		ids[i] = st.ID
+	}
+	sts := make([]*mastodon.Status, 0)
+	for _, i := range paginate(r, ids) {
+		sts = append(sts, u.home[i])
+	}
+	writeJSON(w, sts)
+}
+
+// paginate は、古い順に並んだidsのうち、リクエストの max_id・since_id・min_id・limit に合うものの添字を、新しい順に返す。
+// min_id を指定すると、min_id の直後からlimit件を返す。
+func paginate(r *http.Request, ids []mastodon.ID) (idx []int) {
+	maxID, sinceID, minID := mastodon.ID(r.Form.Get("max_id")), mastodon.ID(r.Form.Get("since_id")), mastodon.ID(r.Form.Get("min_id"))
+	limit, err := strconv.Atoi(r.Form.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 20
+	}
+	var match []int
+	for i, id := range ids {
+		if maxID != "" && !newer(maxID, id) {
+			continue
+		}
+		if sinceID != "" && !newer(id, sinceID) {
+			continue
+		}
+		if minID != "" && !newer(id, minID) {
+			continue
+		}
+		match = append(match, i)
+	}
+	if minID != "" && len(match) > limit {
+		match = match[:limit]
+	}
+	for i := len(match) - 1; i >= 0 && len(idx) < limit; i-- {
+		idx = append(idx, match[i])
+	}
+	return
+}
+
+func (s *Server) publicTimeline(w http.ResponseWriter, r *http.Request) {
+	local := r.Form.Get("local") == "true"
+	s.writeTimeline(w, r, func(st *mastodon.Status) bool { return !local || isLocal(st) })
+}
+
+func (s *Server) tagTimeline(w http.ResponseWriter, r *http.Request) {
+	tag, local := r.PathValue("tag"), r.Form.Get("local") == "true"
+	s.writeTimeline(w, r, func(st *mastodon.Status) bool { return tagged(st, tag) && (!local || isLocal(st)) })
+}
+
+func (s *Server) getLists(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lists := make([]mastodon.List, 0)
+	for _, l := range s.userOf(r).lists {
+		lists = append(lists, l.List)
+	}
+	writeJSON(w, lists)
+}
+
+func (s *Server) listTimeline(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	l := s.userOf(r).list(mastodon.ID(r.PathValue("id")))
+	s.mu.Unlock()
+	if l == nil {
+		writeError(w, http.StatusNotFound, "Record not found")
+		return
+	}
+	s.writeTimeline(w, r, func(st *mastodon.Status) bool { return l.members[st.Account.ID] })
+}
+
+// writeTimeline は、連合タイムラインのうちmatchに合うステータスを、ページ分けして新しい順に返す
+func (s *Server) writeTimeline(w http.ResponseWriter, r *http.Request, match func(st *mastodon.Status) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var matched []*mastodon.Status
+	var ids []mastodon.ID
+	for _, st := range s.public {
+		if match(st) {
+			matched = append(matched, st)
+			ids = append(ids, st.ID)
+		}
+	}
+	sts := make([]*mastodon.Status, 0)
+	for _, i := range paginate(r, ids) {
+		sts = append(sts, matched[i])
+	}
+	writeJSON(w, sts)
+}
+
+// list は、IDがidのリストを返す。なければnil。
+func (u *user) list(id mastodon.ID) *list {
+	for _, l := range u.lists {
+		if l.ID == id {
+			return l
+		}
+	}
+	return nil
+}
+
+// receives は、ストリーミングの接続stに、連合タイムラインに載ったステータスを流すかどうかを返す
+func (u *user) receives(st *stream, status *mastodon.Status) bool {
+	switch st.name {
+	case "public":
+		return true
+	case "public:local":
+		return isLocal(status)
+	case "hashtag":
+		return tagged(status, st.tag)
+	case "hashtag:local":
+		return tagged(status, st.tag) && isLocal(status)
+	case "list":
+		l := u.list(mastodon.ID(st.tag))
+		return l != nil && l.members[status.Account.ID]
+	}
+	return false
+}
+
+// isLocal は、このサーバのアカウントの投稿かどうかを返す
+func isLocal(st *mastodon.Status) bool {
+	return !strings.Contains(st.Account.Acct, "@")
+}
+
+// tagged は、ステータスにハッシュタグtagがついているかを返す
+func tagged(st *mastodon.Status, tag string) bool {
+	for _, t := range st.Tags {
+		if strings.EqualFold(t.Name, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// newer は、採番されたIDでaがbより新しいかを返す
+func newer(a, b mastodon.ID) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+func (s *Server) streaming(w http.ResponseWriter, r *http.Request) {
+	name := r.Form.Get("stream")
+	if name == "" {
+		name = "user"
+	}
+	tag := r.Form.Get("tag")
+	if tag == "" {
+		tag = r.Form.Get("list")
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	st := s.openStream(r, name, tag)
+	defer s.closeStream(r, st)
+
+	// クライアントが切断したらdoneを閉じる
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case ev := <-st.ch:
+			if err := conn.WriteJSON(ev); err != nil {
+				return
+			}
+		case <-st.done:
+			return
+		case <-gone:
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// eventStream は、Server-Sent Events のストリーミング（/api/v1/streaming/user など）
+func (s *Server) eventStream(w http.ResponseWriter, r *http.Request) {
+	name := strings.ReplaceAll(r.PathValue("kind"), "/", ":")
+	tag := r.Form.Get("tag")
+	if name == "list" {
+		tag = r.Form.Get("list")
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming unsupported")
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	st := s.openStream(r, name, tag)
+	defer s.closeStream(r, st)
+	for {
+		select {
+		case ev := <-st.ch:
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, ev.Payload); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-st.done:
+			return
+		case <-r.Context().Done():
+			return
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// openStream は、リクエストのユーザのストリーミング接続を登録する
+func (s *Server) openStream(r *http.Request, name, tag string) *stream {
+	st := &stream{name: name, tag: tag, ch: make(chan mastodon.Stream, 64), done: make(chan struct{})}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.userOf(r).streams[st] = true
+	return st
+}
+
+// closeStream は、ストリーミング接続の登録を外す
+func (s *Server) closeStream(r *http.Request, st *stream) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.userOf(r).streams, st)
+}
+
+func (s *Server) registerApp(w http.ResponseWriter, r *http.Request) {
+	redirect := r.Form.Get("redirect_uris")
+	if r.Form.Get("client_name") == "" || redirect == "" {
+		writeError(w, http.StatusUnprocessableEntity, "Validation failed")
+		return
+	}
+	s.mu.Lock()
+	id := s.newIDLocked()
+	clientID, secret := "client-"+string(id), "secret-"+string(id)
+	s.apps[clientID] = secret
+	s.mu.Unlock()
+	writeJSON(w, mastodon.Application{ID: id, RedirectURI: redirect, ClientID: clientID, ClientSecret: secret})
+}
+
+// authorize は、承認画面の代わりに、登録されている全アカウントの認可コードを表示する
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.apps[r.Form.Get("client_id")]; !ok {
+		writeError(w, http.StatusUnauthorized, "Client authentication failed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "偽のMastodonサーバです。承認するアカウントの認可コードを使ってください。")
+	for token, u := range s.users {
+		fmt.Fprintf(w, "%s: %s\n", u.account.Username, s.issueCodeLocked(token))
+	}
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if secret, ok := s.apps[r.Form.Get("client_id")]; !ok || secret != r.Form.Get("client_secret") {
+		writeError(w, http.StatusUnauthorized, "Client authentication failed")
+		return
+	}
+	code := r.Form.Get("code")
+	token, ok := s.codes[code]
+	if r.Form.Get("grant_type") != "authorization_code" || !ok {
+		writeError(w, http.StatusBadRequest, "The provided authorization grant is invalid")
+		return
+	}
+	delete(s.codes, code)
+	writeJSON(w, map[string]string{"access_token": token, "token_type": "Bearer", "scope": r.Form.Get("scope")})
+}
@@ -2,6 +2,8 @@ package mastobots
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"regexp"
@@ -12,68 +14,141 @@ import (
 	mastodon "github.com/hanage999/go-mastodon"
 )
 
-// moitorは、websocketでタイムラインを監視して反応する。
-func (bot *Persona) monitor(ctx context.Context) {
+const (
+	// streamBackoffMin は、ストリーミングが切れてから最初に再接続するまでの待ち時間。続けて切れるたびに倍にする。
+	streamBackoffMin = 2 * time.Second
+	// streamBackoffMax は、再接続するまでの待ち時間の上限
+	streamBackoffMax = 5 * time.Minute
+	// streamBackoffReset より長くつながっていた接続が切れたら、待ち時間を最初に戻す
+	streamBackoffReset = time.Minute
+)
+
+// moitorは、タイムラインtlを監視して反応する。
+// 接続が切れたら待ち時間を延ばしながら再接続し、切れていた間のステータスと通知を取り戻す。
+// 何も受け取れないまま続けて切れたら、WebSocket→SSE→ポーリングの順に受け取り方を切り替える。
+func (bot *Persona) monitor(ctx context.Context, tl Timeline) {
 	log.Printf("trace: Goroutines: %d", runtime.NumGoroutine())
-	log.Printf("info: %s がタイムライン監視を開始しました", bot.Name)
+	log.Printf("info: %s が%sの監視を開始しました", bot.Name, tl.name())
 	newCtx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	evch, err := bot.openStreaming(newCtx)
+
+	tl, err := bot.resolveList(newCtx, tl)
 	if err != nil {
-		log.Printf("info: %s がストリーミングを受信開始できませんでした", bot.Name)
+		log.Printf("info: %s が%sを監視できないので、今日の監視を諦めます：%s", bot.Name, tl.name(), err)
 		return
 	}
 
-	ers := ""
+	var cur streamCursor
+	bot.seedCursor(newCtx, tl, &cur)
+	mode := bot.streamMode()
+	backoff, failures := streamBackoffMin, 0
+	var fellBack time.Time
+	for {
+		if mode == modePoll {
+			// ポーリングに切り替えてからstreamRetryAfterが経ったら、設定した受け取り方をもう一度試す
+			if mode != bot.streamMode() && bot.clock().Now().Sub(fellBack) >= streamRetryAfter {
+				log.Printf("info: %s の%sを、もう一度%sで受け取ってみます", bot.Name, tl.name(), bot.streamMode())
+				mode = bot.streamMode()
+				backoff, failures = streamBackoffMin, 0
+				continue
+			}
+			// 起点が分からないと取り戻せないので、分かるまで取得し直す
+			if !cur.seeded(tl) {
+				bot.seedCursor(newCtx, tl, &cur)
+			}
+			if err := bot.catchUp(newCtx, tl, &cur); permanent(err) {
+				log.Printf("info: %s が%sを取得できないので、今日の監視を諦めます：%s", bot.Name, tl.name(), err)
+				return
+			}
+			if sleepContext(ctx, bot.clock(), pollInterval) != nil {
+				log.Printf("info: %s が今日の%sの監視を終了しました：%s", bot.Name, tl.name(), ctx.Err())
+				return
+			}
+			continue
+		}
+
+		start := bot.clock().Now()
+		received, ers := bot.stream(newCtx, tl, &cur, mode)
+		if ctx.Err() != nil {
+			log.Printf("info: %s が今日の%sの監視を終了しました：%s", bot.Name, tl.name(), ctx.Err())
+			return
+		}
+		lasted := bot.clock().Now().Sub(start) > streamBackoffReset
+		if received || lasted {
+			failures = 0
+		} else if failures++; failures >= streamFallbackAfter {
+			// 切り替えたら、待たずにすぐつなぐ
+			log.Printf("info: %s の%sは%sでは受け取れないので、%sに切り替えます：%s", bot.Name, tl.name(), mode, mode+1, ers)
+			mode++
+			backoff, failures = streamBackoffMin, 0
+			fellBack = bot.clock().Now()
+			continue
+		}
+		if lasted {
+			backoff = streamBackoffMin
+		}
+		d := jitter(backoff)
+		log.Printf("info: %s の%sの接続が切れました。%s後に再接続します：%s", bot.Name, tl.name(), d.Round(time.Millisecond), ers)
+		if sleepContext(ctx, bot.clock(), d) != nil {
+			log.Printf("info: %s が今日の%sの監視を終了しました：%s", bot.Name, tl.name(), ctx.Err())
+			return
+		}
+		if backoff *= 2; backoff > streamBackoffMax {
+			backoff = streamBackoffMax
+		}
+	}
+}
+
+// stream は、タイムラインtlのストリーミングにmodeの方法で接続し、切れていた間のステータスと通知を取り戻してから、切れるまでイベントに反応する。
+// イベントを一つでも受け取ったかどうかと、最後に受け取ったエラーの内容を返す。
+func (bot *Persona) stream(ctx context.Context, tl Timeline, cur *streamCursor, mode streamMode) (received bool, ers string) {
+	evch, err := bot.openStreaming(ctx, tl, mode)
+	if err != nil {
+		log.Printf("info: %s が%sの%s受信を開始できませんでした：%s", bot.Name, tl.name(), mode, err)
+		bot.catchUp(ctx, tl, cur)
+		return false, err.Error()
+	}
+	// 接続してから取り戻すので、その間に届いたものはどちらかで受け取れる。両方で受け取ったものは、curで見分けて一度だけ反応する。
+	bot.catchUp(ctx, tl, cur)
+
 	for ev := range evch {
-		switch t := ev.(type) {
-		case *mastodon.UpdateEvent:
-			go func() {
-				if err := bot.respondToUpdate(newCtx, t); err != nil {
-					log.Printf("info: %s がトゥートに反応できませんでした", bot.Name)
-				}
-			}()
-		case *mastodon.NotificationEvent:
-			go func() {
-				if err := bot.respondToNotification(newCtx, t); err != nil {
-					log.Printf("info: %s が通知に反応できませんでした", bot.Name)
-				}
-			}()
-		case *mastodon.ErrorEvent:
+		if t, ok := ev.(*mastodon.ErrorEvent); ok {
 			ers = t.Error()
 			log.Printf("info: %s がエラーイベントを受信しました：%s", bot.Name, ers)
+			continue
 		}
+		received = true
+		bot.handleEvent(ctx, tl, cur, ev)
 	}
-
-	if ctx.Err() != nil {
-		log.Printf("info: %s が今日のタイムライン監視を終了しました：%s", bot.Name, ctx.Err())
-	} else {
-		itvl := rand.Intn(4000) + 1000
-		log.Printf("info: %s の接続が切れました。%dミリ秒後に再接続します：%s", bot.Name, itvl, ers)
-		time.Sleep(time.Duration(itvl) * time.Millisecond)
-		go bot.monitor(ctx)
-	}
+	return
 }
 
-// openStreamingは、HTLのストリーミング接続を開始する。失敗したらmaxRetryを上限に再試行する。
-func (bot *Persona) openStreaming(ctx context.Context) (evch chan mastodon.Event, err error) {
-	wsc := bot.Client.NewWSClient()
-	for i := 0; i < bot.commonSettings.maxRetry; i++ {
-		evch, err = wsc.StreamingWSUser(ctx)
-		if err == nil {
-			log.Printf("trace: %s のストリーミング受信に成功しました", bot.Name)
+// handleEvent は、タイムラインtlのイベントに反応する。既に反応したステータスや通知なら何もしない。
+func (bot *Persona) handleEvent(ctx context.Context, tl Timeline, cur *streamCursor, ev mastodon.Event) {
+	switch t := ev.(type) {
+	case *mastodon.UpdateEvent:
+		if tl.notificationsOnly || !cur.seeStatus(t.Status.ID) {
 			return
 		}
-		log.Printf("info: %s のストリーミング受信が開始できません：%s", bot.Name, err)
-		time.Sleep(bot.commonSettings.retryInterval)
+		bot.goSafe("respondToUpdate", func() {
+			if err := bot.respondToUpdate(ctx, tl, t); err != nil {
+				log.Printf("info: %s がトゥートに反応できませんでした", bot.Name)
+			}
+		})
+	case *mastodon.NotificationEvent:
+		if !cur.seeNotification(t.Notification.ID) {
+			return
+		}
+		bot.goSafe("respondToNotification", func() {
+			if err := bot.respondToNotification(ctx, t); err != nil {
+				log.Printf("info: %s が通知に反応できませんでした", bot.Name)
+			}
+		})
 	}
-
-	log.Printf("info: %s のストリーミング受信開始がリトライ上限に達しました：%s", bot.Name, err)
-	return
 }
 
-// respondToUpdateは、statusに反応する。
-func (bot *Persona) respondToUpdate(ctx context.Context, ev *mastodon.UpdateEvent) (err error) {
+// respondToUpdateは、タイムラインtlに流れてきたstatusに、tlの反応の仕方と ReactionPolicy に従って反応する。
+func (bot *Persona) respondToUpdate(ctx context.Context, tl Timeline, ev *mastodon.UpdateEvent) (err error) {
 	orig := ev.Status
 	rebl := false
 	if orig.Reblog != nil {
@@ -91,6 +166,11 @@ func (bot *Persona) respondToUpdate(ctx context.Context, ev *mastodon.UpdateEven
 		return
 	}
 
+	// QuietHours の間は、タイムラインに反応しない
+	if bot.ReactionPolicy.quietAt(bot.clock().Now().In(bot.location())) {
+		return
+	}
+
 	// トゥートを形態素解析
 	text := textContent(orig.Content)
 	if text == "" {
@@ -101,22 +181,32 @@ func (bot *Persona) respondToUpdate(ctx context.Context, ev *mastodon.UpdateEven
 		return
 	}
 
-	// キーワードを検知したらふぁぼる。同じ鯖のbotならブースト＋引用コメントする
-	for _, w := range bot.Keywords {
-		if result.contain(w) {
-			if err = bot.fav(ctx, ev.Status.ID); err != nil {
-				log.Printf("info: %s がふぁぼを諦めました", bot.Name)
-			}
-			if !strings.Contains(ev.Status.Account.Acct, "@") && ev.Status.Account.Bot {
+	// キーワードを検知したら、ReactionPolicy で決めた反応をする
+	for _, w := range bot.keywordsFor(tl) {
+		if !result.contain(w) {
+			continue
+		}
+		// 同じステータスが別のタイムラインやブーストで流れてきても、反応するのは一度だけ
+		if !bot.reacted.add(orig.ID) {
+			return
+		}
+		for _, a := range bot.decideReactions(ctx, tl, ev.Status.Account) {
+			switch a {
+			case "fav":
+				if err = bot.fav(ctx, ev.Status.ID); err != nil {
+					log.Printf("info: %s がふぁぼを諦めました", bot.Name)
+				}
+			case "boost":
 				if err = bot.boost(ctx, ev.Status.ID); err != nil {
 					log.Printf("info: %s がブーストを諦めました", bot.Name)
 				}
+			case "quote":
 				if err = bot.quoteComment(ctx, result, orig.URL); err != nil {
 					log.Printf("info: %s が引用＋コメントを諦めました", bot.Name)
 				}
 			}
-			break
 		}
+		break
 	}
 	return
 }
@@ -148,13 +238,15 @@ func (bot *Persona) messageFromParseResult(result parseResult, url string) (msg
 	}
 
 	// コメントの生成
+	comments := bot.comments()
 	idx := 0
-	if len(bot.Comments) > 1 {
-		idx = rand.Intn(len(bot.Comments))
+	if len(comments) > 1 {
+		idx = rand.Intn(len(comments))
 	}
-	msg = bot.Comments[idx]
+	msg = comments[idx]
 	msg = strings.Replace(msg, "_keyword1_", best.surface, -1)
 	msg = strings.Replace(msg, "_topkana1_", best.firstKana, -1)
+	msg = bot.fillCalendar(msg)
 
 	// リンクを追加
 	msg += "\n\n" + url
@@ -166,7 +258,9 @@ func (bot *Persona) messageFromParseResult(result parseResult, url string) (msg
 func (bot *Persona) respondToNotification(ctx context.Context, ev *mastodon.NotificationEvent) (err error) {
 	switch ev.Notification.Type {
 	case "mention":
-		if err = bot.respondToMention(ctx, ev.Notification.Account, ev.Notification.Status); err != nil {
+		// 同じ通知への反応は、送り直しても二重にならないよう、通知のIDから決まる Idempotency-Key で送る
+		mctx := withIdempotencyKey(ctx, deriveIdempotencyKey(bot.Name, "notification", string(ev.Notification.ID)))
+		if err = bot.respondToMention(mctx, ev.Notification.Account, ev.Notification.Status); err != nil && !errors.Is(err, errQueued) {
 			log.Printf("info: %s がメンションに反応できませんでした：%s", bot.Name, err)
 			return
 		}
@@ -184,8 +278,9 @@ func (bot *Persona) respondToNotification(ctx context.Context, ev *mastodon.Noti
 	return
 }
 
-// respondToMentionは、メンションに反応する。
+// respondToMentionは、メンションに反応する。レート制限に近づいても、定期トゥートより先に返信する。
 func (bot *Persona) respondToMention(ctx context.Context, account mastodon.Account, status *mastodon.Status) (err error) {
+	ctx = withPriority(ctx, priorityReply)
 	r := regexp.MustCompile(`:.*:\z`)
 	name := account.DisplayName
 	if r.MatchString(name) {
@@ -221,7 +316,11 @@ func (bot *Persona) respondToMention(ctx context.Context, account mastodon.Accou
 			log.Printf("info: %s が関係取得に失敗しました", bot.Name)
 			return err
 		}
-		if (*rel[0]).Following {
+		if len(rel) == 0 {
+			log.Printf("info: %s が id:%s との関係を確かめられませんでした", bot.Name, string(account.ID))
+			return fmt.Errorf("id:%s との関係が返ってきませんでした", account.ID)
+		}
+		if rel[0].Following {
 			msg = "@" + account.Acct + " " + name + "さんはもうフォローしてるから大丈夫" + bot.Assertion + "よー"
 		} else {
 			if err = bot.follow(ctx, account.ID); err != nil {
@@ -257,7 +356,7 @@ func (bot *Persona) respondToMention(ctx context.Context, account mastodon.Accou
 		if err != nil {
 			return err
 		}
-		placeName, lat, lng, err := getLocDataFromString(bot.commonSettings.yahooClientID, lc)
+		placeName, lat, lng, err := getLocDataFromString(bot.geocoder, lc)
 		unknownmsg := ""
 		botLoc := false
 		if err != nil {
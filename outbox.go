@@ -0,0 +1,246 @@
+package mastobots
+
+import (
+	"context"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// outboxテーブルの書き込みは、送っている途中（sending）・送信待ち（pending）・送れた（done）・諦めた（failed）のいずれか。
+// 送る前に必ずsendingにするので、その場で送っている書き込みを、drainOutboxが同時に送ることはない。
+// 送っている途中でプロセスが止まった書き込みは、次にプロセスを起動してbotを登録する時にpendingに戻して送り直す。
+const (
+	// outboxPoll は、drainOutboxが送信待ちを見に行く間隔
+	outboxPoll = time.Minute
+	// outboxBackoffMin は、送れなかった書き込みを最初に送り直すまでの待ち時間。失敗するたびに倍にする。
+	outboxBackoffMin = time.Minute
+	// outboxBackoffMax は、送り直すまでの待ち時間の上限
+	outboxBackoffMax = time.Hour
+	// outboxGiveUp より前に送信待ちに入った書き込みは、もう送り直さない
+	outboxGiveUp = 24 * time.Hour
+	// outboxBatch は、drainOutboxが一度に送り直す書き込みの数の上限
+	outboxBatch = 20
+)
+
+// errQueued は、書き込みを送れなかったが、送信待ちに残したので後で送り直すことを示す
+var errQueued = errors.New("送信待ちに残したので、後で送り直します")
+
+// outboxAction は、outboxテーブルの送信待ちの書き込みを格納する
+type outboxAction struct {
+	ID       int64
+	Key      string // Idempotency-Key
+	Kind     string // post・favourite・reblog・follow
+	Toot     *mastodon.Toot
+	TargetID mastodon.ID
+	Priority priority
+	Attempts int
+	Created  time.Time
+}
+
+// outboxPayload は、outboxテーブルのpayload列にJSONで保存する、書き込みの中身
+type outboxPayload struct {
+	Toot     *mastodon.Toot `json:",omitempty"`
+	TargetID mastodon.ID    `json:",omitempty"`
+}
+
+// actionNames は、ログに出す書き込みの種類の名前
+var actionNames = map[string]string{
+	"post":      "トゥート",
+	"favourite": "ふぁぼ",
+	"reblog":    "ブースト",
+	"follow":    "フォロー",
+}
+
+type idempotencyKey struct{}
+
+// withIdempotencyKey は、ctxで送る書き込みの Idempotency-Key をkeyにする。同じキーの投稿は、サーバが二重に受け付けない。
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// idempotencyKeyOf は、ctxで送る書き込みの Idempotency-Key を返す
+func idempotencyKeyOf(ctx context.Context) string {
+	key, _ := ctx.Value(idempotencyKey{}).(string)
+	return key
+}
+
+// newIdempotencyKey は、新しい Idempotency-Key を作る
+func newIdempotencyKey() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// deriveIdempotencyKey は、何に応えた書き込みかを表すpartsから、いつも同じ Idempotency-Key を作る。
+// 同じ通知やアイテムに応えた書き込みは、送り直しても二重にならない。
+func deriveIdempotencyKey(parts ...string) string {
+	sum := sha1.Sum([]byte(strings.Join(parts, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// outboxDelay は、attempts回送れなかった書き込みを、次に送り直すまでの待ち時間
+func outboxDelay(attempts int) time.Duration {
+	d := outboxBackoffMin
+	for i := 1; i < attempts && d < outboxBackoffMax; i++ {
+		d *= 2
+	}
+	if d > outboxBackoffMax {
+		d = outboxBackoffMax
+	}
+	return d
+}
+
+// outbox は、書き込みを残しておくデータベースを返す。データベースにつながっていなければfalseを返す。
+func (bot *Persona) outbox() (db DB, ok bool) {
+	if bot.commonSettings == nil || bot.commonSettings.outboxDB.DB == nil {
+		return db, false
+	}
+	return bot.commonSettings.outboxDB, true
+}
+
+// send は、書き込みaを送っている途中としてoutboxテーブルに残してから、maxRetryを上限に送る。
+// 一時的なエラーで送れなければ、送信待ちに残してerrQueuedを返し、drainOutboxが後で送り直す。
+// 送信待ちに残せなければ、残さずに送る。同じ Idempotency-Key の書き込みが既に残っていれば、送らずにその結果を返す。
+// ctxの Idempotency-Key は投稿にはそのまま使い、ふぁぼ・ブースト・フォローには種類をつけて使う。
+func (bot *Persona) send(ctx context.Context, a outboxAction) (st *mastodon.Status, err error) {
+	if a.Key = idempotencyKeyOf(ctx); a.Key == "" {
+		a.Key = newIdempotencyKey()
+	} else if a.Kind != "post" {
+		a.Key += ":" + a.Kind
+	}
+	a.Priority = priorityOf(ctx)
+	a.Created = bot.clock().Now()
+
+	db, durable := bot.outbox()
+	if durable {
+		if a.ID, err = db.enqueueAction(bot, a); err != nil {
+			log.Printf("info: %s が%sを送信待ちに残せなかったので、そのまま送ります：%s", bot.Name, actionNames[a.Kind], err)
+		} else if a.ID == 0 {
+			return bot.existingAction(db, a)
+		}
+		durable = err == nil
+	}
+
+	err = bot.retry(ctx, actionNames[a.Kind], func() (err error) {
+		st, err = bot.deliver(ctx, a)
+		return
+	})
+	if durable && bot.settle(db, a, st, err) {
+		err = fmt.Errorf("%w：%w", errQueued, err)
+	}
+	return
+}
+
+// existingAction は、同じ Idempotency-Key で既に残っている書き込みaの結果を返す。もう一度は送らない。
+// 送れていれば成功、送っている途中か送信待ちならerrQueued、諦めていればエラーを返す。
+func (bot *Persona) existingAction(db DB, a outboxAction) (st *mastodon.Status, err error) {
+	state, resultID, err := db.actionByKey(bot, a.Key)
+	if err != nil {
+		return
+	}
+	log.Printf("trace: %s の%s %s は既に送信待ちにあり、%s です", bot.Name, actionNames[a.Kind], a.Key, state)
+	switch state {
+	case "done":
+		st = &mastodon.Status{ID: mastodon.ID(resultID)}
+	case "failed":
+		err = fmt.Errorf("同じ%sは既に諦めています", actionNames[a.Kind])
+	default:
+		err = fmt.Errorf("%w：同じ%sが既に送信待ちにあります", errQueued, actionNames[a.Kind])
+	}
+	return
+}
+
+// deliver は、書き込みaを一度だけ送る
+func (bot *Persona) deliver(ctx context.Context, a outboxAction) (st *mastodon.Status, err error) {
+	ctx = withIdempotencyKey(withPriority(ctx, a.Priority), a.Key)
+	switch a.Kind {
+	case "post":
+		if a.Toot == nil {
+			return nil, errors.New("投稿の中身がありません")
+		}
+		return bot.Client.PostStatus(ctx, a.Toot)
+	case "favourite":
+		_, err = bot.Client.Favourite(ctx, a.TargetID)
+	case "reblog":
+		_, err = bot.Client.Reblog(ctx, a.TargetID)
+	case "follow":
+		_, err = bot.Client.AccountFollow(ctx, a.TargetID)
+	default:
+		err = fmt.Errorf("%s という書き込みは送れません", a.Kind)
+	}
+	return
+}
+
+// settle は、送った結果を送信待ちに記録する。送り直すことにしたらtrueを返す。
+func (bot *Persona) settle(db DB, a outboxAction, st *mastodon.Status, err error) (requeued bool) {
+	now := bot.clock().Now()
+	switch {
+	case err == nil:
+		resultID := ""
+		if st != nil {
+			resultID = string(st.ID)
+		}
+		db.finishAction(bot, a.ID, "done", resultID, nil)
+	case permanent(err) || now.Sub(a.Created) >= outboxGiveUp:
+		log.Printf("info: %s は%sを諦めました：%s", bot.Name, actionNames[a.Kind], err)
+		db.finishAction(bot, a.ID, "failed", "", err)
+	default:
+		a.Attempts++
+		next := now.Add(outboxDelay(a.Attempts))
+		log.Printf("info: %s の%sを送信待ちに残して、%s に送り直します", bot.Name, actionNames[a.Kind], next.In(bot.location()).Format("15:04"))
+		db.rescheduleAction(bot, a.ID, a.Attempts, next, err)
+		requeued = true
+	}
+	return
+}
+
+// drainOutbox は、送信待ちの書き込みを、outboxPollごとに送り直す。前回止まった時に残っていたものも送る。
+// 送っている途中のまま残った書き込みを送信待ちに戻すのは、botをデータベースに登録する時にOpenDBやconnectBotがする。
+func (bot *Persona) drainOutbox(ctx context.Context) {
+	db, ok := bot.outbox()
+	if !ok {
+		return
+	}
+	tk := bot.clock().NewTicker(outboxPoll)
+	defer tk.Stop()
+	for {
+		bot.flushOutbox(ctx, db)
+		select {
+		case <-tk.Chan():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// flushOutbox は、送り直す時刻になった送信待ちの書き込みを、優先度の高いものから送る。
+// 他で送り始めた書き込みは飛ばす。
+func (bot *Persona) flushOutbox(ctx context.Context, db DB) {
+	actions, err := db.dueActions(bot, bot.clock().Now(), outboxBatch)
+	if err != nil {
+		return
+	}
+	for _, a := range actions {
+		wctx, done, err := bot.begin(ctx)
+		if err != nil {
+			return
+		}
+		if claimed, err := db.claimAction(bot, a.ID); err != nil || !claimed {
+			done()
+			continue
+		}
+		st, err := bot.deliver(wctx, a)
+		done()
+		if !bot.settle(db, a, st, err) && err == nil {
+			log.Printf("info: %s が送信待ちの%sを送りました", bot.Name, actionNames[a.Kind])
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package mastobots
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestOutboxDelay(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{4, 8 * time.Minute},
+		{7, time.Hour},
+		{30, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := outboxDelay(tt.attempts); got != tt.want {
+			t.Errorf("outboxDelay(%d) = %s, want %s", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestSendIsIdempotent(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", nil)
+
+	ctx := withIdempotencyKey(context.Background(), "scheduled-1")
+	first, err := bot.send(ctx, outboxAction{Kind: "post", Toot: &mastodon.Toot{Status: "お知らせ"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := bot.send(ctx, outboxAction{Kind: "post", Toot: &mastodon.Toot{Status: "お知らせ"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID != again.ID || len(srv.Posted("alice")) != 1 {
+		t.Errorf("同じキーで二重に投稿されました：%s、%s、%d 件", first.ID, again.ID, len(srv.Posted("alice")))
+	}
+
+	keys := 0
+	for _, r := range srv.Requests() {
+		if r.Path == "/api/v1/statuses" && r.Header.Get("Idempotency-Key") == "scheduled-1" {
+			keys++
+		}
+	}
+	if keys != 2 {
+		t.Errorf("Idempotency-Key つきの投稿が %d 件、want 2", keys)
+	}
+}
+
+func TestSendWithoutOutbox(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	// 送信待ちに残せなくても、そのまま送る
+	bot.commonSettings.outboxDB = unavailableDB(t)
+
+	st := srv.AddStatus(mastodon.Status{Content: "<p>hello</p>"})
+	if err := bot.fav(context.Background(), st.ID); err != nil {
+		t.Fatal(err)
+	}
+	if fs := srv.Favourited("alice"); len(fs) != 1 || fs[0] != st.ID {
+		t.Errorf("ふぁぼ = %v", fs)
+	}
+	for _, r := range srv.Requests() {
+		if r.Method == "POST" && r.Header.Get("Idempotency-Key") == "" {
+			t.Errorf("%s に Idempotency-Key がありません", r.Path)
+		}
+	}
+}
+
+// outboxRow は、fakeOutboxDriverが覚えているoutboxテーブルの一行
+type outboxRow struct {
+	id, botID       int64
+	key, kind       string
+	payload         string
+	priority        int64
+	attempts        int64
+	next, created   time.Time
+	state, resultID string
+	err             string
+}
+
+// fakeOutboxDriver は、outboxテーブルへの問い合わせだけを、メモリ上の表で真似るデータベースドライバ。
+// 問い合わせはSQLの文面で見分けるので、DB.goの問い合わせを変えたらここも合わせること。
+type fakeOutboxDriver struct {
+	mu     sync.Mutex
+	tables map[string][]*outboxRow
+}
+
+var outboxDriver = &fakeOutboxDriver{tables: make(map[string][]*outboxRow)}
+
+func init() {
+	sql.Register("mastobots-outbox", outboxDriver)
+}
+
+type fakeOutboxConn struct {
+	d    *fakeOutboxDriver
+	name string
+}
+
+type fakeOutboxStmt struct {
+	c     fakeOutboxConn
+	query string
+}
+
+type fakeOutboxResult struct{ id, n int64 }
+
+type fakeOutboxRows struct {
+	cols []string
+	vals [][]driver.Value
+}
+
+func (d *fakeOutboxDriver) Open(name string) (driver.Conn, error) {
+	return fakeOutboxConn{d, name}, nil
+}
+
+func (c fakeOutboxConn) Prepare(query string) (driver.Stmt, error) {
+	return fakeOutboxStmt{c, strings.Join(strings.Fields(query), " ")}, nil
+}
+
+func (fakeOutboxConn) Close() error { return nil }
+
+func (fakeOutboxConn) Begin() (driver.Tx, error) { return nil, errNoDatabase }
+
+func (fakeOutboxStmt) Close() error { return nil }
+
+func (fakeOutboxStmt) NumInput() int { return -1 }
+
+func (s fakeOutboxStmt) Exec(args []driver.Value) (driver.Result, error) {
+	d := s.c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	rows := d.tables[s.c.name]
+	// 条件に合う行を書き換え、書き換えた行の数を返す
+	update := func(match func(r *outboxRow) bool, set func(r *outboxRow)) (driver.Result, error) {
+		n := int64(0)
+		for _, r := range rows {
+			if match(r) {
+				set(r)
+				n++
+			}
+		}
+		return fakeOutboxResult{n: n}, nil
+	}
+	switch {
+	case strings.HasPrefix(s.query, "INSERT IGNORE INTO outbox"):
+		for _, r := range rows {
+			if r.botID == args[0].(int64) && r.key == args[1].(string) {
+				return fakeOutboxResult{}, nil
+			}
+		}
+		r := &outboxRow{
+			id: int64(len(rows) + 1), botID: args[0].(int64), key: args[1].(string), kind: args[2].(string),
+			payload: args[3].(string), priority: args[4].(int64), next: args[5].(time.Time), created: args[6].(time.Time),
+			state: "sending",
+		}
+		d.tables[s.c.name] = append(rows, r)
+		return fakeOutboxResult{id: r.id, n: 1}, nil
+	case strings.HasPrefix(s.query, "UPDATE outbox SET state = 'sending'"):
+		return update(func(r *outboxRow) bool {
+			return r.id == args[1].(int64) && r.botID == args[2].(int64) && r.state == "pending"
+		}, func(r *outboxRow) { r.state = "sending" })
+	case strings.HasPrefix(s.query, "UPDATE outbox SET state = 'pending', next_attempt_at"):
+		return update(func(r *outboxRow) bool {
+			return r.botID == args[2].(int64) && r.state == "sending"
+		}, func(r *outboxRow) { r.state, r.next = "pending", args[0].(time.Time) })
+	case strings.HasPrefix(s.query, "UPDATE outbox SET state = 'pending', attempts"):
+		return update(func(r *outboxRow) bool {
+			return r.id == args[4].(int64) && r.botID == args[5].(int64)
+		}, func(r *outboxRow) {
+			r.state, r.attempts, r.next, r.err = "pending", args[0].(int64), args[1].(time.Time), args[2].(string)
+		})
+	case strings.HasPrefix(s.query, "UPDATE outbox SET state = ?, result_id"):
+		return update(func(r *outboxRow) bool {
+			return r.id == args[4].(int64) && r.botID == args[5].(int64)
+		}, func(r *outboxRow) {
+			r.state, r.resultID, r.err = args[0].(string), args[1].(string), args[2].(string)
+		})
+	}
+	return nil, errNoDatabase
+}
+
+func (s fakeOutboxStmt) Query(args []driver.Value) (driver.Rows, error) {
+	d := s.c.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case strings.HasPrefix(s.query, "SELECT id, idempotency_key, kind, payload, priority, attempts, created_at FROM outbox"):
+		var due []*outboxRow
+		for _, r := range d.tables[s.c.name] {
+			if r.botID == args[0].(int64) && r.state == "pending" && !r.next.After(args[1].(time.Time)) {
+				due = append(due, r)
+			}
+		}
+		sort.SliceStable(due, func(i, j int) bool { return due[i].priority > due[j].priority })
+		if limit := int(args[2].(int64)); len(due) > limit {
+			due = due[:limit]
+		}
+		rs := &fakeOutboxRows{cols: []string{"id", "idempotency_key", "kind", "payload", "priority", "attempts", "created_at"}}
+		for _, r := range due {
+			rs.vals = append(rs.vals, []driver.Value{r.id, r.key, r.kind, r.payload, r.priority, r.attempts, r.created})
+		}
+		return rs, nil
+	case strings.HasPrefix(s.query, "SELECT state, result_id FROM outbox"):
+		rs := &fakeOutboxRows{cols: []string{"state", "result_id"}}
+		for _, r := range d.tables[s.c.name] {
+			if r.botID == args[0].(int64) && r.key == args[1].(string) {
+				rs.vals = append(rs.vals, []driver.Value{r.state, r.resultID})
+			}
+		}
+		return rs, nil
+	}
+	return nil, errNoDatabase
+}
+
+func (r fakeOutboxResult) LastInsertId() (int64, error) { return r.id, nil }
+
+func (r fakeOutboxResult) RowsAffected() (int64, error) { return r.n, nil }
+
+func (rs *fakeOutboxRows) Columns() []string { return rs.cols }
+
+func (*fakeOutboxRows) Close() error { return nil }
+
+func (rs *fakeOutboxRows) Next(dest []driver.Value) error {
+	if len(rs.vals) == 0 {
+		return io.EOF
+	}
+	copy(dest, rs.vals[0])
+	rs.vals = rs.vals[1:]
+	return nil
+}
+
+// outboxDB は、テストごとに空のoutboxテーブルを持つデータベースを返す
+func outboxDB(t *testing.T) DB {
+	t.Helper()
+	dbase, err := sql.Open("mastobots-outbox", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dbase.Close()
+		outboxDriver.mu.Lock()
+		delete(outboxDriver.tables, t.Name())
+		outboxDriver.mu.Unlock()
+	})
+	return DB{dbase}
+}
+
+// outboxRows は、テストのoutboxテーブルの今の中身を返す
+func outboxRows(t *testing.T) (rows []outboxRow) {
+	outboxDriver.mu.Lock()
+	defer outboxDriver.mu.Unlock()
+	for _, r := range outboxDriver.tables[t.Name()] {
+		rows = append(rows, *r)
+	}
+	return
+}
+
+// outboxBot は、送信待ちをoutboxDBに残すbotを準備する
+func outboxBot(t *testing.T, srv *mastotest.Server, clk *fakeClock, db DB) *Persona {
+	t.Helper()
+	return integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.DBID = 1
+		bot.commonSettings.maxRetry = 1
+		bot.commonSettings.outboxDB = db
+	})
+}
+
+func TestOutboxRequeueAndFlushAfterRestart(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := outboxDB(t)
+	bot := outboxBot(t, srv, clk, db)
+
+	// 送れなければ、送信待ちに残してerrQueuedを返す
+	srv.Fail("POST", "/api/v1/statuses", 503, 1)
+	ctx := withIdempotencyKey(context.Background(), "news-1")
+	if _, err := bot.send(ctx, outboxAction{Kind: "post", Toot: &mastodon.Toot{Status: "ニュース"}}); !errors.Is(err, errQueued) {
+		t.Fatalf("send() = %v, want errQueued", err)
+	}
+	rows := outboxRows(t)
+	if len(rows) != 1 || rows[0].state != "pending" || rows[0].attempts != 1 || !rows[0].next.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("送信待ち = %+v", rows)
+	}
+
+	// 送り直す時刻の前には送らない
+	bot.flushOutbox(context.Background(), db)
+	if len(srv.Posted("alice")) != 0 {
+		t.Fatal("送り直す時刻の前に送りました")
+	}
+
+	// 再起動したbotが、同じ Idempotency-Key で送り直す
+	clk.Advance(time.Minute)
+	restarted := outboxBot(t, srv, clk, db)
+	restarted.flushOutbox(context.Background(), db)
+	if sts := srv.Posted("alice"); len(sts) != 1 || textContent(sts[0].Content) != "ニュース" {
+		t.Fatalf("送り直した投稿 = %v", sts)
+	}
+	if rows := outboxRows(t); rows[0].state != "done" || rows[0].resultID != string(srv.Posted("alice")[0].ID) {
+		t.Errorf("送り直した後の送信待ち = %+v", rows[0])
+	}
+	keys := 0
+	for _, r := range srv.Requests() {
+		if r.Path == "/api/v1/statuses" && r.Header.Get("Idempotency-Key") == "news-1" {
+			keys++
+		}
+	}
+	if keys != 2 {
+		t.Errorf("Idempotency-Key つきの投稿が %d 件、want 2", keys)
+	}
+}
+
+func TestOutboxGiveUp(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := outboxDB(t)
+	bot := outboxBot(t, srv, clk, db)
+
+	st := srv.AddStatus(mastodon.Status{Content: "<p>hello</p>"})
+	srv.Fail("POST", "/api/v1/statuses/"+string(st.ID)+"/favourite", 503, 1000)
+	if err := bot.fav(context.Background(), st.ID); !errors.Is(err, errQueued) {
+		t.Fatalf("fav() = %v, want errQueued", err)
+	}
+
+	// outboxGiveUpまでは送り直し続け、過ぎたら諦める
+	for clk.Now().Before(time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)) {
+		clk.Advance(outboxBackoffMax)
+		bot.flushOutbox(context.Background(), db)
+	}
+	rows := outboxRows(t)
+	if len(rows) != 1 || rows[0].state != "failed" || rows[0].err == "" {
+		t.Fatalf("諦めた後の送信待ち = %+v", rows)
+	}
+	attempts := rows[0].attempts
+	clk.Advance(outboxBackoffMax)
+	bot.flushOutbox(context.Background(), db)
+	if rows := outboxRows(t); rows[0].attempts != attempts || rows[0].state != "failed" {
+		t.Errorf("諦めた書き込みを送り直しました：%+v", rows[0])
+	}
+}
+
+func TestOutboxSkipsActionsBeingSent(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := outboxDB(t)
+	bot := outboxBot(t, srv, clk, db)
+
+	// その場で送っている途中の書き込みは、どれだけ時間がかかってもdrainOutboxが送らない
+	a := outboxAction{Key: "slow", Kind: "post", Toot: &mastodon.Toot{Status: "ゆっくり"}, Created: clk.Now()}
+	if _, err := db.enqueueAction(bot, a); err != nil {
+		t.Fatal(err)
+	}
+	clk.Advance(time.Hour)
+	bot.flushOutbox(context.Background(), db)
+	if len(srv.Posted("alice")) != 0 {
+		t.Fatal("送っている途中の書き込みを送りました")
+	}
+
+	// 送っている途中でプロセスが止まったものは、次のプロセスでbotを登録する時に送信待ちに戻す
+	db.releaseActions(bot, clk.Now())
+	bot.flushOutbox(context.Background(), db)
+	if len(srv.Posted("alice")) != 1 || outboxRows(t)[0].state != "done" {
+		t.Errorf("送信待ちに戻した書き込みを送りませんでした：%+v", outboxRows(t))
+	}
+	// 送り始めた書き込みは、二度は送らない
+	if claimed, _ := db.claimAction(bot, 1); claimed {
+		t.Error("送り終えた書き込みをもう一度送り始められます")
+	}
+}
+
+func TestOutboxDuplicateKey(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := outboxDB(t)
+	bot := outboxBot(t, srv, clk, db)
+	st := srv.AddStatus(mastodon.Status{Content: "<p>hello</p>"})
+	posts := func(path string) (n int) {
+		for _, r := range srv.Requests() {
+			if r.Method == "POST" && r.Path == path {
+				n++
+			}
+		}
+		return
+	}
+
+	// 送信待ちにある書き込みは、同じキーでもう一度送らず、errQueuedを返す
+	srv.Fail("POST", "/api/v1/statuses/"+string(st.ID)+"/favourite", 503, 1)
+	ctx := withIdempotencyKey(context.Background(), "notification-1")
+	if err := bot.fav(ctx, st.ID); !errors.Is(err, errQueued) {
+		t.Fatalf("fav() = %v, want errQueued", err)
+	}
+	if err := bot.fav(ctx, st.ID); !errors.Is(err, errQueued) {
+		t.Fatalf("送信待ちと同じキーのfav() = %v, want errQueued", err)
+	}
+	if n := posts("/api/v1/statuses/" + string(st.ID) + "/favourite"); n != 1 {
+		t.Fatalf("ふぁぼを %d 回送りました、want 1", n)
+	}
+
+	// 送れた書き込みは、同じキーなら送らずに、送った結果を返す
+	first, err := bot.postStatus(ctx, mastodon.Toot{Status: "お返事"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := bot.postStatus(ctx, mastodon.Toot{Status: "お返事"})
+	if err != nil || again.ID != first.ID {
+		t.Errorf("送れた投稿と同じキーのpostStatus() = %v, %v, want %s", again, err, first.ID)
+	}
+	if n := posts("/api/v1/statuses"); n != 1 {
+		t.Errorf("投稿を %d 回送りました、want 1", n)
+	}
+
+	// 諦めた書き込みは、同じキーでも送らずにエラーを返す
+	srv.Fail("POST", "/api/v1/accounts/99/follow", 404, 1)
+	if err := bot.follow(ctx, "99"); err == nil || errors.Is(err, errQueued) {
+		t.Fatalf("follow() = %v, want 諦めたエラー", err)
+	}
+	if err := bot.follow(ctx, "99"); err == nil || errors.Is(err, errQueued) {
+		t.Errorf("諦めたのと同じキーのfollow() = %v, want エラー", err)
+	}
+	if n := posts("/api/v1/accounts/99/follow"); n != 1 {
+		t.Errorf("フォローを %d 回送りました、want 1", n)
+	}
+}
+
+func TestTruncateError(t *testing.T) {
+	s := truncateError(errors.New(strings.Repeat("あ", 300)))
+	if n := utf8.RuneCountInString(s); n != 255 || !utf8.ValidString(s) {
+		t.Errorf("truncateError = %d 文字, want 255", n)
+	}
+	if s := truncateError(errors.New("short")); s != "short" {
+		t.Errorf("truncateError = %q", s)
+	}
+}
@@ -2,36 +2,73 @@ package mastobots
 
 import (
 	"context"
+	"errors"
 	"log"
 	"math"
 	"math/rand"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	mastodon "github.com/hanage999/go-mastodon"
 )
 
-// periodicActivityは、指定された時刻（分）を皮切りに一定時間ごとに行う活動。
-func (bot *Persona) periodicActivity(ctx context.Context, db DB) {
-	itvl := time.Duration(bot.Interval) * time.Minute
-
-	// 起動後最初のトゥートまでの待機時間を、Intervalより短くする
-	delay := until(-1, bot.FirstFire, 0)
-	for i := 1; delay > itvl; i++ {
-		m := bot.FirstFire + bot.Interval*i
-		if m >= 60 {
-			m -= 60
+// parseSchedulesは、botの活動ごとのcron形式のスケジュールを解析する。
+func (bot *Persona) parseSchedules() error {
+	var errs ConfigErrors
+	var err error
+	if bot.Schedule != "" {
+		if bot.newsSchedule, err = parseCron(bot.Schedule); err != nil {
+			errs.add(bot.Name, "Schedule", "%s", err)
+		}
+	}
+	if bot.RandomSchedule != "" {
+		if bot.randomSchedule, err = parseCron(bot.RandomSchedule); err != nil {
+			errs.add(bot.Name, "RandomSchedule", "%s", err)
 		}
-		delay = until(-1, m, 0)
 	}
+	return errs.err()
+}
+
+// periodicActivityは、Scheduleに合う時刻ごと、またはScheduleがなければ指定された時刻（分）を皮切りに一定時間ごとに行う活動。
+func (bot *Persona) periodicActivity(ctx context.Context, db DB) {
+	var tc chan string
+	if bot.newsSchedule != nil {
+		loc := bot.location()
+		now := bot.clock().Now().In(loc)
+		bot.newsTicks = bot.newsSchedule.count(now, now.Add(bot.Awake))
+		tc = tickBySchedule(ctx, bot.clock(), bot.newsSchedule, loc, time.Duration(bot.Jitter)*time.Minute)
+	} else {
+		itvl := time.Duration(bot.Interval) * time.Minute
+
+		// 起動後最初のトゥートまでの待機時間を、Intervalより短くする
+		now := bot.clock().Now().In(bot.location())
+		delay := until(now, -1, bot.FirstFire, 0)
+		for i := 1; delay > itvl; i++ {
+			m := bot.FirstFire + bot.Interval*i
+			if m >= 60 {
+				m -= 60
+			}
+			delay = until(now, -1, m, 0)
+		}
 
-	tc := tickAfterWait(ctx, delay, itvl)
+		if itvl > 0 {
+			bot.newsTicks = int(bot.Awake / itvl)
+		}
+		tc = tickAfterWait(ctx, bot.clock(), delay, itvl)
+	}
 	log.Printf("info: %s が今日の定期トゥートを開始しました", bot.Name)
 
 	for str := range tc {
 		log.Printf("trace: %s", str)
-		go func() {
+		bot.goSafe("stockAndToot", func() {
+			// ネタの仕入れとトゥートは、シャットダウンが始まったり寝る時刻になったりしても最後まで済ませる
+			wctx, done, err := bot.begin(ctx)
+			if err != nil {
+				return
+			}
+			defer done()
 			if err := db.deleteOldCandidates(bot); err != nil {
 				log.Printf("info :%s が古いトゥート候補の削除に失敗しました", bot.Name)
 				return
@@ -41,22 +78,26 @@ func (bot *Persona) periodicActivity(ctx context.Context, db DB) {
 				log.Printf("info: %s がアイテムの収集に失敗しました", bot.Name)
 				return
 			}
-			if err := bot.newsToot(ctx, stock, db); err != nil {
+			if err := bot.newsToot(wctx, stock, db); err != nil {
 				log.Printf("info: %s がニューストゥートに失敗しました", bot.Name)
 			}
-		}()
+		})
 	}
 
 	log.Printf("info: %s が今日の定期トゥートを終了しました", bot.Name)
 }
 
-// newsTootはストックしたRSSアイテムをネタにトゥートする
+// newsTootはストックしたRSSアイテムをネタにトゥートする。レート制限に近づいたら、返信に譲って後回しにする。
 func (bot *Persona) newsToot(ctx context.Context, stock int, db DB) (err error) {
 	if stock == 0 {
 		return
 	}
+	ctx = withPriority(ctx, priorityNews)
 
-	tf := float64(bot.Awake) / float64(time.Duration(bot.Interval)*time.Minute)
+	tf := float64(bot.newsTicks)
+	if tf < 1 {
+		tf = 1
+	}
 	bst := 1
 	if stock > 10 {
 		bst = 2
@@ -73,8 +114,14 @@ func (bot *Persona) newsToot(ctx context.Context, stock int, db DB) (err error)
 			return err
 		}
 		if item.Title != "" {
-			if err = bot.post(ctx, toot); err != nil {
+			// 同じアイテムのトゥートは、送り直しても二重にならないよう、アイテムのIDから決まる Idempotency-Key で送る。
+			// 送信待ちに残したトゥートは後で送られるので、アイテムは使ったことにする
+			ictx := withIdempotencyKey(ctx, deriveIdempotencyKey(bot.Name, "item", strconv.Itoa(item.ID)))
+			if err = bot.post(ictx, toot); err != nil && !errors.Is(err, errQueued) {
 				log.Printf("info: %s がトゥートできませんでした。今回は諦めます……", bot.Name)
+			} else if bot.DryRun {
+				log.Printf("trace: %s はdry-runなので、アイテムid %d を残し、使ったことだけ覚えておきます", bot.Name, item.ID)
+				bot.dryRunFired.Store(dryRunItemKey(item.ID), true)
 			} else {
 				if err = db.deleteItem(bot, item); err != nil {
 					log.Printf("info: %s がトゥート済みアイテムの削除に失敗しました", bot.Name)
@@ -147,29 +194,36 @@ func (bot *Persona) messageFromItem(item Item) (msg string, lang string, err err
 
 	// ハッシュタグ生成
 	var hashtagStr string
-	for _, t := range bot.Hashtags {
+	for _, t := range bot.hashtags() {
 		hashtagStr += `#` + t + " "
 	}
 	hashtagStr = strings.TrimSpace(hashtagStr)
 
 	// コメントの生成
 	if noword {
-		idx := rand.Intn(len(bot.RandomToots))
-		msg = bot.RandomToots[idx]
+		randomToots := bot.randomToots()
+		if len(randomToots) == 0 {
+			log.Printf("info: %s にはランダムな投稿文もありません", bot.Name)
+			return
+		}
+		idx := rand.Intn(len(randomToots))
+		msg = randomToots[idx]
 		if msg == "" {
 			log.Printf("info: %s がランダムな投稿文の作成にも失敗しました", bot.Name)
 			return
 		}
-		msg = msg + nuance()
+		msg = bot.fillCalendar(msg) + nuance()
 		err = nil
 	} else {
+		comments := bot.comments()
 		idx := 0
-		if len(bot.Comments) > 1 {
-			idx = rand.Intn(len(bot.Comments))
+		if len(comments) > 1 {
+			idx = rand.Intn(len(comments))
 		}
-		msg = bot.Comments[idx]
+		msg = comments[idx]
 		msg = strings.Replace(msg, "_keyword1_", best.surface, -1)
 		msg = strings.Replace(msg, "_topkana1_", best.firstKana, -1)
+		msg = bot.fillCalendar(msg)
 
 		// 投稿言語の設定
 		switch result.(type) {
@@ -9,32 +9,48 @@ import (
 	mastodon "github.com/hanage999/go-mastodon"
 )
 
-// randomTootは、ランダムにトゥートする。
+// randomTootは、ランダムにトゥートする。RandomScheduleがあれば、それに合う時刻にトゥートする。
 func (bot *Persona) randomToot(ctx context.Context) {
+	if bot.randomSchedule != nil {
+		tc := tickBySchedule(ctx, bot.clock(), bot.randomSchedule, bot.location(), time.Duration(bot.Jitter)*time.Minute)
+		for range tc {
+			bot.tootRandomly(ctx)
+		}
+		return
+	}
+
 	bt := 24 * 60 / bot.RandomFrequency
 	ft := bt - bt*2/3 + rand.Intn(bt*4/3)
 	itvl := time.Duration(ft) * time.Minute
 
-	t := time.NewTimer(itvl)
+	t := bot.clock().NewTimer(itvl)
 	defer t.Stop()
 
 	select {
-	case <-t.C:
-		idx := rand.Intn(len(bot.RandomToots))
-		msg := bot.RandomToots[idx]
-		if msg != "" {
-			msg = msg + nuance()
-			toot := mastodon.Toot{Status: msg}
-			if err := bot.post(ctx, toot); err != nil {
-				log.Printf("info: %s がランダムな呟きに失敗しました", bot.Name)
-			}
-		}
-
+	case <-t.Chan():
+		bot.tootRandomly(ctx)
 		bot.randomToot(ctx)
 	case <-ctx.Done():
 	}
 }
 
+// tootRandomlyは、RandomTootsから一つ選んでトゥートする。レート制限に近づいたら、返信に譲って後回しにする。
+func (bot *Persona) tootRandomly(ctx context.Context) {
+	ctx = withPriority(ctx, priorityNews)
+	randomToots := bot.randomToots()
+	if len(randomToots) == 0 {
+		return
+	}
+	msg := randomToots[rand.Intn(len(randomToots))]
+	if msg != "" {
+		msg = bot.fillCalendar(msg) + nuance()
+		toot := mastodon.Toot{Status: msg}
+		if err := bot.post(ctx, toot); err != nil {
+			log.Printf("info: %s がランダムな呟きに失敗しました", bot.Name)
+		}
+	}
+}
+
 // nuance は、投稿にニュアンスを添えたり添えなかったりする。
 func nuance() (s string) {
 	gb := [...]string{"", "？", "?!", "!?", "！", "！！", "！！！", "！！！！", "！！！！！", "…", "……", "………", "w", "www", "…？", "…！", "…?!", "…?!", "…w", "……w", "………w"}
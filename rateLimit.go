@@ -0,0 +1,250 @@
+package mastobots
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// priority は、リクエストの優先度。レート制限に近づいたら、優先度の高いものから送る。
+type priority int
+
+const (
+	// priorityNews は、定期トゥートやランダムトゥートなど、遅れても困らない投稿
+	priorityNews priority = -1
+	// priorityNormal は、ふぁぼ・ブースト・フォロー・通知削除など、特に指定のないリクエスト
+	priorityNormal priority = 0
+	// priorityReply は、メンションへの返信とそれに伴うリクエスト
+	priorityReply priority = 1
+)
+
+// newsReserve は、残り回数がこれ以下になったら、priorityNews のリクエストを制限が戻るまで待たせる（返信のために取っておく）
+const newsReserve = 10
+
+// blockWithoutReset は、429を受けたのに X-RateLimit-Reset がない時に待つ時間
+const blockWithoutReset = time.Minute
+
+type priorityKey struct{}
+
+// withPriority は、ctxで送るリクエストの優先度をpにする
+func withPriority(ctx context.Context, p priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// priorityOf は、ctxで送るリクエストの優先度を返す
+func priorityOf(ctx context.Context) priority {
+	if p, ok := ctx.Value(priorityKey{}).(priority); ok {
+		return p
+	}
+	return priorityNormal
+}
+
+// reserve は、優先度pのリクエストのために残しておかなくてよい回数の下限
+func (p priority) reserve() int {
+	if p < priorityNormal {
+		return newsReserve
+	}
+	return 0
+}
+
+// rateLimiter は、サーバが X-RateLimit-Remaining・X-RateLimit-Reset で知らせる残り回数に従って、リクエストを順番待ちさせる
+type rateLimiter struct {
+	mu        sync.Mutex
+	name      string
+	clk       Clock
+	remaining int       // 残り回数。分からなければ-1
+	reset     time.Time // 残り回数が戻る時刻
+	blocked   time.Time // 429を受けて、この時刻まで送らない
+	waiting   map[priority]int
+	changed   chan struct{}
+}
+
+func newRateLimiter(name string, clk Clock) *rateLimiter {
+	return &rateLimiter{name: name, clk: clk, remaining: -1, waiting: make(map[priority]int), changed: make(chan struct{})}
+}
+
+// acquire は、優先度pのリクエストを一つ送ってよくなるまで待つ。優先度の高いリクエストが待っていれば、先に通す。
+func (l *rateLimiter) acquire(ctx context.Context, p priority) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	queued := false
+	defer func() {
+		if queued {
+			l.waiting[p]--
+			l.notifyLocked()
+		}
+	}()
+
+	for {
+		now := l.clk.Now()
+		if l.remaining >= 0 && !now.Before(l.reset) {
+			l.remaining = -1
+		}
+		var until time.Time
+		switch {
+		case now.Before(l.blocked):
+			until = l.blocked
+		case l.remaining >= 0 && l.remaining <= p.reserve():
+			until = l.reset
+		case l.higherWaitingLocked(p):
+		default:
+			if l.remaining > 0 {
+				l.remaining--
+			}
+			return nil
+		}
+
+		if !queued {
+			l.waiting[p]++
+			queued = true
+		}
+		changed := l.changed
+		l.mu.Unlock()
+		var timer Timer
+		var fired <-chan time.Time
+		if !until.IsZero() {
+			timer = l.clk.NewTimer(until.Sub(now))
+			fired = timer.Chan()
+		}
+		select {
+		case <-fired:
+		case <-changed:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		l.mu.Lock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// higherWaitingLocked は、優先度pより高いリクエストが待っていればtrueを返す
+func (l *rateLimiter) higherWaitingLocked(p priority) bool {
+	for q, n := range l.waiting {
+		if q > p && n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// notifyLocked は、待っているリクエストに、状況が変わったことを知らせる
+func (l *rateLimiter) notifyLocked() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// update は、応答のヘッダから残り回数と戻る時刻を読み取る。429なら、戻る時刻まで全てのリクエストを止める。
+func (l *rateLimiter) update(h http.Header, status int) {
+	rem, rerr := strconv.Atoi(h.Get("X-RateLimit-Remaining"))
+	reset, terr := time.Parse(time.RFC3339, h.Get("X-RateLimit-Reset"))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rerr == nil && terr == nil {
+		l.remaining, l.reset = rem, reset
+	}
+	if status == http.StatusTooManyRequests {
+		if terr != nil {
+			reset = l.clk.Now().Add(blockWithoutReset)
+		}
+		l.blockLocked(reset)
+	}
+	l.notifyLocked()
+}
+
+// block は、untilまで全てのリクエストを止める
+func (l *rateLimiter) block(until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.blockLocked(until)
+	l.notifyLocked()
+}
+
+// blockedUntil は、429を受けてリクエストを止めている期限を返す
+func (l *rateLimiter) blockedUntil() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.blocked
+}
+
+func (l *rateLimiter) blockLocked(until time.Time) {
+	if until.After(l.blocked) {
+		l.blocked = until
+		log.Printf("info: %s がレート制限に達したので、%s まで待ちます", l.name, until.Local().Format("15:04:05"))
+	}
+}
+
+// rateLimiters は、サーバごと・アカウントごとのrateLimiterを、botたちで共有する
+type rateLimiters struct {
+	mu sync.Mutex
+	m  map[string]*rateLimiter
+}
+
+// get は、keyのrateLimiterを返す。なければ作る。
+func (rs *rateLimiters) get(key, name string, clk Clock) *rateLimiter {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.m == nil {
+		rs.m = make(map[string]*rateLimiter)
+	}
+	l, ok := rs.m[key]
+	if !ok {
+		l = newRateLimiter(name, clk)
+		rs.m[key] = l
+	}
+	return l
+}
+
+// rateLimitedTransport は、botのリクエストを、サーバとアカウントのレート制限に従って送る。
+// 書き込みに Idempotency-Key が決まっていれば、ヘッダにつける。
+type rateLimitedTransport struct {
+	base     http.RoundTripper
+	instance *rateLimiter // 同じサーバのbotたち全員で共有する（IPアドレスごとの制限）
+	account  *rateLimiter // botのアカウントごとの制限
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	ctx := req.Context()
+	p := priorityOf(ctx)
+	if err = t.instance.acquire(ctx, p); err != nil {
+		return
+	}
+	if err = t.account.acquire(ctx, p); err != nil {
+		return
+	}
+	if key := idempotencyKeyOf(ctx); key != "" && req.Method == http.MethodPost {
+		req = req.Clone(ctx)
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if resp, err = t.base.RoundTrip(req); err != nil {
+		return
+	}
+	t.account.update(resp.Header, resp.StatusCode)
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// アカウントの制限かIPアドレスごとの制限かは見分けられないので、同じサーバのbotたち全員で待つ
+		t.instance.block(t.account.blockedUntil())
+	}
+	return
+}
+
+// transport は、botのMastodonサーバへのリクエストを、レート制限に従って送るRoundTripperを返す
+func (bot *Persona) transport() http.RoundTripper {
+	if bot.commonSettings == nil {
+		return http.DefaultTransport
+	}
+	instance := strings.TrimSuffix(bot.Instance, "/")
+	return &rateLimitedTransport{
+		base:     http.DefaultTransport,
+		instance: bot.commonSettings.limiters.get(instance, instance, bot.clock()),
+		account:  bot.commonSettings.limiters.get(instance+" "+bot.AccessToken, bot.Name, bot.clock()),
+	}
+}
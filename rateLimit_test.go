@@ -0,0 +1,135 @@
+package mastobots
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func rateLimitHeader(remaining int, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	h.Set("X-RateLimit-Reset", reset.UTC().Format(time.RFC3339Nano))
+	return h
+}
+
+// acquired は、acquireが別のgoroutineで終わったら閉じるチャネルを返す
+func acquired(l *rateLimiter, p priority) <-chan struct{} {
+	ch := make(chan struct{})
+	go func() {
+		l.acquire(context.Background(), p)
+		close(ch)
+	}()
+	return ch
+}
+
+func TestRateLimiterKeepsReserveForReplies(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	l := newRateLimiter("alice", clk)
+	l.update(rateLimitHeader(newsReserve, clk.Now().Add(5*time.Minute)), http.StatusOK)
+
+	news := acquired(l, priorityNews)
+	select {
+	case <-news:
+		t.Fatal("残り回数が少ないのに、定期トゥートが待たされません")
+	case <-time.After(20 * time.Millisecond):
+	}
+	select {
+	case <-acquired(l, priorityReply):
+	case <-time.After(5 * time.Second):
+		t.Fatal("返信が待たされました")
+	}
+
+	clk.waitForTimers(t, 1)
+	clk.Advance(5 * time.Minute)
+	select {
+	case <-news:
+	case <-time.After(5 * time.Second):
+		t.Fatal("制限が戻っても定期トゥートが送られません")
+	}
+}
+
+func TestRateLimiterBlocksOn429(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	l := newRateLimiter("alice", clk)
+	l.update(rateLimitHeader(0, clk.Now().Add(time.Minute)), http.StatusTooManyRequests)
+
+	reply := acquired(l, priorityReply)
+	select {
+	case <-reply:
+		t.Fatal("429の後なのに、待たずに送られました")
+	case <-time.After(20 * time.Millisecond):
+	}
+	clk.waitForTimers(t, 1)
+	clk.Advance(time.Minute)
+	select {
+	case <-reply:
+	case <-time.After(5 * time.Second):
+		t.Fatal("制限が戻っても送られません")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	l.block(clk.Now().Add(time.Hour))
+	cancel()
+	if err := l.acquire(ctx, priorityNormal); err == nil {
+		t.Error("キャンセルしたのに acquire() = nil")
+	}
+}
+
+func TestIntegrationRateLimit(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	// 同じサーバのbobも、aliceが429を受けたら待つ
+	bob := integrationBot(t, srv, clk, "bob", nil)
+	bob.commonSettings = bot.commonSettings
+	if err := bob.verifyCredentials(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetRateLimit("alice", 0, clk.Now().Add(time.Minute))
+
+	ctx := context.Background()
+	done := make(chan error, 2)
+	go func() {
+		_, err := bot.Client.PostStatus(ctx, &mastodon.Toot{Status: "制限中"})
+		done <- err
+	}()
+	if !srv.WaitFor(5*time.Second, func() bool { return bot.commonSettings.limiters.get(srv.URL, "", clk).blockedUntil().After(clk.Now()) }) {
+		t.Fatal("429を受けても待ちません")
+	}
+	go func() {
+		_, err := bob.Client.PostStatus(ctx, &mastodon.Toot{Status: "bobです"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("制限が戻る前に送られました：%v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	srv.SetRateLimit("alice", 10, clk.Now().Add(2*time.Minute))
+	clk.Advance(time.Minute)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("制限が戻っても送られません")
+		}
+	}
+	if n := len(srv.Posted("alice")); n != 1 {
+		t.Errorf("aliceの投稿が %d 件、want 1", n)
+	}
+	if n := len(srv.Posted("bob")); n != 1 {
+		t.Errorf("bobの投稿が %d 件、want 1", n)
+	}
+}
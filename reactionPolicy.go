@@ -0,0 +1,269 @@
+package mastobots
+
+import (
+	"context"
+	"log"
+	"maps"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// authorClasses は、ReactionPolicy の Rules の Authors に指定できる相手の種類
+var authorClasses = []string{"local", "remote", "bot", "human", "followed", "mutual", "stranger"}
+
+// defaultReactionRules は、Rules を省略した時の規則。フォローしている同じサーバのbotにはブースト＋引用コメントもし、他の相手にはふぁぼるだけ。
+// フォロー関係を調べるのは、同じサーバのbotだけ。
+var defaultReactionRules = []ReactionRule{
+	{Authors: []string{"local", "bot", "followed"}, Actions: map[string]float64{"fav": 1, "boost": 1, "quote": 1}},
+	{Actions: map[string]float64{"fav": 1}},
+}
+
+// ReactionPolicy は、タイムラインでキーワードを見つけた時に、誰にどれだけ反応するかを格納する。
+// 規則で選んだ反応のうち、タイムラインの Reactions（省略すると SourceReactions か defaultReactions）にあるものだけをする
+type ReactionPolicy struct {
+	Rules          []ReactionRule // 上から順に調べ、最初に当てはまった規則で反応する。省略すると defaultReactionRules
+	DailyCaps      map[string]int // 反応（fav・boost・quote）ごとの一日の上限。省略した反応は無制限
+	AuthorCooldown int            // 同じ相手に反応してから、次に反応するまで空ける時間（分）
+	QuietHours     []string       // タイムラインに反応しない時間帯（"22:00-07:00" の形式）。メンションには返事する
+}
+
+// ReactionRule は、どのタイムラインの、どんな相手に、どの反応をどの確率でするかを格納する
+type ReactionRule struct {
+	Sources []string           // タイムラインの種類（home・local・public・hashtag・list）。省略するとすべて
+	Authors []string           // 相手の種類（local・remote・bot・human・followed・mutual・stranger）。全部に当てはまる相手だけ。省略すると誰でも
+	Actions map[string]float64 // 反応（fav・boost・quote）と、その確率（0〜1）
+}
+
+// rules は、反応の規則を返す
+func (p ReactionPolicy) rules() []ReactionRule {
+	if len(p.Rules) == 0 {
+		return defaultReactionRules
+	}
+	return p.Rules
+}
+
+// quietAt は、時刻tがQuietHoursの時間帯に入るかどうかを返す。tはbotのタイムゾーンで渡す。
+func (p ReactionPolicy) quietAt(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	for _, s := range p.QuietHours {
+		w, err := parseWindow(s)
+		if err != nil {
+			continue
+		}
+		if (w.start <= m && m < w.end) || (w.start <= m+24*60 && m+24*60 < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// author は、反応する相手が、どの種類に当てはまるかを調べる。フォロー関係は、必要になった時に一度だけ取得する。
+type author struct {
+	acc      mastodon.Account
+	home     bool // ホームタイムラインに流れてきた相手はフォローしている
+	relation func() *mastodon.Relationship
+}
+
+// authorOf は、タイムラインtlに流れてきたアカウントaccを調べるためのauthorを返す
+func (bot *Persona) authorOf(ctx context.Context, tl Timeline, acc mastodon.Account) *author {
+	var once sync.Once
+	var rel *mastodon.Relationship
+	return &author{
+		acc:  acc,
+		home: tl.Type == "home",
+		relation: func() *mastodon.Relationship {
+			once.Do(func() {
+				rels, err := bot.relationWith(ctx, acc.ID)
+				if err != nil || len(rels) == 0 {
+					log.Printf("info: %s が id:%s との関係を確かめられなかったので、知らない相手として扱います", bot.Name, string(acc.ID))
+					return
+				}
+				rel = rels[0]
+			})
+			return rel
+		},
+	}
+}
+
+// is は、相手がclassの種類に当てはまるかどうかを返す
+func (a *author) is(class string) bool {
+	remote := strings.Contains(a.acc.Acct, "@")
+	switch class {
+	case "local":
+		return !remote
+	case "remote":
+		return remote
+	case "bot":
+		return a.acc.Bot
+	case "human":
+		return !a.acc.Bot
+	case "followed":
+		if a.home {
+			return true
+		}
+		rel := a.relation()
+		return rel != nil && rel.Following
+	case "mutual":
+		rel := a.relation()
+		return rel != nil && rel.Following && rel.FollowedBy
+	case "stranger":
+		return !a.is("followed")
+	}
+	return false
+}
+
+// matches は、規則rがタイムラインtlの相手aに当てはまるかどうかを返す
+func (r ReactionRule) matches(tl Timeline, a *author) bool {
+	if len(r.Sources) > 0 && !slices.Contains(r.Sources, tl.Type) {
+		return false
+	}
+	for _, c := range r.Authors {
+		if !a.is(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// reactionLog は、一日の反応の回数と、相手ごとに最後に反応した時刻を覚えておく
+type reactionLog struct {
+	mu     sync.Mutex
+	day    string
+	counts map[string]int
+	last   map[mastodon.ID]time.Time
+}
+
+// reserve は、時刻nowに相手idへactionsの反応をすることを記録し、一日の上限capsに達していないものだけを返す。
+// cooldownの間に同じ相手に反応していたら、何も返さない。
+func (l *reactionLog) reserve(now time.Time, id mastodon.ID, actions []string, caps map[string]int, cooldown time.Duration) (ok []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if day := now.Format("2006-01-02"); day != l.day {
+		l.day, l.counts = day, make(map[string]int)
+	}
+	if l.last == nil {
+		l.last = make(map[mastodon.ID]time.Time)
+	}
+	if t, found := l.last[id]; found && now.Sub(t) < cooldown {
+		return nil
+	}
+	for _, a := range actions {
+		if c, capped := caps[a]; capped && l.counts[a] >= c {
+			continue
+		}
+		l.counts[a]++
+		ok = append(ok, a)
+	}
+	if len(ok) == 0 {
+		return
+	}
+	l.last[id] = now
+	// 間隔を空け終わった相手は忘れる
+	if len(l.last) > recentIDsMax {
+		maps.DeleteFunc(l.last, func(_ mastodon.ID, t time.Time) bool { return now.Sub(t) >= cooldown })
+	}
+	return
+}
+
+// decideReactions は、タイムラインtlでキーワードを見つけた、accのステータスへの反応を、ReactionPolicy に従って決める。
+// tlの Reactions にない反応はしない。決めた反応は、一日の上限と相手ごとの間隔に数える。
+func (bot *Persona) decideReactions(ctx context.Context, tl Timeline, acc mastodon.Account) (actions []string) {
+	p := bot.ReactionPolicy
+	a := bot.authorOf(ctx, tl, acc)
+	for _, r := range p.rules() {
+		if !r.matches(tl, a) {
+			continue
+		}
+		for _, name := range reactionNames {
+			prob, ok := r.Actions[name]
+			if !ok || !tl.reacts(name) || rand.Float64() >= prob {
+				continue
+			}
+			actions = append(actions, name)
+		}
+		break
+	}
+	if len(actions) == 0 {
+		return
+	}
+	now := bot.clock().Now().In(bot.location())
+	cooldown := time.Duration(p.AuthorCooldown) * time.Minute
+	if actions = bot.reactions.reserve(now, acc.ID, actions, p.DailyCaps, cooldown); len(actions) == 0 {
+		log.Printf("trace: %s は %s への反応を、一日の上限か相手ごとの間隔のため控えました", bot.Name, acc.Acct)
+	}
+	return
+}
+
+// applyReactionPolicyDefaults は、ReactionPolicy の表記の揺れを整える（種類や反応の名前は小文字に）
+func (bot *Persona) applyReactionPolicyDefaults() {
+	p := &bot.ReactionPolicy
+	for i := range p.Rules {
+		r := &p.Rules[i]
+		for j, s := range r.Sources {
+			r.Sources[j] = strings.ToLower(strings.TrimSpace(s))
+		}
+		for j, c := range r.Authors {
+			r.Authors[j] = strings.ToLower(strings.TrimSpace(c))
+		}
+		r.Actions = lowerKeys(r.Actions)
+	}
+	p.DailyCaps = lowerKeys(p.DailyCaps)
+}
+
+// lowerKeys は、キーを小文字にしたマップを返す
+func lowerKeys[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]V, len(m))
+	for k, v := range m {
+		res[strings.ToLower(strings.TrimSpace(k))] = v
+	}
+	return res
+}
+
+// validateReactionPolicy は、ReactionPolicy の問題を洗い出す。nameはエラー表示用のbotの呼び名。
+func (bot *Persona) validateReactionPolicy(name string) (errs ConfigErrors) {
+	p := bot.ReactionPolicy
+	for i, r := range p.Rules {
+		key := "ReactionPolicy.Rules"
+		for _, s := range r.Sources {
+			if !slices.Contains(timelineTypes, s) {
+				errs.add(name, key, "%d番目の Sources %q は不正です。%s のいずれかを指定してください", i+1, s, strings.Join(timelineTypes, "・"))
+			}
+		}
+		for _, c := range r.Authors {
+			if !slices.Contains(authorClasses, c) {
+				errs.add(name, key, "%d番目の Authors %q は不正です。%s のいずれかを指定してください", i+1, c, strings.Join(authorClasses, "・"))
+			}
+		}
+		for _, a := range slices.Sorted(maps.Keys(r.Actions)) {
+			if !slices.Contains(reactionNames, a) {
+				errs.add(name, key, "%d番目の Actions %q は不正です。%s から選んでください", i+1, a, strings.Join(reactionNames, "・"))
+			} else if prob := r.Actions[a]; prob < 0 || prob > 1 {
+				errs.add(name, key, "%d番目の %s の確率 %v は不正です。0〜1で指定してください", i+1, a, prob)
+			}
+		}
+	}
+	for _, a := range slices.Sorted(maps.Keys(p.DailyCaps)) {
+		if !slices.Contains(reactionNames, a) {
+			errs.add(name, "ReactionPolicy.DailyCaps", "%q は不正です。%s から選んでください", a, strings.Join(reactionNames, "・"))
+		} else if p.DailyCaps[a] < 0 {
+			errs.add(name, "ReactionPolicy.DailyCaps", "%s の %d は負です", a, p.DailyCaps[a])
+		}
+	}
+	if p.AuthorCooldown < 0 {
+		errs.add(name, "ReactionPolicy.AuthorCooldown", "%d は負です", p.AuthorCooldown)
+	}
+	for _, s := range p.QuietHours {
+		if _, err := parseWindow(s); err != nil {
+			errs.add(name, "ReactionPolicy.QuietHours", "%q は「22:00-07:00」の形式で指定してください", s)
+		}
+	}
+	return
+}
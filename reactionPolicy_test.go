@@ -0,0 +1,162 @@
+package mastobots
+
+import (
+	"context"
+	"slices"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestQuietAt(t *testing.T) {
+	p := ReactionPolicy{QuietHours: []string{"22:00-07:00", "12:00-13:00"}}
+	tests := []struct {
+		clock string
+		want  bool
+	}{
+		{"21:59", false},
+		{"22:00", true},
+		{"03:00", true},
+		{"06:59", true},
+		{"07:00", false},
+		{"12:30", true},
+		{"13:00", false},
+	}
+	for _, tt := range tests {
+		tm, _ := time.Parse("15:04", tt.clock)
+		if got := p.quietAt(tm); got != tt.want {
+			t.Errorf("%s: %v, want %v", tt.clock, got, tt.want)
+		}
+	}
+	if (ReactionPolicy{}).quietAt(time.Now()) {
+		t.Error("QuietHours がないのに静かにしています")
+	}
+}
+
+func TestReactionLogReserve(t *testing.T) {
+	var l reactionLog
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	caps := map[string]int{"boost": 1}
+	all := []string{"fav", "boost"}
+
+	if got := l.reserve(now, "1", all, caps, 30*time.Minute); !slices.Equal(got, all) {
+		t.Errorf("最初 = %v, want %v", got, all)
+	}
+	if got := l.reserve(now.Add(10*time.Minute), "1", all, caps, 30*time.Minute); got != nil {
+		t.Errorf("間隔を空けずに %v", got)
+	}
+	if got := l.reserve(now.Add(10*time.Minute), "2", all, caps, 30*time.Minute); !slices.Equal(got, []string{"fav"}) {
+		t.Errorf("上限の後 = %v, want [fav]", got)
+	}
+	if got := l.reserve(now.Add(40*time.Minute), "1", all, caps, 30*time.Minute); !slices.Equal(got, []string{"fav"}) {
+		t.Errorf("間隔を空けた後 = %v, want [fav]", got)
+	}
+	// 日が変われば数え直す
+	if got := l.reserve(now.Add(12*time.Hour), "2", all, caps, 30*time.Minute); !slices.Equal(got, all) {
+		t.Errorf("翌日 = %v, want %v", got, all)
+	}
+}
+
+func TestValidateReactionPolicy(t *testing.T) {
+	bot := validBot("a")
+	bot.ReactionPolicy = ReactionPolicy{
+		Rules: []ReactionRule{
+			{Sources: []string{"Hashtag"}, Authors: []string{"Mutual"}, Actions: map[string]float64{"FAV": 1}},
+			{Sources: []string{"federated"}, Authors: []string{"friend"}, Actions: map[string]float64{"boost": 1.5, "reply": 1}},
+		},
+		DailyCaps:      map[string]int{"fav": -1, "reply": 3},
+		AuthorCooldown: -5,
+		QuietHours:     []string{"22:00-07:00", "night"},
+	}
+	errs := validateBots([]*Persona{bot})
+	want := []string{
+		`a の ReactionPolicy.Rules：2番目の Sources "federated" は不正です。home・local・public・hashtag・list のいずれかを指定してください`,
+		`a の ReactionPolicy.Rules：2番目の Authors "friend" は不正です。local・remote・bot・human・followed・mutual・stranger のいずれかを指定してください`,
+		`a の ReactionPolicy.Rules：2番目の boost の確率 1.5 は不正です。0〜1で指定してください`,
+		`a の ReactionPolicy.Rules：2番目の Actions "reply" は不正です。fav・boost・quote から選んでください`,
+		`a の ReactionPolicy.DailyCaps：fav の -1 は負です`,
+		`a の ReactionPolicy.DailyCaps："reply" は不正です。fav・boost・quote から選んでください`,
+		`a の ReactionPolicy.AuthorCooldown：-5 は負です`,
+		`a の ReactionPolicy.QuietHours："night" は「22:00-07:00」の形式で指定してください`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("エラーが%d件：\n%s", len(errs), errs.Error())
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Errorf("%d件目 = %q, want %q", i, e.Error(), want[i])
+		}
+	}
+	r := bot.ReactionPolicy.Rules[0]
+	if r.Sources[0] != "hashtag" || r.Authors[0] != "mutual" || r.Actions["fav"] != 1 {
+		t.Errorf("表記が整っていません：%+v", r)
+	}
+}
+
+func TestDecideReactions(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	ctx := context.Background()
+
+	localBot := mastodon.Account{ID: "8", Acct: "friend", Bot: true}
+	remoteHuman := mastodon.Account{ID: "7", Acct: "human@example.com"}
+	mutual := mastodon.Account{ID: "5", Acct: "pal@example.com"}
+	followed := mastodon.Account{ID: "6", Acct: "idol@example.com"}
+	stranger := mastodon.Account{ID: "9", Acct: "stranger", Bot: true}
+	home := Timeline{Type: "home", Reactions: reactionNames}
+	hashtag := Timeline{Type: "hashtag", Tag: "coffee", Reactions: reactionNames}
+
+	// Rules を省略したら、フォローしている同じサーバのbotには全部、他の相手にはふぁぼだけ
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	srv.SetFollowing("alice", mutual.ID, true)
+	srv.SetFollowedBy("alice", mutual.ID, true)
+	srv.SetFollowing("alice", followed.ID, true)
+	if got := bot.decideReactions(ctx, home, localBot); !slices.Equal(got, reactionNames) {
+		t.Errorf("同じサーバのbot = %v, want %v", got, reactionNames)
+	}
+	if got := bot.decideReactions(ctx, home, remoteHuman); !slices.Equal(got, []string{"fav"}) {
+		t.Errorf("他のサーバの人 = %v, want [fav]", got)
+	}
+	// フォローしていない相手は、同じサーバのbotでもブーストしない
+	if got := bot.decideReactions(ctx, hashtag, stranger); !slices.Equal(got, []string{"fav"}) {
+		t.Errorf("知らないbot = %v, want [fav]", got)
+	}
+
+	bot = integrationBot(t, srv, clk, "bob", func(bot *Persona) {
+		bot.ReactionPolicy = ReactionPolicy{
+			Rules: []ReactionRule{
+				{Sources: []string{"hashtag"}, Authors: []string{"mutual"}, Actions: map[string]float64{"fav": 1, "boost": 1}},
+				{Sources: []string{"hashtag"}, Authors: []string{"remote"}, Actions: map[string]float64{"fav": 0}},
+				{Authors: []string{"stranger"}, Actions: map[string]float64{"fav": 1}},
+				{Actions: map[string]float64{"boost": 1}},
+			},
+			DailyCaps: map[string]int{"boost": 2},
+		}
+	})
+	srv.SetFollowing("bob", mutual.ID, true)
+	srv.SetFollowedBy("bob", mutual.ID, true)
+	srv.SetFollowing("bob", followed.ID, true)
+	tests := []struct {
+		tl   Timeline
+		acc  mastodon.Account
+		want []string
+	}{
+		{hashtag, mutual, []string{"fav", "boost"}},
+		{hashtag, followed, nil},
+		// 知らない相手をブーストしないのも、規則で決める
+		{hashtag, stranger, []string{"fav"}},
+		{home, remoteHuman, []string{"boost"}},
+		// 一日の上限
+		{home, localBot, nil},
+		// tlの Reactions にない反応はしない
+		{Timeline{Type: "hashtag", Tag: "tea", Reactions: []string{"fav"}}, mutual, []string{"fav"}},
+	}
+	for i, tt := range tests {
+		if got := bot.decideReactions(ctx, tt.tl, tt.acc); !slices.Equal(got, tt.want) {
+			t.Errorf("%d: %sの %s = %v, want %v", i, tt.tl.name(), tt.acc.Acct, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package mastobots
+
+import (
+	"context"
+	"errors"
+	"log"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// 設定ファイルを読み直した時、これらの項目だけが変わったbotは、止めずにその場で入れ替える
+var vocabularyFields = map[string]bool{
+	"Keywords":    true,
+	"Comments":    true,
+	"Hashtags":    true,
+	"RandomToots": true,
+}
+
+// 実行中に決まる項目。設定ファイルとの比較には使わない
+var runtimeFields = map[string]bool{
+	"Client":    true,
+	"MyID":      true,
+	"DBID":      true,
+	"PlaceName": true,
+	"Awake":     true,
+}
+
+// botChange は、設定ファイルを読み直した時のbotの変わり方
+type botChange int
+
+const (
+	unchanged botChange = iota
+	vocabularyChanged
+	otherChanged
+)
+
+// diffPersona は、同じ名前のbotの新旧の設定を比べ、一番大きな変わり方を返す。
+// 語彙以外の項目（寝起きの時刻やスケジュールも含む）が変わったら、botを再起動する。
+func diffPersona(old, nb *Persona) (change botChange) {
+	ov, nv := reflect.ValueOf(old).Elem(), reflect.ValueOf(nb).Elem()
+	t := ov.Type()
+	for i := 0; i < t.NumField(); i++ {
+		fd := t.Field(i)
+		if !fd.IsExported() || fd.Anonymous || runtimeFields[fd.Name] {
+			continue
+		}
+		if reflect.DeepEqual(ov.Field(i).Interface(), nv.Field(i).Interface()) {
+			continue
+		}
+		c := otherChanged
+		if vocabularyFields[fd.Name] {
+			c = vocabularyChanged
+		}
+		if c > change {
+			change = c
+		}
+	}
+	return
+}
+
+// keywords は、botが興味を示す単語を返す。設定ファイルの読み直しで入れ替わることがある。
+func (bot *Persona) keywords() []string {
+	bot.vocabMu.RLock()
+	defer bot.vocabMu.RUnlock()
+	return bot.Keywords
+}
+
+// comments は、トゥート本文のテンプレートを返す
+func (bot *Persona) comments() []string {
+	bot.vocabMu.RLock()
+	defer bot.vocabMu.RUnlock()
+	return bot.Comments
+}
+
+// hashtags は、トゥートに付けるハッシュタグを返す
+func (bot *Persona) hashtags() []string {
+	bot.vocabMu.RLock()
+	defer bot.vocabMu.RUnlock()
+	return bot.Hashtags
+}
+
+// randomToots は、ランダムトゥートの内容を返す
+func (bot *Persona) randomToots() []string {
+	bot.vocabMu.RLock()
+	defer bot.vocabMu.RUnlock()
+	return bot.RandomToots
+}
+
+// setVocabulary は、キーワード・コメント・ハッシュタグ・ランダムトゥートをnbのものに入れ替える
+func (bot *Persona) setVocabulary(nb *Persona) {
+	bot.vocabMu.Lock()
+	defer bot.vocabMu.Unlock()
+	bot.Keywords = nb.Keywords
+	bot.Comments = nb.Comments
+	bot.Hashtags = nb.Hashtags
+	bot.RandomToots = nb.RandomToots
+}
+
+// runningBot は、活動中のbotと、それだけを止める関数を格納する
+type runningBot struct {
+	bot    *Persona
+	cancel context.CancelFunc
+}
+
+// roster は、活動中のbotたちを名前で管理する
+// 活動を続けられなくなったbotは、runningから外してlostに理由を残す。
+// 全体の設定はcommonに持ち、途中で加わったbotや動かし直したbotにも同じものを渡す。
+type roster struct {
+	mu      sync.Mutex
+	ctx     context.Context
+	db      DB
+	common  *commonSettings
+	running map[string]runningBot
+	lost    BotErrors
+	allLost chan struct{}
+	connect func(db DB, bot *Persona) error
+}
+
+func newRoster(ctx context.Context, db DB, common *commonSettings) *roster {
+	return &roster{ctx: ctx, db: db, common: common, running: make(map[string]runningBot), allLost: make(chan struct{}, 1), connect: connectBot}
+}
+
+// start は、botを活動させる。準備を諦めたり、パニックを繰り返したりしたbotは、活動をやめさせる。r.muを持って呼ぶこと。
+func (r *roster) start(bot *Persona) {
+	ctx, cancel := context.WithCancel(r.ctx)
+	r.running[bot.Name] = runningBot{bot: bot, cancel: cancel}
+	gaveUp := bot.supervise(ctx, "daylife", func(ctx context.Context) {
+		if err := bot.live(ctx, r.db, r.connect); err != nil {
+			r.lose(bot, err)
+		}
+	})
+	go func() {
+		if err, ok := <-gaveUp; ok {
+			r.lose(bot, err)
+		}
+	}()
+}
+
+// apply は、読み直した設定をbotたちに反映する。
+// 語彙だけ変わったbotはその場で入れ替え、新しいbotは活動を始め、いなくなったbotは止め、
+// それ以外が変わったbotは止めてから新しい設定で動かし直す。全体の設定は再起動するまで変わらない。
+func (r *roster) apply(bots []*Persona) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make(map[string]bool)
+	for _, nb := range bots {
+		names[nb.Name] = true
+		rb, ok := r.running[nb.Name]
+		if !ok {
+			nb.commonSettings = r.common
+			if err := r.connect(r.db, nb); err != nil {
+				log.Printf("alert: 新しく加わった %s が準備できませんでした。後でやり直します：%s", nb.Name, err)
+				nb.startupErr = err
+			}
+			log.Printf("info: %s が新しく加わりました", nb.Name)
+			r.start(nb)
+			continue
+		}
+
+		switch diffPersona(rb.bot, nb) {
+		case vocabularyChanged:
+			rb.bot.setVocabulary(nb)
+			log.Printf("info: %s のキーワード・コメント・ハッシュタグ・ランダムトゥートを入れ替えました", nb.Name)
+		case otherChanged:
+			nb.commonSettings = r.common
+			if rb.bot.startupErr != nil {
+				// まだ準備できていないbotは、新しい設定で準備し直す
+				nb.startupErr = rb.bot.startupErr
+			} else {
+				nb.DBID = rb.bot.DBID
+				nb.PlaceName = rb.bot.PlaceName
+				if nb.Instance == rb.bot.Instance && nb.AccessToken == rb.bot.AccessToken {
+					nb.Client, nb.MyID = rb.bot.Client, rb.bot.MyID
+				} else if err := nb.getMastoID(); err != nil {
+					log.Printf("alert: %s の新しいアカウントに接続できなかったので、元の設定のまま動かします：%s", nb.Name, err)
+					continue
+				}
+			}
+			rb.cancel()
+			log.Printf("info: %s を新しい設定で動かし直します", nb.Name)
+			r.start(nb)
+		}
+	}
+
+	for name, rb := range r.running {
+		if !names[name] {
+			rb.cancel()
+			delete(r.running, name)
+			log.Printf("info: %s は設定ファイルからいなくなったので、活動をやめました", name)
+		}
+	}
+}
+
+// connectBot は、新しく加わったbotや、起動時に準備できなかったbotをMastodonサーバとデータベースに登録する
+func connectBot(db DB, bot *Persona) (err error) {
+	if err = bot.verifyCredentials(context.Background()); err != nil {
+		return
+	}
+	if err = db.addNewBots([]*Persona{bot}); err != nil {
+		return
+	}
+	if bot.DBID, err = db.botID(bot); err != nil {
+		return
+	}
+	// このプロセスではまだ何も送っていないbotなので、前のプロセスが送っている途中だった書き込みを送信待ちに戻してよい
+	db.releaseActions(bot, time.Now())
+	if bot.LivesWithSun {
+		bot.PlaceName, err = getPlaceName(bot.geocoder, bot.Latitude, bot.Longitude)
+	}
+	return
+}
+
+// watchConfig は、config.ymlが書き換えられるたびに読み直し、問題がなければ新しいbotたちを送る。
+// 全体の設定は読み直さず、新しいbotたちにもcommonを使わせる。問題があれば、ログに出して今の設定のまま動き続ける。
+func watchConfig(ctx context.Context, common *commonSettings) <-chan []*Persona {
+	ch := make(chan []*Persona, 1)
+	conf := newConfig()
+	if err := conf.ReadInConfig(); err != nil {
+		log.Printf("info: 設定ファイルの変更を監視できません：%s", err)
+		return ch
+	}
+	conf.OnConfigChange(func(ev fsnotify.Event) {
+		if ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+			return
+		}
+		log.Printf("info: 設定ファイルが変更されたので読み直します")
+		bots, err := loadConfig(conf, common)
+		if err != nil {
+			var errs ConfigErrors
+			if errors.As(err, &errs) {
+				for _, e := range errs {
+					log.Printf("alert: 設定の問題：%s", e)
+				}
+			}
+			log.Printf("alert: 設定ファイルに問題があるので、今の設定のまま動き続けます")
+			return
+		}
+		select {
+		case ch <- bots:
+		case <-ctx.Done():
+		}
+	})
+	conf.WatchConfig()
+	return ch
+}
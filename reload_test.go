@@ -0,0 +1,158 @@
+package mastobots
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+	"github.com/spf13/viper"
+)
+
+func TestDiffPersona(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(bot *Persona)
+		want   botChange
+	}{
+		{"同じ", func(bot *Persona) {}, unchanged},
+		{"実行中に決まる項目だけ", func(bot *Persona) { bot.MyID = "1"; bot.DBID = 3; bot.PlaceName = "東京" }, unchanged},
+		{"キーワード", func(bot *Persona) { bot.Keywords = []string{"紅茶"} }, vocabularyChanged},
+		{"ハッシュタグ", func(bot *Persona) { bot.Hashtags = []string{"news"} }, vocabularyChanged},
+		{"起きる時刻", func(bot *Persona) { bot.WakeHour = 7; bot.Comments = []string{"x"} }, otherChanged},
+		{"スケジュール", func(bot *Persona) { bot.Schedule = "0 8 * * *" }, otherChanged},
+		{"口調", func(bot *Persona) { bot.Assertion = "ナリ"; bot.Interval = 30 }, otherChanged},
+		{"アクセストークン", func(bot *Persona) { bot.AccessToken = "new" }, otherChanged},
+	}
+	for _, tt := range tests {
+		old, nb := validBot("a"), validBot("a")
+		tt.modify(nb)
+		if got := diffPersona(old, nb); got != tt.want {
+			t.Errorf("%s: diffPersona() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRosterApply(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	alice := integrationBot(t, srv, clk, "alice", func(bot *Persona) { bot.Keywords = []string{"coffee"} })
+	bob := integrationBot(t, srv, clk, "bob", nil)
+	dave := integrationBot(t, srv, clk, "dave", nil)
+	r := newRoster(ctx, db, alice.commonSettings)
+	r.connect = func(db DB, bot *Persona) error { return bot.getMastoID() }
+	r.mu.Lock()
+	for _, bot := range []*Persona{alice, bob, dave} {
+		r.start(bot)
+	}
+	r.mu.Unlock()
+	if !srv.WaitFor(5*time.Second, func() bool {
+		return srv.Streams("alice") == 1 && srv.Streams("bob") == 1 && srv.Streams("dave") == 1
+	}) {
+		t.Fatal("ストリーミングに接続しませんでした")
+	}
+
+	// aliceはキーワードだけ、daveは間隔が変わり、bobはいなくなり、carolが加わる
+	srv.AddAccount("carol", mastodon.Account{Username: "carol", Bot: true})
+	reloaded := func(name string, configure func(bot *Persona)) *Persona {
+		bot := &Persona{Name: name, Instance: srv.URL, AccessToken: name, Interval: 60, loc: time.UTC}
+		if configure != nil {
+			configure(bot)
+		}
+		if err := bot.parseDaySchedule(); err != nil {
+			t.Fatal(err)
+		}
+		return bot
+	}
+	newAlice := reloaded("alice", func(bot *Persona) { bot.Keywords = []string{"tea"} })
+	newDave := reloaded("dave", func(bot *Persona) { bot.Interval = 30 })
+	carol := reloaded("carol", nil)
+	r.apply([]*Persona{newAlice, newDave, carol})
+
+	if r.running["alice"].bot != alice {
+		t.Error("キーワードだけ変わったaliceが動かし直されました")
+	}
+	if got := alice.keywords(); !reflect.DeepEqual(got, []string{"tea"}) {
+		t.Errorf("aliceのキーワード = %q, want [tea]", got)
+	}
+	if r.running["dave"].bot != newDave || newDave.MyID != dave.MyID {
+		t.Error("間隔が変わったdaveが新しい設定で動いていません")
+	}
+	if _, ok := r.running["bob"]; ok {
+		t.Error("いなくなったbobがまだ動いています")
+	}
+	if !srv.WaitFor(5*time.Second, func() bool {
+		return srv.Streams("bob") == 0 && srv.Streams("carol") == 1 && srv.Streams("dave") == 1
+	}) {
+		t.Errorf("ストリーミングの接続数：bob %d、carol %d、dave %d", srv.Streams("bob"), srv.Streams("carol"), srv.Streams("dave"))
+	}
+	if srv.Streams("alice") != 1 {
+		t.Errorf("aliceのストリーミングの接続数が %d になりました", srv.Streams("alice"))
+	}
+}
+
+func TestRosterApplyToEmptyRoster(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 誰も動いていなくても、新しく加わったbotは全体の設定を受け取る
+	alice := integrationBot(t, srv, clk, "alice", nil)
+	r := newRoster(ctx, unavailableDB(t), alice.commonSettings)
+	r.connect = func(db DB, bot *Persona) error { return bot.getMastoID() }
+	r.apply([]*Persona{alice})
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 1 }) {
+		t.Fatal("ストリーミングに接続しませんでした")
+	}
+	r.apply(nil)
+
+	bob := integrationBot(t, srv, clk, "bob", nil)
+	bob.commonSettings = nil
+	r.apply([]*Persona{bob})
+	if bob.commonSettings != alice.commonSettings {
+		t.Error("新しく加わったbobが全体の設定を受け取っていません")
+	}
+}
+
+func TestLoadConfigKeepsCommonSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	conf := `
+DryRunSink:
+    Type: jsonl
+Personae:
+    -   Name: alice
+        Instance: https://example.com
+        AccessToken: token
+        WakeHour: 6
+        SleepHour: 22
+        TimeZone: UTC
+        Interval: 60
+        Comments: ["_keyword1_！"]
+`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+
+	// 読み直しでは全体の設定を作らず、動いているものを使う
+	common := &commonSettings{defaultGeo: "gsi", geocoders: newGeocoders(GeocoderSettings{}, "")}
+	bots, err := loadConfig(v, common)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bots) != 1 || bots[0].commonSettings != common {
+		t.Errorf("読み直したbotが、動いている全体の設定を使っていません")
+	}
+}
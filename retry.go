@@ -0,0 +1,79 @@
+package mastobots
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// retryMaxInterval は、やり直すまでの待ち時間の上限
+const retryMaxInterval = 5 * time.Minute
+
+// permanent は、何度やり直しても成功しないエラーかどうかを返す。
+// 4xx（認証の失敗・見つからない・内容の誤りなど）はやり直さない。ただし、408と429は時間を置けば成功しうる。
+func permanent(err error) bool {
+	var ae *mastodon.APIError
+	if !errors.As(err, &ae) {
+		return false
+	}
+	switch ae.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return ae.StatusCode >= 400 && ae.StatusCode < 500
+}
+
+// retry は、fnが成功するまで、maxRetry回を上限にやり直す。whatは、ログに出す操作の名前。
+// 待ち時間は retryInterval から始めて倍々に延ばし（上限は retryMaxInterval）、前後にゆらぎを加える。
+// やり直しても成功しないエラーなら、すぐに諦める。待っている間にctxが終わったら、ctxのエラーを返す。
+func (bot *Persona) retry(ctx context.Context, what string, fn func() error) (err error) {
+	wait := bot.commonSettings.retryInterval
+	for i := 1; ; i++ {
+		if err = fn(); err == nil {
+			return
+		}
+		if permanent(err) {
+			log.Printf("info: %s の%sは、やり直しても成功しないので諦めます：%s", bot.Name, what, err)
+			return
+		}
+		if i >= bot.commonSettings.maxRetry {
+			break
+		}
+		d := jitter(wait)
+		log.Printf("info: %s の%sに失敗しました。%s後にやり直します：%s", bot.Name, what, d.Round(time.Millisecond), err)
+		if cerr := sleepContext(ctx, bot.clock(), d); cerr != nil {
+			return cerr
+		}
+		if wait *= 2; wait > retryMaxInterval {
+			wait = retryMaxInterval
+		}
+	}
+
+	log.Printf("info: %s の%sがリトライ上限に達しました：%s", bot.Name, what, err)
+	return
+}
+
+// jitter は、dの半分から1.5倍までのどこかを返す（同時に失敗したbotたちが、一斉にやり直さないように）
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// sleepContext は、clkの時刻でdだけ待つ。その前にctxが終わったら、ctxのエラーを返す。
+func sleepContext(ctx context.Context, clk Clock, d time.Duration) error {
+	t := clk.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.Chan():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
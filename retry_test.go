@@ -0,0 +1,84 @@
+package mastobots
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&mastodon.APIError{StatusCode: 401}, true},
+		{&mastodon.APIError{StatusCode: 404}, true},
+		{&mastodon.APIError{StatusCode: 422}, true},
+		{&mastodon.APIError{StatusCode: 408}, false},
+		{&mastodon.APIError{StatusCode: 429}, false},
+		{&mastodon.APIError{StatusCode: 503}, false},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("permanent(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := &Persona{Name: "alice", commonSettings: &commonSettings{maxRetry: 3, retryInterval: time.Second, clk: clk}}
+	ctx := context.Background()
+
+	// やり直しても無駄なエラーは、一度で諦める
+	calls := 0
+	err := bot.retry(ctx, "テスト", func() error {
+		calls++
+		return &mastodon.APIError{StatusCode: 422}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("422: err = %v、%d 回呼ばれました", err, calls)
+	}
+
+	// 一時的なエラーは、待ち時間を倍にしながらmaxRetry回まで試す
+	calls = 0
+	done := make(chan error, 1)
+	go func() {
+		done <- bot.retry(ctx, "テスト", func() error {
+			calls++
+			return &mastodon.APIError{StatusCode: 503}
+		})
+	}()
+	for _, max := range []time.Duration{1500 * time.Millisecond, 3 * time.Second} {
+		clk.waitForTimers(t, 1)
+		clk.Advance(max)
+	}
+	select {
+	case err := <-done:
+		if err == nil || calls != 3 {
+			t.Errorf("503: err = %v、%d 回呼ばれました", err, calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("やり直しが終わりません")
+	}
+
+	// 待っている間にキャンセルされたら、すぐに戻る
+	cctx, cancel := context.WithCancel(ctx)
+	go func() {
+		done <- bot.retry(cctx, "テスト", func() error { return errors.New("一時的") })
+	}()
+	clk.waitForTimers(t, 1)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("キャンセル: err = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("キャンセルしても戻りません")
+	}
+}
@@ -0,0 +1,202 @@
+package mastobots
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule は、cron形式（分 時 日 月 曜日）で指定された実行時刻を格納する
+type cronSchedule struct {
+	spec    string
+	minute  uint64
+	hour    uint64
+	dom     uint64
+	month   uint64
+	dow     uint64
+	domStar bool
+	dowStar bool
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronMinute = cronField{0, 59, nil}
+	cronHour   = cronField{0, 23, nil}
+	cronDom    = cronField{1, 31, nil}
+	cronMonth  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cronDow = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron は、cron形式の文字列を解析する。"*"、"1,15"、"9-17"、"*/20"、"8-20/3" および曜日・月の英語略称、"@daily" 等に対応する。
+func parseCron(spec string) (c *cronSchedule, err error) {
+	expr := strings.TrimSpace(spec)
+	if m, ok := cronMacros[strings.ToLower(expr)]; ok {
+		expr = m
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		err = fmt.Errorf("スケジュール %q は「分 時 日 月 曜日」の5項目で指定してください", spec)
+		return
+	}
+
+	c = &cronSchedule{spec: spec}
+	targets := []struct {
+		bits *uint64
+		def  cronField
+	}{
+		{&c.minute, cronMinute},
+		{&c.hour, cronHour},
+		{&c.dom, cronDom},
+		{&c.month, cronMonth},
+		{&c.dow, cronDow},
+	}
+	for i, t := range targets {
+		if *t.bits, err = parseCronField(fields[i], t.def); err != nil {
+			err = fmt.Errorf("スケジュール %q の%d項目めが不正です：%s", spec, i+1, err)
+			return nil, err
+		}
+	}
+
+	// 日曜日は0でも7でもよい
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*" || strings.HasPrefix(fields[2], "*/")
+	c.dowStar = fields[4] == "*" || strings.HasPrefix(fields[4], "*/")
+	return
+}
+
+// parseCronField は、cron形式の一項目を解析し、該当する値のビット集合を返す
+func parseCronField(field string, def cronField) (bits uint64, err error) {
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			rng = part[:i]
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("間隔 %q が不正です", part[i+1:])
+			}
+		}
+
+		lo, hi := def.min, def.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			ends := strings.SplitN(rng, "-", 2)
+			if lo, err = cronValue(ends[0], def); err != nil {
+				return
+			}
+			if hi, err = cronValue(ends[1], def); err != nil {
+				return
+			}
+		default:
+			if lo, err = cronValue(rng, def); err != nil {
+				return
+			}
+			if step == 1 {
+				hi = lo
+			}
+		}
+		if lo > hi {
+			return 0, fmt.Errorf("範囲 %q が逆転しています", rng)
+		}
+
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return
+}
+
+func cronValue(s string, def cronField) (v int, err error) {
+	if n, ok := def.names[strings.ToLower(s)]; ok {
+		return n, nil
+	}
+	if v, err = strconv.Atoi(s); err != nil {
+		return 0, fmt.Errorf("%q は数値ではありません", s)
+	}
+	if v < def.min || v > def.max {
+		return 0, fmt.Errorf("%d は %d〜%d の範囲外です", v, def.min, def.max)
+	}
+	return
+}
+
+// matchDay は、その日がスケジュールの日・曜日の指定に合うかを返す。
+// 日と曜日の両方が指定されていれば、どちらかに合えばよい（一般的なcronと同じ）。
+func (c *cronSchedule) matchDay(t time.Time) bool {
+	domOK := c.dom&(1<<uint(t.Day())) != 0
+	dowOK := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// next は、t より後で最初にスケジュールに合う時刻を返す。tのタイムゾーンで判定する。
+// 5年以内に該当する時刻がなければゼロ値を返す。
+func (c *cronSchedule) next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	// 夏時間の切り替えで存在しない時刻に丸められても、必ず先へ進むようにする
+	forward := func(cur, nt time.Time) time.Time {
+		if !nt.After(cur) {
+			return cur.Add(time.Duration(60-cur.Minute()) * time.Minute)
+		}
+		return nt
+	}
+
+	for t.Before(limit) {
+		y, mo, d := t.Date()
+		if c.month&(1<<uint(mo)) == 0 {
+			t = forward(t, time.Date(y, mo+1, 1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if !c.matchDay(t) {
+			t = forward(t, time.Date(y, mo, d+1, 0, 0, 0, 0, loc))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// count は、fromからtoまでの間にスケジュールに合う時刻の数を返す
+func (c *cronSchedule) count(from, to time.Time) (n int) {
+	for t := c.next(from); !t.IsZero() && !t.After(to); t = c.next(t) {
+		n++
+	}
+	return
+}
+
+func (c *cronSchedule) String() string {
+	return c.spec
+}
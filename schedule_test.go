@@ -0,0 +1,95 @@
+package mastobots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronNext(t *testing.T) {
+	// 2024-05-01 は水曜日
+	tests := []struct {
+		spec string
+		from string
+		want string
+	}{
+		{"0 * * * *", "2024-05-01 10:00", "2024-05-01 11:00"},
+		{"30 6 * * *", "2024-05-01 06:30", "2024-05-02 06:30"},
+		{"*/20 9-17 * * *", "2024-05-01 08:59", "2024-05-01 09:00"},
+		{"*/20 9-17 * * *", "2024-05-01 09:00", "2024-05-01 09:20"},
+		{"*/20 9-17 * * *", "2024-05-01 17:40", "2024-05-02 09:00"},
+		{"0 8-20/3 * * *", "2024-05-01 12:00", "2024-05-01 14:00"},
+		{"5/15 * * * *", "2024-05-01 10:40", "2024-05-01 10:50"},
+		{"0,30 12 * * *", "2024-05-01 12:00", "2024-05-01 12:30"},
+		{"0 9 * jan,JUL mon-fri", "2024-05-01 00:00", "2024-07-01 09:00"},
+		{"0 9 * * sat,sun", "2024-05-01 00:00", "2024-05-04 09:00"},
+		{"0 0 * * 7", "2024-05-01 00:00", "2024-05-05 00:00"},
+		{"@monthly", "2024-05-01 00:00", "2024-06-01 00:00"},
+		{"@weekly", "2024-05-01 00:00", "2024-05-05 00:00"},
+		{"@Daily", "2024-05-01 00:00", "2024-05-02 00:00"},
+		{"@hourly", "2024-05-01 23:59", "2024-05-02 00:00"},
+		{"@yearly", "2024-05-01 00:00", "2025-01-01 00:00"},
+		// 日と曜日の両方を指定したら、どちらかに合えばよい
+		{"0 0 13 * fri", "2024-05-01 00:00", "2024-05-03 00:00"},
+		{"0 0 13 * fri", "2024-05-10 00:00", "2024-05-13 00:00"},
+		// 片方が「*」なら、もう片方だけで決まる
+		{"0 0 13 * *", "2024-05-01 00:00", "2024-05-13 00:00"},
+		// 「*/10」も「*」と同じく扱うので、1・11・21・31日のうち月曜日だけ（一般的なcronと同じ）
+		{"0 0 */10 * mon", "2024-05-01 00:00", "2024-07-01 00:00"},
+		{"0 0 29 2 *", "2024-05-01 00:00", "2028-02-29 00:00"},
+	}
+	for _, tt := range tests {
+		c, err := parseCron(tt.spec)
+		if err != nil {
+			t.Errorf("%s: %v", tt.spec, err)
+			continue
+		}
+		from, _ := time.Parse("2006-01-02 15:04", tt.from)
+		if got := c.next(from).Format("2006-01-02 15:04"); got != tt.want {
+			t.Errorf("%s の %s の次 = %s, want %s", tt.spec, tt.from, got, tt.want)
+		}
+	}
+}
+
+func TestCronNeverFires(t *testing.T) {
+	c, err := parseCron("0 0 30 2 *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.next(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)); !got.IsZero() {
+		t.Errorf("2月30日 = %s, want ゼロ値", got)
+	}
+}
+
+func TestCronCount(t *testing.T) {
+	c, err := parseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	from := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	if n := c.count(from, from.Add(5*time.Hour)); n != 5 {
+		t.Errorf("count = %d, want 5", n)
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"*/x * * * *",
+		"5-1 * * * *",
+		"* * * foo *",
+		"* * * * mon-",
+		"@reboot",
+	} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q がエラーになりません", spec)
+		}
+	}
+}
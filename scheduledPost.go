@@ -0,0 +1,174 @@
+package mastobots
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// 寝ている間や停止中に時刻を過ぎた一回限りの予約投稿を、起きてから投稿する猶予
+const scheduledPostGrace = 24 * time.Hour
+
+// ScheduledPost は、予約投稿の内容と日時を格納する。Atは一回限りの日時（"2006-01-02 15:04"）、Scheduleはcron形式の繰り返し。
+// 投稿した回は、設定ファイルのものは At・Schedule・Status から、データベースのものはIDから作るキーで見分ける。
+// そのため、設定ファイルの予約投稿の文面を直すと、投稿済みの回も別の投稿とみなして、猶予の間なら投稿し直す。
+type ScheduledPost struct {
+	ID          int
+	Status      string
+	Visibility  string
+	SpoilerText string
+	Media       []string
+	At          string
+	Schedule    string
+	at          time.Time
+	sched       *cronSchedule
+	key         string
+}
+
+// prepare は、予約投稿の日時を解析し、二重投稿を防ぐためのキーを決める
+func (sp *ScheduledPost) prepare(loc *time.Location) (err error) {
+	if sp.At == "" && sp.Schedule == "" {
+		return fmt.Errorf("予約投稿「%s」に日時（At）もスケジュール（Schedule）もありません", sp.Status)
+	}
+	if sp.At != "" && sp.at.IsZero() {
+		if sp.at, err = time.ParseInLocation("2006-01-02 15:04", sp.At, loc); err != nil {
+			return fmt.Errorf("予約投稿の日時 %q が不正です：%s", sp.At, err)
+		}
+	}
+	if sp.Schedule != "" {
+		if sp.sched, err = parseCron(sp.Schedule); err != nil {
+			return
+		}
+	}
+
+	if sp.ID > 0 {
+		sp.key = fmt.Sprintf("db:%d", sp.ID)
+	} else {
+		sum := sha1.Sum([]byte(sp.At + "|" + sp.Schedule + "|" + sp.Status))
+		sp.key = "yaml:" + hex.EncodeToString(sum[:8])
+	}
+	return
+}
+
+// firesBetween は、sinceより後、until以前に予約投稿を行うべき時刻を返す
+func (sp *ScheduledPost) firesBetween(since, until time.Time, loc *time.Location) (fires []time.Time) {
+	if !sp.at.IsZero() && sp.at.After(since) && !sp.at.After(until) {
+		fires = append(fires, sp.at)
+	}
+	if sp.sched != nil {
+		for t := sp.sched.next(since.In(loc)); !t.IsZero() && !t.After(until); t = sp.sched.next(t) {
+			fires = append(fires, t)
+		}
+	}
+	return
+}
+
+// parseScheduledPostsは、設定ファイルで指定された予約投稿を解析する。
+func (bot *Persona) parseScheduledPosts() error {
+	var errs ConfigErrors
+	loc := bot.location()
+	for i := range bot.ScheduledPosts {
+		if err := bot.ScheduledPosts[i].prepare(loc); err != nil {
+			errs.add(bot.Name, fmt.Sprintf("ScheduledPosts[%d]", i), "%s", err)
+		}
+	}
+	return errs.err()
+}
+
+// scheduledPostActivityは、起きている間、設定ファイルとデータベースの予約投稿を時刻どおりに投稿する。
+func (bot *Persona) scheduledPostActivity(ctx context.Context, db DB) {
+	loc := bot.location()
+	clk := bot.clock()
+	started := clk.Now()
+	since := started.Add(-scheduledPostGrace)
+
+	tk := clk.NewTicker(time.Minute)
+	defer tk.Stop()
+
+	for {
+		now := clk.Now()
+		posts := append([]ScheduledPost{}, bot.ScheduledPosts...)
+		dbPosts, err := db.scheduledPosts(bot, loc)
+		if err != nil {
+			log.Printf("info: %s がデータベースの予約投稿を読み込めませんでした", bot.Name)
+		}
+		posts = append(posts, dbPosts...)
+
+		for _, sp := range posts {
+			// 繰り返しの予約投稿は、寝ている間の分まで遡らない
+			from := since
+			if sp.sched != nil && from.Before(started) {
+				from = started.Add(-time.Minute)
+			}
+			for _, fireAt := range sp.firesBetween(from, now, loc) {
+				bot.postScheduled(ctx, db, sp, fireAt)
+			}
+		}
+		since = now
+
+		select {
+		case <-tk.Chan():
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// postScheduledは、予約投稿を一件投稿し、その結果を記録する。既に記録のある投稿は飛ばす。
+// 記録してから投稿に失敗した回は、エラーを残すだけで、やり直さない。ただし送信待ちに残した回は、失敗とせず後で送る。
+// dry-runの時はデータベースに記録を残さず、起動中に同じ回を二度投稿しないようにだけする。
+func (bot *Persona) postScheduled(ctx context.Context, db DB, sp ScheduledPost, fireAt time.Time) {
+	if bot.DryRun {
+		if _, fired := bot.dryRunFired.LoadOrStore(sp.key+"|"+fireAt.String(), true); fired {
+			return
+		}
+		toot := mastodon.Toot{Status: bot.fillCalendar(sp.Status), Visibility: sp.Visibility, SpoilerText: sp.SpoilerText}
+		for _, m := range sp.Media {
+			id, err := bot.uploadMedia(ctx, m)
+			if err != nil {
+				log.Printf("info: %s が予約投稿のメディア %s を見つけられませんでした：%s", bot.Name, m, err)
+				return
+			}
+			toot.MediaIDs = append(toot.MediaIDs, id)
+		}
+		bot.postStatus(ctx, toot)
+		return
+	}
+
+	claimed, err := db.claimScheduledPost(bot, sp.key, fireAt)
+	if err != nil || !claimed {
+		return
+	}
+	// 同じ回の予約投稿は、送り直しても二重に投稿されないよう、いつも同じ Idempotency-Key で送る
+	ctx = withIdempotencyKey(ctx, deriveIdempotencyKey(bot.Name, sp.key, fireAt.UTC().Format(time.RFC3339)))
+
+	toot := mastodon.Toot{Status: bot.fillCalendar(sp.Status), Visibility: sp.Visibility, SpoilerText: sp.SpoilerText}
+	for _, m := range sp.Media {
+		id, err := bot.uploadMedia(ctx, m)
+		if err != nil {
+			log.Printf("info: %s が予約投稿のメディア %s をアップロードできませんでした：%s", bot.Name, m, err)
+			db.recordScheduledPost(bot, sp.key, fireAt, "", err)
+			return
+		}
+		toot.MediaIDs = append(toot.MediaIDs, id)
+	}
+
+	st, err := bot.postStatus(ctx, toot)
+	if errors.Is(err, errQueued) {
+		log.Printf("info: %s の予約投稿 %s は送信待ちに残したので、後で送ります", bot.Name, sp.key)
+		return
+	}
+	if err != nil {
+		log.Printf("info: %s が予約投稿できませんでした：%s", bot.Name, sp.key)
+		db.recordScheduledPost(bot, sp.key, fireAt, "", err)
+		return
+	}
+	log.Printf("info: %s が予約投稿しました：%s（%s）", bot.Name, sp.key, fireAt.Format("01-02 15:04 MST"))
+	db.recordScheduledPost(bot, sp.key, fireAt, string(st.ID), nil)
+}
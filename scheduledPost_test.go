@@ -0,0 +1,84 @@
+package mastobots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduledPostPrepare(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	sp := ScheduledPost{Status: "お知らせ", At: "2024-05-01 18:00"}
+	if err := sp.prepare(tokyo); err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC); !sp.at.Equal(want) {
+		t.Errorf("at = %s, want %s", sp.at, want)
+	}
+
+	// 同じ内容なら同じキー、文面が変われば別のキー
+	same := ScheduledPost{Status: "お知らせ", At: "2024-05-01 18:00"}
+	edited := ScheduledPost{Status: "お知らせです", At: "2024-05-01 18:00"}
+	same.prepare(tokyo)
+	edited.prepare(tokyo)
+	if sp.key != same.key || sp.key == edited.key {
+		t.Errorf("キー %s・%s・%s", sp.key, same.key, edited.key)
+	}
+	db := ScheduledPost{ID: 12, Status: "お知らせ", Schedule: "0 18 * * fri"}
+	if err := db.prepare(tokyo); err != nil || db.key != "db:12" || db.sched == nil {
+		t.Errorf("データベースの予約投稿 = %+v, %v", db, err)
+	}
+
+	for _, bad := range []ScheduledPost{
+		{Status: "日時なし"},
+		{Status: "日付が不正", At: "2024-13-01 18:00"},
+		{Status: "形式が不正", At: "2024/05/01 18:00"},
+		{Status: "スケジュールが不正", Schedule: "every friday"},
+	} {
+		if err := bad.prepare(tokyo); err == nil {
+			t.Errorf("%s がエラーになりません", bad.Status)
+		}
+	}
+}
+
+func TestScheduledPostFiresBetween(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	at := func(s string) time.Time {
+		tm, _ := time.ParseInLocation("2006-01-02 15:04", s, tokyo)
+		return tm
+	}
+	once := ScheduledPost{Status: "一回", At: "2024-05-01 18:00"}
+	weekly := ScheduledPost{Status: "毎週", Schedule: "0 18 * * fri"}
+	both := ScheduledPost{Status: "両方", At: "2024-05-01 12:00", Schedule: "0 18 * * *"}
+	for _, sp := range []*ScheduledPost{&once, &weekly, &both} {
+		if err := sp.prepare(tokyo); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		sp           *ScheduledPost
+		since, until string
+		want         []string
+	}{
+		{&once, "2024-05-01 17:00", "2024-05-01 18:00", []string{"2024-05-01 18:00"}},
+		// sinceちょうどのものは、前の回で投稿済み
+		{&once, "2024-05-01 18:00", "2024-05-01 19:00", nil},
+		{&once, "2024-05-01 16:00", "2024-05-01 17:59", nil},
+		{&weekly, "2024-05-01 00:00", "2024-05-18 00:00", []string{"2024-05-03 18:00", "2024-05-10 18:00", "2024-05-17 18:00"}},
+		{&weekly, "2024-05-03 18:00", "2024-05-04 00:00", nil},
+		{&both, "2024-05-01 00:00", "2024-05-02 00:00", []string{"2024-05-01 12:00", "2024-05-01 18:00"}},
+	}
+	for i, tt := range tests {
+		got := tt.sp.firesBetween(at(tt.since), at(tt.until), tokyo)
+		if len(got) != len(tt.want) {
+			t.Errorf("%d: %s = %v, want %v", i, tt.sp.Status, got, tt.want)
+			continue
+		}
+		for j := range got {
+			if !got[j].Equal(at(tt.want[j])) {
+				t.Errorf("%d: %s = %v, want %v", i, tt.sp.Status, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package mastobots
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secretMinLength より短い値は、ログから伏せない（「***」のような仮の値や、ありふれた短い文字列を伏せてしまわないように）
+const secretMinLength = 6
+
+// resolveSecret は、秘密の値を設定ファイルの書き方に従って取り出す。
+//   - env:VAR      環境変数VARの値
+//   - file:/path   ファイルの中身（末尾の改行は除く）。パスの中の $CREDENTIALS_DIRECTORY などの環境変数は展開する
+//   - それ以外    書かれた値そのもの
+//
+// 取り出した値は、ログに出ないように覚えておく。
+func resolveSecret(v string) (secret string, err error) {
+	switch {
+	case strings.HasPrefix(v, "env:"):
+		name := strings.TrimPrefix(v, "env:")
+		var ok bool
+		if secret, ok = os.LookupEnv(name); !ok {
+			return "", fmt.Errorf("環境変数 %s が設定されていません", name)
+		}
+	case strings.HasPrefix(v, "file:"):
+		path := os.ExpandEnv(strings.TrimPrefix(v, "file:"))
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("ファイル %s が読めません：%s", path, err)
+		}
+		secret = strings.TrimRight(string(b), "\r\n")
+	default:
+		secret = v
+	}
+	logRedactor.add(secret)
+	return
+}
+
+// redactor は、覚えた秘密の値を伏せてからログを書き出す
+type redactor struct {
+	mu       sync.RWMutex
+	out      io.Writer
+	secrets  map[string]bool
+	replacer *strings.Replacer
+}
+
+var logRedactor = &redactor{out: os.Stderr, secrets: make(map[string]bool)}
+
+// add は、伏せる値を覚える
+func (r *redactor) add(secret string) {
+	if len(secret) < secretMinLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.secrets[secret] {
+		return
+	}
+	r.secrets[secret] = true
+	// 長い値から順に伏せる（ある秘密が別の秘密の一部の時に、伏せ残さないように）
+	ss := make([]string, 0, len(r.secrets))
+	for s := range r.secrets {
+		ss = append(ss, s)
+	}
+	sort.Slice(ss, func(i, j int) bool { return len(ss[i]) > len(ss[j]) })
+	pairs := make([]string, 0, len(ss)*2)
+	for _, s := range ss {
+		pairs = append(pairs, s, "[秘密]")
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// redact は、文字列の中の秘密の値を伏せる
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+func (r *redactor) Write(p []byte) (n int, err error) {
+	if _, err = io.WriteString(r.out, r.redact(string(p))); err != nil {
+		return
+	}
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+package mastobots
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	t.Setenv("MASTOBOTS_TEST_TOKEN", "token-from-env")
+	dir := t.TempDir()
+	t.Setenv("CREDENTIALS_DIRECTORY", dir)
+	if err := os.WriteFile(filepath.Join(dir, "token"), []byte("token-from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{"plain-token", "plain-token", false},
+		{"env:MASTOBOTS_TEST_TOKEN", "token-from-env", false},
+		{"env:MASTOBOTS_TEST_UNSET", "", true},
+		{"file:$CREDENTIALS_DIRECTORY/token", "token-from-file", false},
+		{"file:" + filepath.Join(dir, "missing"), "", true},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := resolveSecret(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("resolveSecret(%q) = %q, %v, want %q", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	var buf bytes.Buffer
+	r := &redactor{out: &buf, secrets: make(map[string]bool)}
+	r.add("abc")
+	r.add("secret-token")
+	r.add("secret-token-2")
+	r.Write([]byte("GET /api/v1/streaming?access_token=secret-token-2 failed; Bearer secret-token; abc\n"))
+
+	want := "GET /api/v1/streaming?access_token=[秘密] failed; Bearer [秘密]; abc\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,131 @@
+package mastobots
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// shutdownGrace は、シャットダウンの時に、投稿などの書き込みが終わるのを待つ上限
+const shutdownGrace = 30 * time.Second
+
+// errShuttingDown は、シャットダウンが始まったので新しい書き込みを始めないことを示す
+var errShuttingDown = errors.New("シャットダウン中です")
+
+// inflight は、実行中の書き込み（投稿・ふぁぼ・ブースト・フォロー・通知削除・ネタの仕入れ）を数える
+type inflight struct {
+	mu     sync.Mutex
+	n      int
+	closed bool
+	idle   chan struct{}
+}
+
+// add は、書き込みを一つ始める。シャットダウンが始まっていたらfalseを返す。
+func (f *inflight) add() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.n++
+	return true
+}
+
+// done は、書き込みを一つ終える
+func (f *inflight) done() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.n--
+	if f.n == 0 && f.idle != nil {
+		close(f.idle)
+		f.idle = nil
+	}
+}
+
+// drain は、新しい書き込みを断り、実行中の書き込みが終わるのを待つ。timerが先に切れたらfalseを返す。
+func (f *inflight) drain(timer <-chan time.Time) bool {
+	f.mu.Lock()
+	f.closed = true
+	if f.n == 0 {
+		f.mu.Unlock()
+		return true
+	}
+	if f.idle == nil {
+		f.idle = make(chan struct{})
+	}
+	idle := f.idle
+	f.mu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-timer:
+		return false
+	}
+}
+
+// inflightKey は、既にbeginで数えている書き込みのコンテキストにつける印
+type inflightKey struct{}
+
+// begin は、シャットダウンの時に待ってもらう書き込みを始める。
+// ctxが既に終わっていたら始めない。始めた書き込みは、ctxが終わっても最後までやり通せるよう、キャンセルされないコンテキストで行う。
+// beginで得たコンテキストの中でさらにbeginしても、二重には数えない。
+func (bot *Persona) begin(ctx context.Context) (wctx context.Context, done func(), err error) {
+	if ctx.Value(inflightKey{}) != nil {
+		return ctx, func() {}, nil
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	wctx = context.WithValue(context.WithoutCancel(ctx), inflightKey{}, true)
+	if bot.commonSettings == nil {
+		return wctx, func() {}, nil
+	}
+	if !bot.commonSettings.inflight.add() {
+		return nil, nil, errShuttingDown
+	}
+	return wctx, bot.commonSettings.inflight.done, nil
+}
+
+// shutdown は、起きているbotにGoodbyeを投稿させ、実行中の書き込みが終わるのをshutdownGraceまで待つ
+func (r *roster) shutdown(clk Clock) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, rb := range r.running {
+		bot := rb.bot
+		if bot.Goodbye == "" || !bot.awake.Load() {
+			continue
+		}
+		ctx, done, err := bot.begin(context.Background())
+		if err != nil {
+			continue
+		}
+		bot.goSafe("goodbye", func() {
+			defer done()
+			if err := bot.post(ctx, mastodon.Toot{Status: bot.fillCalendar(bot.Goodbye)}); err != nil {
+				log.Printf("info: %s がお別れのトゥートに失敗しました", bot.Name)
+			}
+		})
+	}
+
+	t := clk.NewTimer(shutdownGrace)
+	defer t.Stop()
+	drained := make(map[*commonSettings]bool)
+	for _, rb := range r.running {
+		cmn := rb.bot.commonSettings
+		if cmn == nil || drained[cmn] {
+			continue
+		}
+		drained[cmn] = true
+		log.Printf("info: 投稿などの書き込みが終わるのを待っています")
+		if !cmn.inflight.drain(t.Chan()) {
+			log.Printf("alert: %s 待っても書き込みが終わらなかったので、諦めて終了します", shutdownGrace)
+			return
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package mastobots
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestInflightDrain(t *testing.T) {
+	var f inflight
+	if !f.add() || !f.add() {
+		t.Fatal("書き込みを始められません")
+	}
+	result := make(chan bool)
+	go func() { result <- f.drain(nil) }()
+
+	f.done()
+	select {
+	case <-result:
+		t.Fatal("書き込みが残っているのにdrainが戻りました")
+	case <-time.After(20 * time.Millisecond):
+	}
+	f.done()
+	if ok := <-result; !ok {
+		t.Error("drain() = false, want true")
+	}
+	if f.add() {
+		t.Error("シャットダウン後に書き込みを始められてしまいました")
+	}
+
+	var g inflight
+	g.add()
+	timer := make(chan time.Time, 1)
+	timer <- time.Now()
+	if g.drain(timer) {
+		t.Error("期限切れなのに drain() = true")
+	}
+}
+
+func TestBeginAfterCancel(t *testing.T) {
+	bot := &Persona{Name: "alice", commonSettings: &commonSettings{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	wctx, done, err := bot.begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if wctx.Err() != nil {
+		t.Error("始めた書き込みのコンテキストがキャンセルされました")
+	}
+	// 数えている書き込みの中の書き込みは、二重に数えない
+	if _, inner, err := bot.begin(wctx); err != nil {
+		t.Errorf("入れ子のbegin: %s", err)
+	} else {
+		inner()
+	}
+	done()
+	if _, _, err := bot.begin(ctx); err == nil {
+		t.Error("終わったコンテキストで書き込みを始められてしまいました")
+	}
+	if !bot.commonSettings.inflight.drain(nil) {
+		t.Error("書き込みが残っています")
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) { bot.Goodbye = "またね_date_" })
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- activateBots(ctx, []*Persona{bot}, db, 0, clk, nil, nil) }()
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 1 }) {
+		cancel()
+		t.Fatal("起きませんでした")
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("終了の合図を受けてもシャットダウンしませんでした")
+	}
+	posted := srv.Posted("alice")
+	if len(posted) != 1 || !strings.Contains(posted[0].Content, "またね5月1日") {
+		t.Errorf("お別れのトゥートが投稿されていません：%v", posted)
+	}
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 0 }) {
+		t.Error("シャットダウン後もストリーミングの接続が残っています")
+	}
+}
+
+func TestPauseStopsOnCancel(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) { bot.commonSettings.sendPause = time.Second })
+	st := srv.AddStatus(mastodon.Status{Content: "<p>hello</p>"})
+
+	// 送る前の間を置いている間に終わったら、待ち切らずに送るのをやめる
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() { result <- bot.fav(ctx, st.ID) }()
+	clk.waitForTimers(t, 1)
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("fav() = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("キャンセルしても間を置き続けています")
+	}
+	if fs := srv.Favourited("alice"); len(fs) != 0 {
+		t.Errorf("やめたはずのふぁぼを送りました：%v", fs)
+	}
+	// 間を置き終えたら送る
+	go func() { result <- bot.fav(context.Background(), st.ID) }()
+	clk.waitForTimers(t, 1)
+	clk.Advance(3 * time.Second)
+	if err := <-result; err != nil || len(srv.Favourited("alice")) != 1 {
+		t.Errorf("fav() = %v、ふぁぼ %v", err, srv.Favourited("alice"))
+	}
+}
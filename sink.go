@@ -0,0 +1,216 @@
+package mastobots
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// SinkSettings は、dry-runの時に投稿等を送る先を格納する。Typeは log、jsonl、html のいずれか。
+type SinkSettings struct {
+	Type string
+	Path string
+}
+
+// Action は、dry-runの時に実際には行わなかった投稿・ふぁぼ・ブースト・フォロー・通知削除を記録する
+type Action struct {
+	Time        time.Time `json:"time"`
+	Bot         string    `json:"bot"`
+	Kind        string    `json:"kind"`
+	Status      string    `json:"status,omitempty"`
+	Visibility  string    `json:"visibility,omitempty"`
+	SpoilerText string    `json:"spoiler_text,omitempty"`
+	Language    string    `json:"language,omitempty"`
+	InReplyToID string    `json:"in_reply_to_id,omitempty"`
+	Media       []string  `json:"media,omitempty"`
+	TargetID    string    `json:"target_id,omitempty"`
+}
+
+// Sink は、dry-runの時にActionを受け取る
+type Sink interface {
+	Record(a Action) error
+}
+
+// newSink は、設定に応じたSinkを作る。Typeが空ならログに出す。
+func newSink(ss SinkSettings) (s Sink, err error) {
+	switch strings.ToLower(ss.Type) {
+	case "", "log":
+		s = logSink{}
+	case "jsonl":
+		path := ss.Path
+		if path == "" {
+			path = "dryrun.jsonl"
+		}
+		s = &jsonlSink{path: path}
+	case "html":
+		path := ss.Path
+		if path == "" {
+			path = "dryrun.html"
+		}
+		s = &htmlSink{path: path}
+	default:
+		err = fmt.Errorf("dry-runの出力先 %s はありません。log、jsonl、html のいずれかにしてください", ss.Type)
+	}
+	return
+}
+
+// logSink は、Actionをログに出す
+type logSink struct{}
+
+func (logSink) Record(a Action) error {
+	switch a.Kind {
+	case "post":
+		log.Printf("info: [dry-run] %s のトゥート（%s）：\n%s", a.Bot, a.Visibility, a.Status)
+	case "media":
+		log.Printf("info: [dry-run] %s のメディアアップロード：%s", a.Bot, strings.Join(a.Media, ", "))
+	default:
+		log.Printf("info: [dry-run] %s の %s：id:%s", a.Bot, a.Kind, a.TargetID)
+	}
+	return nil
+}
+
+// jsonlSink は、Actionを一行ずつJSONでファイルに追記する
+type jsonlSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (s *jsonlSink) Record(a Action) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fl, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer fl.Close()
+	return json.NewEncoder(fl).Encode(a)
+}
+
+// htmlSinkMax は、htmlSinkのプレビューページに載せるActionの数の上限。これより古いものは載せない。
+const htmlSinkMax = 500
+
+// htmlSink は、これまでのActionを新しい順に、htmlSinkMaxまで並べたプレビューページを書き出す
+type htmlSink struct {
+	mu      sync.Mutex
+	path    string
+	actions []Action
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="ja">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>mastobots dry-run</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 1em auto; background: #eee; }
+.action { background: #fff; border-radius: 6px; padding: 0.8em; margin: 0.8em 0; }
+.meta { color: #777; font-size: 0.85em; }
+.status { white-space: pre-wrap; }
+.cw { color: #a33; }
+</style>
+</head>
+<body>
+<h1>mastobots dry-run</h1>
+{{range .}}<div class="action">
+<div class="meta">{{.Time.Format "2006-01-02 15:04:05 MST"}} ・ {{.Bot}} ・ {{.Kind}}{{if .Visibility}} ・ {{.Visibility}}{{end}}{{if .InReplyToID}} ・ 返信先 {{.InReplyToID}}{{end}}{{if .TargetID}} ・ id:{{.TargetID}}{{end}}</div>
+{{if .SpoilerText}}<div class="cw">CW: {{.SpoilerText}}</div>{{end}}
+{{if .Status}}<div class="status">{{.Status}}</div>{{end}}
+{{range .Media}}<div class="meta">📎 {{.}}</div>{{end}}
+</div>
+{{end}}</body>
+</html>
+`))
+
+func (s *htmlSink) Record(a Action) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actions = append([]Action{a}, s.actions...)
+	if len(s.actions) > htmlSinkMax {
+		s.actions = s.actions[:htmlSinkMax]
+	}
+
+	tmp := s.path + ".tmp"
+	fl, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	if err = previewTemplate.Execute(fl, s.actions); err != nil {
+		fl.Close()
+		return
+	}
+	if err = fl.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// recordDryRun は、実際には行わない操作をSinkに送る
+func (bot *Persona) recordDryRun(a Action) {
+	a.Time = bot.clock().Now()
+	a.Bot = bot.Name
+	var s Sink = logSink{}
+	if bot.commonSettings != nil && bot.commonSettings.sink != nil {
+		s = bot.commonSettings.sink
+	}
+	if err := s.Record(a); err != nil {
+		log.Printf("info: %s のdry-runの記録に失敗しました：%s", bot.Name, err)
+	}
+}
+
+// dryRunItemKey は、dry-runで使ったアイテムを、dryRunFiredに覚えておくためのキー
+func dryRunItemKey(id int) string {
+	return fmt.Sprintf("item:%d", id)
+}
+
+// dryRunUsed は、dry-runでアイテムidを既に使ったかどうかを返す
+func (bot *Persona) dryRunUsed(id int) bool {
+	_, used := bot.dryRunFired.Load(dryRunItemKey(id))
+	return used
+}
+
+// dryRunPost は、トゥートをSinkに送り、投稿されたことにしたステータスを返す
+func (bot *Persona) dryRunPost(toot mastodon.Toot) (st *mastodon.Status) {
+	a := Action{
+		Kind:        "post",
+		Status:      toot.Status,
+		Visibility:  toot.Visibility,
+		SpoilerText: toot.SpoilerText,
+		Language:    toot.Language,
+		InReplyToID: string(toot.InReplyToID),
+	}
+	for _, id := range toot.MediaIDs {
+		a.Media = append(a.Media, string(id))
+	}
+	bot.recordDryRun(a)
+	return &mastodon.Status{
+		ID:          mastodon.ID(fmt.Sprintf("dry-run-%d", bot.clock().Now().UnixNano())),
+		Content:     toot.Status,
+		Visibility:  toot.Visibility,
+		SpoilerText: toot.SpoilerText,
+	}
+}
+
+// uploadMedia は、メディアをアップロードする。dry-runの時はファイル名をIDの代わりにする。
+func (bot *Persona) uploadMedia(ctx context.Context, path string) (id mastodon.ID, err error) {
+	if bot.DryRun {
+		if _, err = os.Stat(path); err != nil {
+			return
+		}
+		bot.recordDryRun(Action{Kind: "media", Media: []string{path}})
+		return mastodon.ID(path), nil
+	}
+	att, err := bot.Client.UploadMedia(ctx, path)
+	if err != nil {
+		return
+	}
+	return att.ID, nil
+}
@@ -0,0 +1,44 @@
+package mastobots
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestHTMLSinkCap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dryrun.html")
+	s := &htmlSink{path: path}
+	for i := 0; i < htmlSinkMax+10; i++ {
+		if err := s.Record(Action{Kind: "post", Status: fmt.Sprintf("toot-%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(s.actions) != htmlSinkMax {
+		t.Fatalf("残ったAction = %d, want %d", len(s.actions), htmlSinkMax)
+	}
+	// 新しいものが先頭に残り、古いものから落ちる
+	if got := s.actions[0].Status; got != fmt.Sprintf("toot-%d", htmlSinkMax+9) {
+		t.Errorf("先頭 = %s", got)
+	}
+	page, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(page), ">toot-9<") || !strings.Contains(string(page), ">toot-10<") {
+		t.Error("プレビューページに上限より古いActionが残っています")
+	}
+}
+
+func TestDryRunUsed(t *testing.T) {
+	bot := &Persona{Name: "test", DryRun: true}
+	if bot.dryRunUsed(3) {
+		t.Fatal("まだ使っていないアイテムが使ったことになっています")
+	}
+	bot.dryRunFired.Store(dryRunItemKey(3), true)
+	if !bot.dryRunUsed(3) || bot.dryRunUsed(4) {
+		t.Error("dry-runで使ったアイテムを正しく覚えていません")
+	}
+}
@@ -0,0 +1,190 @@
+package mastobots
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// streamMode は、タイムラインを受け取る方法
+type streamMode int
+
+const (
+	modeWebSocket streamMode = iota // WebSocketのストリーミング
+	modeSSE                         // HTTPのServer-Sent Eventsのストリーミング
+	modePoll                        // REST APIで定期的に取得
+)
+
+// streamModeNames は、設定ファイルの Streaming に書く名前と、受け取る方法の対応
+var streamModeNames = map[string]streamMode{
+	"":          modeWebSocket,
+	"websocket": modeWebSocket,
+	"sse":       modeSSE,
+	"poll":      modePoll,
+}
+
+func (m streamMode) String() string {
+	switch m {
+	case modeSSE:
+		return "SSE"
+	case modePoll:
+		return "ポーリング"
+	}
+	return "WebSocket"
+}
+
+const (
+	// streamFallbackAfter 回続けて何も受け取れずに切れたら、次の受け取り方（WebSocket→SSE→ポーリング）に切り替える
+	streamFallbackAfter = 3
+	// pollInterval は、ポーリングでタイムラインを取得する間隔
+	pollInterval = time.Minute
+	// streamRetryAfter は、ポーリングに切り替えてから、設定した受け取り方をもう一度試すまでの時間
+	streamRetryAfter = 30 * time.Minute
+	// sseMaxLine は、SSEの一行の長さの上限
+	sseMaxLine = 1 << 20
+)
+
+// streamMode は、botがタイムラインを最初に受け取る方法を返す
+func (bot *Persona) streamMode() streamMode {
+	return streamModeNames[bot.Streaming]
+}
+
+// openStreamingは、タイムラインtlのストリーミング接続を、modeの方法で開始する。失敗したらmaxRetryを上限に再試行する。
+func (bot *Persona) openStreaming(ctx context.Context, tl Timeline, mode streamMode) (evch chan mastodon.Event, err error) {
+	err = bot.retry(ctx, tl.name()+"のストリーミング受信開始", func() (err error) {
+		if mode == modeSSE {
+			evch, err = bot.streamSSE(ctx, tl)
+			return
+		}
+		wsc := bot.Client.NewWSClient()
+		switch tl.Type {
+		case "local", "public":
+			evch, err = wsc.StreamingWSPublic(ctx, tl.Type == "local")
+		case "hashtag":
+			evch, err = wsc.StreamingWSHashtag(ctx, tl.Tag, tl.Local)
+		case "list":
+			evch, err = wsc.StreamingWSList(ctx, mastodon.ID(tl.List))
+		default:
+			evch, err = wsc.StreamingWSUser(ctx)
+		}
+		return
+	})
+	if err == nil {
+		log.Printf("trace: %s の%sの%s受信に成功しました", bot.Name, tl.name(), mode)
+	}
+	return
+}
+
+// ssePath は、タイムラインtlのSSEストリーミングのパスとパラメータを返す
+func (tl Timeline) ssePath() (p string, params url.Values) {
+	params = url.Values{}
+	switch tl.Type {
+	case "local":
+		p = "public/local"
+	case "public":
+		p = "public"
+	case "hashtag":
+		p = "hashtag"
+		if tl.Local {
+			p = "hashtag/local"
+		}
+		params.Set("tag", tl.Tag)
+	case "list":
+		p = "list"
+		params.Set("list", tl.List)
+	default:
+		p = "user"
+	}
+	return
+}
+
+// streamSSE は、タイムラインtlをServer-Sent Eventsで受信する。接続が切れたらチャネルを閉じる。
+// go-mastodonのStreamingUserなどは、切れても黙ってつなぎ直してしまい、取りこぼしを取り戻す機会がないので使わない。
+func (bot *Persona) streamSSE(ctx context.Context, tl Timeline) (evch chan mastodon.Event, err error) {
+	u, err := url.Parse(bot.Instance)
+	if err != nil {
+		return
+	}
+	p, params := tl.ssePath()
+	u.Path = path.Join(u.Path, "/api/v1/streaming", p)
+	u.RawQuery = params.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+bot.AccessToken)
+	req.Header.Set("Accept", "text/event-stream")
+
+	// ストリーミングはレート制限の対象外なので、botのTransportを通さない
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, &mastodon.APIError{Message: e.Error, StatusCode: resp.StatusCode}
+	}
+
+	evch = make(chan mastodon.Event)
+	go func() {
+		defer close(evch)
+		defer resp.Body.Close()
+		sc := bufio.NewScanner(resp.Body)
+		sc.Buffer(make([]byte, 0, 64*1024), sseMaxLine)
+		var name string
+		var data []string
+		for sc.Scan() {
+			line := sc.Text()
+			switch {
+			case line == "":
+				if ev := sseEvent(name, strings.Join(data, "\n")); ev != nil {
+					evch <- ev
+				}
+				name, data = "", nil
+			case strings.HasPrefix(line, "event:"):
+				name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+			case strings.HasPrefix(line, "data:"):
+				data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+			}
+		}
+		err := sc.Err()
+		if err == nil {
+			err = fmt.Errorf("サーバが接続を閉じました")
+		}
+		evch <- &mastodon.ErrorEvent{Err: err}
+	}()
+	return
+}
+
+// sseEvent は、SSEの一つのイベントを、go-mastodonのイベントに変換する。反応しないイベントならnilを返す。
+func sseEvent(name, data string) mastodon.Event {
+	var err error
+	switch name {
+	case "update":
+		var st mastodon.Status
+		if err = json.Unmarshal([]byte(data), &st); err == nil {
+			return &mastodon.UpdateEvent{Status: &st}
+		}
+	case "notification":
+		var n mastodon.Notification
+		if err = json.Unmarshal([]byte(data), &n); err == nil {
+			return &mastodon.NotificationEvent{Notification: &n}
+		}
+	default:
+		return nil
+	}
+	return &mastodon.ErrorEvent{Err: err}
+}
@@ -0,0 +1,200 @@
+package mastobots
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestSSEEvent(t *testing.T) {
+	if ev, ok := sseEvent("update", `{"id":"5","content":"<p>hi</p>"}`).(*mastodon.UpdateEvent); !ok || ev.Status.ID != "5" {
+		t.Errorf("update = %#v", ev)
+	}
+	if ev, ok := sseEvent("notification", `{"id":"6","type":"mention"}`).(*mastodon.NotificationEvent); !ok || ev.Notification.Type != "mention" {
+		t.Errorf("notification = %#v", ev)
+	}
+	if _, ok := sseEvent("update", `{`).(*mastodon.ErrorEvent); !ok {
+		t.Error("壊れたJSONがエラーになりません")
+	}
+	if ev := sseEvent("delete", "5"); ev != nil {
+		t.Errorf("delete = %#v, want nil", ev)
+	}
+}
+
+func TestSSEPath(t *testing.T) {
+	tests := []struct {
+		tl   Timeline
+		want string
+	}{
+		{Timeline{Type: "home"}, "user?"},
+		{Timeline{Type: "local"}, "public/local?"},
+		{Timeline{Type: "public"}, "public?"},
+		{Timeline{Type: "hashtag", Tag: "coffee", Local: true}, "hashtag/local?tag=coffee"},
+		{Timeline{Type: "list", List: "12"}, "list?list=12"},
+	}
+	for _, tt := range tests {
+		p, params := tt.tl.ssePath()
+		if got := p + "?" + params.Encode(); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.tl.name(), got, tt.want)
+		}
+	}
+}
+
+// advanceUntil は、condが真になるまで、実時間でtimeoutを上限に、fakeClockをstepずつ進める
+func advanceUntil(clk *fakeClock, step, timeout time.Duration, cond func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		clk.Advance(step)
+		time.Sleep(20 * time.Millisecond)
+	}
+	return cond()
+}
+
+// sseStreams は、SSEのストリーミングへのリクエストの数を返す
+func sseStreams(srv *mastotest.Server) (n int) {
+	for _, r := range srv.Requests() {
+		if strings.HasPrefix(r.Path, "/api/v1/streaming/") {
+			n++
+		}
+	}
+	return
+}
+
+func TestIntegrationStreamingFallback(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.Keywords = []string{"coffee"}
+		bot.Comments = []string{"_keyword1_!"}
+	})
+	human := mastodon.Account{ID: "7", Username: "human", Acct: "human@example.com"}
+
+	// WebSocketが通らなければ、SSEに切り替える
+	srv.Fail("GET", "/api/v1/streaming", 403, 1000)
+	stop := runBots(t, clk, db, 24*60, bot)
+	if !advanceUntil(clk, 30*time.Second, 5*time.Second, func() bool { return srv.Streams("alice") == 1 }) {
+		stop()
+		t.Fatal("SSEに切り替えませんでした")
+	}
+	if sseStreams(srv) == 0 {
+		stop()
+		t.Fatal("SSEのストリーミングを使っていません")
+	}
+	st1 := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Morning coffee</p>"})
+	if !srv.WaitFor(parseWait, func() bool { return len(srv.Favourited("alice")) == 1 }) {
+		stop()
+		t.Fatal("SSEで受け取ったトゥートに反応しませんでした")
+	}
+
+	// SSEも通らなくなったら、ポーリングに切り替える
+	srv.Fail("GET", "/api/v1/streaming/user", 403, 1000)
+	srv.DisconnectStreams("alice")
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 0 }) {
+		stop()
+		t.Fatal("切断できませんでした")
+	}
+	st2 := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Afternoon coffee</p>"})
+	// 切断中のトゥートは再接続を試みるたびに取り戻すので、切り替えた後のトゥートでポーリングを確かめる
+	ok := advanceUntil(clk, 5*time.Second, parseWait, func() bool { return len(srv.Favourited("alice")) == 2 })
+	ok = ok && srv.WaitFor(5*time.Second, func() bool { return sseStreams(srv) >= 1+streamFallbackAfter })
+	time.Sleep(100 * time.Millisecond)
+	st3 := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Evening coffee</p>"})
+	ok = ok && advanceUntil(clk, 5*time.Second, parseWait, func() bool { return len(srv.Favourited("alice")) == 3 })
+	stop()
+
+	if !ok {
+		t.Fatalf("ポーリングでトゥートに反応しませんでした：ふぁぼ %v", srv.Favourited("alice"))
+	}
+	want := []mastodon.ID{st1.ID, st2.ID, st3.ID}
+	for i, id := range srv.Favourited("alice") {
+		if id != want[i] {
+			t.Errorf("ふぁぼったのは %v, want %v", srv.Favourited("alice"), want)
+			break
+		}
+	}
+}
+
+// requestsTo は、pathへのGETリクエストの数を返す
+func requestsTo(srv *mastotest.Server, path string) (n int) {
+	for _, r := range srv.Requests() {
+		if r.Method == "GET" && r.Path == path {
+			n++
+		}
+	}
+	return
+}
+
+func TestIntegrationPollSeedsLater(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.Keywords = []string{"coffee"}
+		bot.Comments = []string{"_keyword1_!"}
+		bot.Streaming = "poll"
+	})
+	human := mastodon.Account{ID: "7", Username: "human", Acct: "human@example.com"}
+
+	// 起動した時にタイムラインが取得できなくても、取得できるようになったらポーリングで反応する
+	srv.Fail("GET", "/api/v1/timelines/home", 503, bot.commonSettings.maxRetry)
+	stop := runBots(t, clk, db, 24*60, bot)
+	if !advanceUntil(clk, 10*time.Second, 5*time.Second, func() bool {
+		return requestsTo(srv, "/api/v1/timelines/home") > bot.commonSettings.maxRetry
+	}) {
+		stop()
+		t.Fatal("タイムラインを取得し直しませんでした")
+	}
+	st := srv.PushStatus("alice", mastodon.Status{Account: human, Content: "<p>Morning coffee</p>"})
+	ok := advanceUntil(clk, 10*time.Second, parseWait, func() bool { return len(srv.Favourited("alice")) == 1 })
+	stop()
+
+	if !ok {
+		t.Fatal("ポーリングでトゥートに反応しませんでした")
+	}
+	if got := srv.Favourited("alice"); got[0] != st.ID {
+		t.Errorf("ふぁぼったのは %v, want [%s]", got, st.ID)
+	}
+}
+
+func TestIntegrationStreamingRetriesAfterPoll(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+	bot := integrationBot(t, srv, clk, "alice", nil)
+
+	// WebSocketもSSEも一時的に通らなければポーリングに切り替え、しばらくしたらWebSocketをもう一度試す
+	srv.Fail("GET", "/api/v1/streaming", 403, streamFallbackAfter)
+	srv.Fail("GET", "/api/v1/streaming/user", 403, streamFallbackAfter)
+	stop := runBots(t, clk, db, 24*60, bot)
+	polled := advanceUntil(clk, 10*time.Second, 10*time.Second, func() bool {
+		return sseStreams(srv) == streamFallbackAfter && requestsTo(srv, "/api/v1/notifications") > 1
+	})
+	polling := clk.Now()
+	reconnected := polled && advanceUntil(clk, time.Minute, 10*time.Second, func() bool { return srv.Streams("alice") == 1 })
+	stop()
+
+	if !polled {
+		t.Fatal("ポーリングに切り替えませんでした")
+	}
+	if !reconnected {
+		t.Fatal("WebSocketをもう一度試しませんでした")
+	}
+	if d := clk.Now().Sub(polling); d < streamRetryAfter-time.Minute {
+		t.Errorf("ポーリングに切り替えて %s でWebSocketを試しました, want %s", d, streamRetryAfter)
+	}
+	if n := requestsTo(srv, "/api/v1/streaming"); n != streamFallbackAfter+1 {
+		t.Errorf("WebSocketへのリクエスト %d 件, want %d", n, streamFallbackAfter+1)
+	}
+}
@@ -0,0 +1,185 @@
+package mastobots
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// 太陽の高度による薄明の定義（度）
+var twilightAngles = map[string]float64{
+	"sunrise":      -0.833, // 日の出・日の入り（大気差と視半径を考慮）
+	"civil":        -6,     // 市民薄明
+	"nautical":     -12,    // 航海薄明
+	"astronomical": -18,    // 天文薄明
+}
+
+// SunTimes は、ある一日の太陽の動きを格納する
+type SunTimes struct {
+	Rise       time.Time // 太陽高度が指定の角度を上回る時刻
+	Set        time.Time // 太陽高度が指定の角度を下回る時刻
+	Noon       time.Time // 南中時刻
+	PolarDay   bool      // 一日中、太陽高度が指定の角度を下回らない（白夜）
+	PolarNight bool      // 一日中、太陽高度が指定の角度を上回らない（極夜）
+}
+
+// twilightAngle は、薄明の種類に対応する太陽高度を返す。空文字列は市民薄明とみなす。
+func twilightAngle(twilight string) (angle float64, err error) {
+	if twilight == "" {
+		twilight = "civil"
+	}
+	angle, ok := twilightAngles[strings.ToLower(twilight)]
+	if !ok {
+		err = fmt.Errorf("%s という薄明の定義はありません", twilight)
+	}
+	return
+}
+
+const (
+	jdUnixEpoch = 2440587.5 // 1970-01-01T00:00:00Zのユリウス日
+	jdJ2000     = 2451545.0 // 2000-01-01T12:00:00Zのユリウス日
+	obliquity   = 23.4397   // 黄道傾斜角（度）
+)
+
+func julianDay(t time.Time) float64 {
+	return float64(t.Unix())/86400 + jdUnixEpoch
+}
+
+func timeFromJulianDay(jd float64) time.Time {
+	sec := (jd - jdUnixEpoch) * 86400
+	return time.Unix(0, int64(sec*float64(time.Second))).UTC()
+}
+
+func sinDeg(d float64) float64 { return math.Sin(d * math.Pi / 180) }
+func cosDeg(d float64) float64 { return math.Cos(d * math.Pi / 180) }
+
+// solarCoordinates は、J2000からの日数に対する平均近点角と太陽黄経、赤緯（いずれも度）を返す
+func solarCoordinates(days float64) (m, lambda, dec float64) {
+	m = math.Mod(357.5291+0.98560028*days, 360)
+	c := 1.9148*sinDeg(m) + 0.0200*sinDeg(2*m) + 0.0003*sinDeg(3*m)
+	lambda = math.Mod(m+c+180+102.9372, 360)
+	dec = math.Asin(sinDeg(lambda)*sinDeg(obliquity)) * 180 / math.Pi
+	return
+}
+
+// sunTimes は、dateが示す日（dateのタイムゾーンにおける日付）の太陽の動きを計算する。
+// angleは、起床・就寝の基準とする太陽高度（度）。
+func sunTimes(date time.Time, lat, lng, angle float64) (st SunTimes) {
+	y, mo, d := date.Date()
+	localNoon := time.Date(y, mo, d, 12, 0, 0, 0, date.Location())
+
+	// その日の南中に対応するJ2000からの日数
+	n := math.Round(julianDay(localNoon) - jdJ2000 + lng/360)
+	jStar := n - lng/360
+	m, lambda, dec := solarCoordinates(jStar)
+	transit := jdJ2000 + jStar + 0.0053*sinDeg(m) - 0.0069*sinDeg(2*lambda)
+	st.Noon = timeFromJulianDay(transit).In(date.Location())
+
+	// 南中時と南中の12時間後の太陽高度から、白夜・極夜を判定
+	highest := 90 - math.Abs(lat-dec)
+	lowest := math.Abs(lat+dec) - 90
+	switch {
+	case highest < angle:
+		st.PolarNight = true
+		return
+	case lowest > angle:
+		st.PolarDay = true
+		return
+	}
+
+	cosH := (sinDeg(angle) - sinDeg(lat)*sinDeg(dec)) / (cosDeg(lat) * cosDeg(dec))
+	h := math.Acos(math.Max(-1, math.Min(1, cosH))) * 180 / math.Pi
+	st.Rise = timeFromJulianDay(transit - h/360).In(date.Location())
+	st.Set = timeFromJulianDay(transit + h/360).In(date.Location())
+	return
+}
+
+// getDayCycleBySunMovement は、太陽の出入り時刻と現在時刻nowに応じて寝起きの時刻を返す
+func getDayCycleBySunMovement(now time.Time, loc *time.Location, lat, lng float64, twilight string) (sleep, active time.Duration, cond string, err error) {
+	wt, st, err := getSleepWakeTimeBySunMovement(now, loc, lat, lng, twilight)
+	if err != nil {
+		return
+	}
+
+	if wt.IsZero() {
+		sleep = st.Sub(now)
+		active = 0
+		cond = "極夜"
+		return
+	}
+
+	if st.IsZero() {
+		sleep = 0
+		active = wt.Sub(now)
+		cond = "白夜"
+		return
+	}
+
+	sleep = wt.Sub(now)
+	tillSleep := st.Sub(now)
+	active = st.Sub(wt)
+	if active < 0 {
+		active += 24 * time.Hour
+	}
+	if active > tillSleep {
+		sleep = 0
+		active = tillSleep
+	}
+
+	return
+}
+
+// getSleepWakeTimeBySunMovement は、太陽の出入り時刻と現在時刻nowに応じて寝起きの時刻を返す
+func getSleepWakeTimeBySunMovement(now time.Time, loc *time.Location, lat, lng float64, twilight string) (wt, st time.Time, err error) {
+	angle, err := twilightAngle(twilight)
+	if err != nil {
+		return
+	}
+
+	now = now.In(loc)
+
+	days := [...]SunTimes{
+		sunTimes(now, lat, lng, angle),
+		sunTimes(now.AddDate(0, 0, 1), lat, lng, angle),
+	}
+
+	for _, day := range days {
+		if day.PolarDay || day.PolarNight {
+			wt, st = getExtremeCycle(days, now, day.PolarDay)
+			return
+		}
+	}
+
+	wt = days[0].Rise
+	st = days[0].Set
+	if wt.Before(now) {
+		wt = days[1].Rise
+	}
+	if st.Before(now) {
+		st = days[1].Set
+	}
+
+	return
+}
+
+// getExtremeCycle は、白夜あるいは極夜の生活サイクルを返す
+func getExtremeCycle(days [2]SunTimes, now time.Time, isWhite bool) (wt, st time.Time) {
+	if isWhite {
+		// wtを１日で最も暗い時刻に設定
+		wt = days[0].Noon.Add(12 * time.Hour)
+		if wt.Before(now) {
+			wt = days[1].Noon.Add(12 * time.Hour)
+		}
+		st = time.Time{}
+	} else {
+		// stを１日で最も明るい時刻に設定
+		wt = time.Time{}
+		st = days[0].Noon
+		if st.Before(now) {
+			st = days[1].Noon
+		}
+	}
+
+	return
+}
@@ -0,0 +1,91 @@
+package mastobots
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDayCycleBySunMovementTokyo(t *testing.T) {
+	tokyo := mustLoadLocation(t, "Asia/Tokyo")
+	lat, lng := 35.6812, 139.7671
+
+	// 夜明け前：日の出（4時25分ごろ）まで眠り、日の入り（19時ごろ）まで起きている
+	now := time.Date(2024, 6, 21, 3, 0, 0, 0, tokyo)
+	sleep, active, cond, err := getDayCycleBySunMovement(now, tokyo, lat, lng, "sunrise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cond != "" {
+		t.Errorf("cond = %q, want empty", cond)
+	}
+	if sleep < time.Hour || sleep > 2*time.Hour {
+		t.Errorf("sleep = %s, want 1h〜2h", sleep)
+	}
+	if active < 14*time.Hour || active > 15*time.Hour {
+		t.Errorf("active = %s, want 14h〜15h", active)
+	}
+
+	// 日の入り後：日付をまたいで翌日の日の出まで眠る
+	now = time.Date(2024, 6, 21, 23, 0, 0, 0, tokyo)
+	sleep, _, _, err = getDayCycleBySunMovement(now, tokyo, lat, lng, "sunrise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wake := now.Add(sleep); wake.Day() != 22 || wake.Hour() != 4 {
+		t.Errorf("起床時刻 = %s, want 6月22日の4時台", wake)
+	}
+
+	// 昼間：起きたまま日の入りまで活動する
+	now = time.Date(2024, 6, 21, 12, 0, 0, 0, tokyo)
+	sleep, active, _, err = getDayCycleBySunMovement(now, tokyo, lat, lng, "sunrise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sleep != 0 {
+		t.Errorf("sleep = %s, want 0", sleep)
+	}
+	sunset := time.Date(2024, 6, 21, 19, 0, 0, 0, tokyo)
+	if end := now.Add(active); end.Sub(sunset).Abs() > 10*time.Minute {
+		t.Errorf("就寝時刻 = %s, want 19時ごろ", end)
+	}
+}
+
+func TestDayCycleBySunMovementPolar(t *testing.T) {
+	tromso := mustLoadLocation(t, "Europe/Oslo")
+	lat, lng := 69.6492, 18.9553
+
+	// 白夜：眠らず、一日で最も暗い時刻まで活動する
+	now := time.Date(2024, 6, 21, 12, 0, 0, 0, tromso)
+	sleep, active, cond, err := getDayCycleBySunMovement(now, tromso, lat, lng, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cond != "白夜" || sleep != 0 {
+		t.Errorf("cond, sleep = %q, %s, want 白夜, 0", cond, sleep)
+	}
+	if active <= 0 || active > 24*time.Hour {
+		t.Errorf("active = %s, want 0〜24h", active)
+	}
+
+	// 極夜：起きず、一日で最も明るい時刻まで眠る
+	now = time.Date(2024, 12, 21, 23, 0, 0, 0, tromso)
+	sleep, active, cond, err = getDayCycleBySunMovement(now, tromso, lat, lng, "sunrise")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cond != "極夜" || active != 0 {
+		t.Errorf("cond, active = %q, %s, want 極夜, 0", cond, active)
+	}
+	if noon := now.Add(sleep); noon.Day() != 22 || noon.Hour() != 11 && noon.Hour() != 12 {
+		t.Errorf("南中時刻 = %s, want 12月22日の昼", noon)
+	}
+}
+
+func TestTwilightAngle(t *testing.T) {
+	if a, err := twilightAngle(""); err != nil || a != -6 {
+		t.Errorf("twilightAngle(\"\") = %v, %v, want -6", a, err)
+	}
+	if _, err := twilightAngle("golden"); err == nil {
+		t.Error("未知の薄明がエラーになりませんでした")
+	}
+}
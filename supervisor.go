@@ -0,0 +1,200 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// restartBackoffMin は、パニックした仕事を最初に再開するまでの待ち時間。続けてパニックするたびに倍にする。
+	restartBackoffMin = time.Second
+	// restartBackoffMax は、再開までの待ち時間の上限
+	restartBackoffMax = 5 * time.Minute
+	// restartBackoffReset より長く動いてからパニックした仕事は、待ち時間と回数を最初に戻す
+	restartBackoffReset = 10 * time.Minute
+	// restartLimit 回続けてパニックした仕事は、もう動かし直さない
+	restartLimit = 10
+)
+
+// TaskHealth は、botの仕事一つの様子
+type TaskHealth struct {
+	Task        string
+	Running     int
+	Panics      int
+	LastPanic   string
+	LastPanicAt time.Time
+}
+
+// Health は、botの様子。Problemは、botが準備できていないか、活動を続けられなくなった理由。
+type Health struct {
+	Bot     string
+	Awake   bool
+	Problem string
+	Tasks   []TaskHealth
+}
+
+// health は、botの仕事ごとの様子を記録する
+type health struct {
+	mu      sync.Mutex
+	tasks   map[string]*TaskHealth
+	problem string
+}
+
+// task は、名前がnameの仕事の記録を返す。mu を取ってから呼ぶ。
+func (h *health) task(name string) *TaskHealth {
+	if h.tasks == nil {
+		h.tasks = make(map[string]*TaskHealth)
+	}
+	th, ok := h.tasks[name]
+	if !ok {
+		th = &TaskHealth{Task: name}
+		h.tasks[name] = th
+	}
+	return th
+}
+
+func (h *health) started(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.task(name).Running++
+}
+
+func (h *health) stopped(name string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.task(name).Running--
+}
+
+func (h *health) panicked(name string, v interface{}, at time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	th := h.task(name)
+	th.Panics++
+	th.LastPanic = fmt.Sprint(v)
+	th.LastPanicAt = at
+}
+
+// setProblem は、botが活動できない理由を記録する。errがnilなら消す。
+func (h *health) setProblem(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.problem = ""
+	if err != nil {
+		h.problem = err.Error()
+	}
+}
+
+// Health は、botが起きているかと、活動できない理由、仕事ごとの実行数・パニックの回数を返す
+func (bot *Persona) Health() (h Health) {
+	h.Bot = bot.Name
+	h.Awake = bot.awake.Load()
+	bot.health.mu.Lock()
+	defer bot.health.mu.Unlock()
+	h.Problem = bot.health.problem
+	for _, th := range bot.health.tasks {
+		h.Tasks = append(h.Tasks, *th)
+	}
+	sort.Slice(h.Tasks, func(i, j int) bool { return h.Tasks[i].Task < h.Tasks[j].Task })
+	return
+}
+
+// lastPanic は、仕事taskの最後のパニックを返す
+func (h Health) lastPanic(task string) string {
+	for _, th := range h.Tasks {
+		if th.Task == task {
+			return th.LastPanic
+		}
+	}
+	return ""
+}
+
+// run は、fnを実行し、パニックしたらスタックと一緒にログに出す。パニックしたらtrueを返す。
+func (bot *Persona) run(task string, fn func()) (panicked bool) {
+	bot.health.started(task)
+	defer bot.health.stopped(task)
+	defer func() {
+		if v := recover(); v != nil {
+			panicked = true
+			bot.health.panicked(task, v, bot.clock().Now())
+			log.Printf("alert: %s の %s がパニックしました：%v\n%s", bot.Name, task, v, debug.Stack())
+		}
+	}()
+	fn()
+	return
+}
+
+// supervise は、botの仕事fnを別のgoroutineで動かす。
+// fnがパニックしたら、待ち時間を置いて動かし直す。fnが普通に戻るか、ctxが終わったらおしまい。
+// restartLimit 回続けてパニックしたら諦めて、返したチャネルに最後のパニックを送る。
+func (bot *Persona) supervise(ctx context.Context, task string, fn func(ctx context.Context)) (gaveUp <-chan error) {
+	ch := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		backoff, panics := restartBackoffMin, 0
+		for {
+			start := bot.clock().Now()
+			if !bot.run(task, func() { fn(ctx) }) {
+				return
+			}
+			if bot.clock().Now().Sub(start) > restartBackoffReset {
+				backoff, panics = restartBackoffMin, 0
+			}
+			if panics++; panics >= restartLimit {
+				err := fmt.Errorf("%s が %d 回続けてパニックしました：%s", task, panics, bot.Health().lastPanic(task))
+				log.Printf("alert: %s の %s は %d 回続けてパニックしたので、もう動かし直しません", bot.Name, task, panics)
+				ch <- err
+				return
+			}
+			log.Printf("info: %s の %s を %s 後に再開します", bot.Name, task, backoff)
+			t := bot.clock().NewTimer(backoff)
+			select {
+			case <-t.Chan():
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+			if backoff *= 2; backoff > restartBackoffMax {
+				backoff = restartBackoffMax
+			}
+		}
+	}()
+	return ch
+}
+
+// goSafe は、一度きりの仕事fnを別のgoroutineで動かす。パニックしてもログに出すだけで、動かし直さない。
+func (bot *Persona) goSafe(task string, fn func()) {
+	go bot.run(task, fn)
+}
+
+// logHealth は、活動中のbotたちの様子をログに出す
+func (r *roster) logHealth() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	names := make([]string, 0, len(r.running))
+	for name := range r.running {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		h := r.running[name].bot.Health()
+		log.Printf("info: %s（起きている：%t）", h.Bot, h.Awake)
+		if h.Problem != "" {
+			log.Printf("info:   問題：%s", h.Problem)
+		}
+		for _, th := range h.Tasks {
+			if th.Panics == 0 {
+				log.Printf("info:   %s 実行中 %d", th.Task, th.Running)
+				continue
+			}
+			log.Printf("info:   %s 実行中 %d、パニック %d 回（最後は %s：%s）", th.Task, th.Running, th.Panics, th.LastPanicAt.Format(time.RFC3339), th.LastPanic)
+		}
+	}
+	for _, e := range r.lost {
+		log.Printf("info: %s は活動をやめています：%s", e.Bot, e.Err)
+	}
+}
@@ -0,0 +1,73 @@
+package mastobots
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSuperviseRestartsAfterPanic(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := &Persona{Name: "alice", commonSettings: &commonSettings{clk: clk}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	runs := make(chan int, 3)
+	n := 0
+	bot.supervise(ctx, "flaky", func(ctx context.Context) {
+		n++
+		runs <- n
+		if n < 3 {
+			panic("わざと")
+		}
+	})
+
+	<-runs
+	// 1秒、2秒と待ち時間を倍にしながら動かし直す
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		clk.waitForTimers(t, 1)
+		clk.Advance(d - time.Millisecond)
+		select {
+		case <-runs:
+			t.Fatalf("%s 待つ前に動かし直されました", d)
+		case <-time.After(20 * time.Millisecond):
+		}
+		clk.Advance(time.Millisecond)
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s 待っても動かし直されません", d)
+		}
+	}
+
+	var h Health
+	for i := 0; i < 100; i++ {
+		if h = bot.Health(); len(h.Tasks) == 1 && h.Tasks[0].Running == 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(h.Tasks) != 1 {
+		t.Fatalf("Health().Tasks = %+v", h.Tasks)
+	}
+	if th := h.Tasks[0]; th.Task != "flaky" || th.Panics != 2 || th.LastPanic != "わざと" || th.Running != 0 {
+		t.Errorf("Health().Tasks[0] = %+v", th)
+	}
+}
+
+func TestGoSafeRecovers(t *testing.T) {
+	bot := &Persona{Name: "alice"}
+	done := make(chan struct{})
+	bot.goSafe("once", func() {
+		defer close(done)
+		var m map[string]int
+		m["x"] = 1
+	})
+	<-done
+	for i := 0; i < 100 && bot.Health().Tasks[0].Running != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if th := bot.Health().Tasks[0]; th.Panics != 1 || th.Running != 0 {
+		t.Errorf("Health().Tasks[0] = %+v", th)
+	}
+}
@@ -0,0 +1,241 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	mastodon "github.com/hanage999/go-mastodon"
+)
+
+// timelineTypes は、Timelines の Type に指定できるタイムライン
+var timelineTypes = []string{"home", "local", "public", "hashtag", "list"}
+
+// reactionNames は、Timelines の Reactions に指定できる反応
+var reactionNames = []string{"fav", "boost", "quote"}
+
+// defaultReactions は、Reactions も SourceReactions も指定しない時の、タイムラインの種類ごとの反応。
+// ホームタイムライン以外には知らない人が多いので、ふぁぼだけにする。
+var defaultReactions = map[string][]string{
+	"home":    {"fav", "boost", "quote"},
+	"local":   {"fav"},
+	"public":  {"fav"},
+	"hashtag": {"fav"},
+	"list":    {"fav"},
+}
+
+// Timeline は、botが監視するタイムラインと、そこでキーワードを見つけた時の反応の仕方を格納する
+type Timeline struct {
+	Type      string   // home・local・public・hashtag・list
+	Tag       string   // Typeがhashtagの時のハッシュタグ（「#」は不要）
+	List      string   // Typeがlistの時のリストのIDか名前
+	Local     bool     // Typeがhashtagの時、このサーバの投稿だけを見る
+	Keywords  []string // このタイムラインで興味を示す単語。省略するとbotの Keywords
+	Reactions []string // キーワードを見つけた時にしてよい反応（fav・boost・quote）。省略すると SourceReactions か defaultReactions。ReactionPolicy が選んでも、ここにない反応はしない
+	// notificationsOnly なら、ステータスには反応せず、通知だけを受け取る（Timelines に home がない時の、通知のための接続）
+	notificationsOnly bool
+}
+
+// name は、ログやヘルスに出すタイムラインの名前
+func (tl Timeline) name() string {
+	switch tl.Type {
+	case "hashtag":
+		if tl.Local {
+			return "#" + tl.Tag + "（ローカル）"
+		}
+		return "#" + tl.Tag
+	case "list":
+		return "list:" + tl.List
+	}
+	return tl.Type
+}
+
+// reacts は、キーワードを見つけた時にreactionの反応をするかどうかを返す
+func (tl Timeline) reacts(reaction string) bool {
+	return !tl.notificationsOnly && slices.Contains(tl.Reactions, reaction)
+}
+
+// configuredTimelines は、Timelines に、FollowHashtags と Lists で指定したタイムラインを加えて返す
+func (bot *Persona) configuredTimelines() (tls []Timeline) {
+	tls = append(tls, bot.Timelines...)
+	for _, tag := range bot.FollowHashtags {
+		tls = append(tls, Timeline{Type: "hashtag", Tag: tag})
+	}
+	for _, l := range bot.Lists {
+		tls = append(tls, Timeline{Type: "list", List: l})
+	}
+	return
+}
+
+// timelines は、botが監視するタイムラインを、反応の仕方を決めて返す。省略したらホームタイムラインだけ。
+// home がなくても、メンションに返事するため、通知だけはホームタイムラインの接続で受け取る。
+func (bot *Persona) timelines() (tls []Timeline) {
+	tls = bot.configuredTimelines()
+	home := false
+	for i := range tls {
+		home = home || tls[i].Type == "home"
+		if len(tls[i].Reactions) > 0 {
+			continue
+		}
+		if rs, ok := bot.SourceReactions[tls[i].Type]; ok {
+			tls[i].Reactions = rs
+		} else {
+			tls[i].Reactions = defaultReactions[tls[i].Type]
+		}
+	}
+	if home {
+		return
+	}
+	return append([]Timeline{{Type: "home", notificationsOnly: len(tls) > 0, Reactions: defaultReactions["home"]}}, tls...)
+}
+
+// resolveList は、Typeがlistのタイムラインtlの List が、リストの名前ならIDに置き換える。
+// そのIDや名前のリストがなければエラーを返す。リスト一覧を取得できなければ、List をIDとみなす。
+func (bot *Persona) resolveList(ctx context.Context, tl Timeline) (Timeline, error) {
+	if tl.Type != "list" {
+		return tl, nil
+	}
+	var lists []*mastodon.List
+	if err := bot.retry(ctx, "リスト一覧の取得", func() (err error) {
+		lists, err = bot.Client.GetLists(ctx)
+		return
+	}); err != nil {
+		log.Printf("info: %s がリスト一覧を取得できなかったので、%s をリストIDとみなします：%s", bot.Name, tl.List, err)
+		return tl, nil
+	}
+	for _, l := range lists {
+		if string(l.ID) == tl.List {
+			return tl, nil
+		}
+	}
+	for _, l := range lists {
+		if l.Title == tl.List {
+			tl.List = string(l.ID)
+			return tl, nil
+		}
+	}
+	return tl, fmt.Errorf("%s というリストはありません", tl.List)
+}
+
+// keywordsFor は、タイムラインtlで興味を示す単語を返す
+func (bot *Persona) keywordsFor(tl Timeline) []string {
+	if len(tl.Keywords) > 0 {
+		return tl.Keywords
+	}
+	return bot.keywords()
+}
+
+// fetchTimeline は、タイムラインtlのステータスを、pgの範囲で新しい順に取得する
+func (bot *Persona) fetchTimeline(ctx context.Context, tl Timeline, pg *mastodon.Pagination) ([]*mastodon.Status, error) {
+	switch tl.Type {
+	case "local", "public":
+		return bot.Client.GetTimelinePublic(ctx, tl.Type == "local", pg)
+	case "hashtag":
+		return bot.Client.GetTimelineHashtag(ctx, tl.Tag, tl.Local, pg)
+	case "list":
+		return bot.Client.GetTimelineList(ctx, mastodon.ID(tl.List), pg)
+	}
+	return bot.Client.GetTimelineHome(ctx, pg)
+}
+
+// applyTimelineDefaults は、Timelines・FollowHashtags・Lists・SourceReactions の表記の揺れを整える（Typeや反応は小文字に、ハッシュタグの「#」は取り除く）
+func (bot *Persona) applyTimelineDefaults() {
+	for i, t := range bot.FollowHashtags {
+		bot.FollowHashtags[i] = strings.TrimPrefix(strings.TrimSpace(t), "#")
+	}
+	bot.FollowHashtags = nonEmpty(bot.FollowHashtags)
+	bot.Lists = nonEmpty(bot.Lists)
+	for i := range bot.Timelines {
+		tl := &bot.Timelines[i]
+		tl.Type = strings.ToLower(strings.TrimSpace(tl.Type))
+		tl.Tag = strings.TrimPrefix(strings.TrimSpace(tl.Tag), "#")
+		tl.List = strings.TrimSpace(tl.List)
+		tl.Keywords = nonEmpty(tl.Keywords)
+		for j, r := range tl.Reactions {
+			tl.Reactions[j] = strings.ToLower(strings.TrimSpace(r))
+		}
+	}
+	for t, rs := range bot.SourceReactions {
+		for j, r := range rs {
+			rs[j] = strings.ToLower(strings.TrimSpace(r))
+		}
+		bot.SourceReactions[t] = rs
+	}
+	bot.Streaming = strings.ToLower(strings.TrimSpace(bot.Streaming))
+}
+
+// validateTimelines は、Timelines・FollowHashtags・Lists・SourceReactions・Streaming の問題を洗い出す。nameはエラー表示用のbotの呼び名。
+func (bot *Persona) validateTimelines(name string) (errs ConfigErrors) {
+	if _, ok := streamModeNames[bot.Streaming]; !ok {
+		errs.add(name, "Streaming", "%q は不正です。websocket・sse・poll のいずれかを指定してください", bot.Streaming)
+	}
+	for _, t := range slices.Sorted(maps.Keys(bot.SourceReactions)) {
+		rs := bot.SourceReactions[t]
+		if !slices.Contains(timelineTypes, t) {
+			errs.add(name, "SourceReactions", "%q は不正です。%s のいずれかを指定してください", t, strings.Join(timelineTypes, "・"))
+		}
+		for _, r := range rs {
+			if !slices.Contains(reactionNames, r) {
+				errs.add(name, "SourceReactions", "%s の %q は不正です。%s から選んでください", t, r, strings.Join(reactionNames, "・"))
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	for i, tl := range bot.configuredTimelines() {
+		switch {
+		case !slices.Contains(timelineTypes, tl.Type):
+			errs.add(name, "Timelines", "%d番目の Type %q は不正です。%s のいずれかを指定してください", i+1, tl.Type, strings.Join(timelineTypes, "・"))
+			continue
+		case tl.Type == "hashtag" && tl.Tag == "":
+			errs.add(name, "Timelines", "%d番目は hashtag なので、Tag を指定してください", i+1)
+		case tl.Type == "list" && tl.List == "":
+			errs.add(name, "Timelines", "%d番目は list なので、List にリストIDを指定してください", i+1)
+		}
+		for _, r := range tl.Reactions {
+			if !slices.Contains(reactionNames, r) {
+				errs.add(name, "Timelines", "%d番目の Reactions %q は不正です。%s から選んでください", i+1, r, strings.Join(reactionNames, "・"))
+			}
+		}
+		// ハッシュタグは大文字と小文字を区別しない
+		key := strings.ToLower(tl.name())
+		if seen[key] {
+			errs.add(name, "Timelines", "%s が二度指定されています", tl.name())
+		}
+		seen[key] = true
+	}
+	return
+}
+
+// recentIDsMax は、recentIDs が覚えておくIDの数
+const recentIDsMax = 1000
+
+// recentIDs は、最近反応したステータスのIDを、古いものから忘れながら覚えておく。
+// 同じステータスが複数のタイムラインに流れてきても、一度だけ反応するために使う。
+type recentIDs struct {
+	mu    sync.Mutex
+	set   map[mastodon.ID]bool
+	order []mastodon.ID
+}
+
+// add は、idを覚える。既に覚えていたらfalseを返す。
+func (r *recentIDs) add(id mastodon.ID) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.set == nil {
+		r.set = make(map[mastodon.ID]bool)
+	}
+	if r.set[id] {
+		return false
+	}
+	r.set[id] = true
+	r.order = append(r.order, id)
+	if len(r.order) > recentIDsMax {
+		delete(r.set, r.order[0])
+		r.order = r.order[1:]
+	}
+	return true
+}
@@ -0,0 +1,271 @@
+package mastobots
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	mastodon "github.com/hanage999/go-mastodon"
+	"github.com/hanage999/mastobots/mastotest"
+)
+
+func TestValidateTimelines(t *testing.T) {
+	bot := validBot("a")
+	bot.Streaming = " SSE "
+	bot.Timelines = []Timeline{
+		{Type: "Home"},
+		{Type: "hashtag", Tag: "#Coffee", Reactions: []string{"FAV"}},
+		{Type: "hashtag"},
+		{Type: "list"},
+		{Type: "federated"},
+		{Type: "local", Reactions: []string{"fav", "reply"}},
+		{Type: "hashtag", Tag: "coffee"},
+	}
+	errs := validateBots([]*Persona{bot})
+	want := []string{
+		`a の Timelines：3番目は hashtag なので、Tag を指定してください`,
+		`a の Timelines：4番目は list なので、List にリストIDを指定してください`,
+		`a の Timelines：5番目の Type "federated" は不正です。home・local・public・hashtag・list のいずれかを指定してください`,
+		`a の Timelines：6番目の Reactions "reply" は不正です。fav・boost・quote から選んでください`,
+		`a の Timelines：#coffee が二度指定されています`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("エラーが%d件：\n%s", len(errs), errs.Error())
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Errorf("%d件目 = %q, want %q", i, e.Error(), want[i])
+		}
+	}
+	if bot.Streaming != "sse" || bot.Timelines[0].Type != "home" || bot.Timelines[1].Tag != "Coffee" || bot.Timelines[1].Reactions[0] != "fav" {
+		t.Errorf("表記が整っていません：%q %+v", bot.Streaming, bot.Timelines[:2])
+	}
+
+	bot = validBot("b")
+	bot.Streaming = "carrier-pigeon"
+	if errs := validateBots([]*Persona{bot}); len(errs) != 1 || errs[0].Key != "Streaming" {
+		t.Errorf("Streaming の誤りを見逃しました：%v", errs)
+	}
+}
+
+func TestTimelines(t *testing.T) {
+	bot := &Persona{}
+	if tls := bot.timelines(); len(tls) != 1 || tls[0].Type != "home" || tls[0].notificationsOnly {
+		t.Errorf("省略時 = %+v, want ホームタイムラインだけ", tls)
+	}
+
+	bot.Timelines = []Timeline{{Type: "local"}}
+	tls := bot.timelines()
+	if len(tls) != 2 || tls[0].Type != "home" || !tls[0].notificationsOnly || tls[1].Type != "local" {
+		t.Errorf("home なし = %+v, want 通知だけのホームタイムラインとローカル", tls)
+	}
+	if tls[0].reacts("fav") {
+		t.Error("通知だけの接続で、ステータスに反応しようとしています")
+	}
+
+	bot.Timelines = []Timeline{{Type: "local"}, {Type: "home", Reactions: []string{"fav"}}}
+	tls = bot.timelines()
+	if len(tls) != 2 || tls[1].notificationsOnly {
+		t.Errorf("home あり = %+v", tls)
+	}
+	// ホームタイムライン以外は、既定ではふぁぼだけ
+	if !tls[0].reacts("fav") || tls[0].reacts("boost") || !tls[1].reacts("fav") || tls[1].reacts("boost") {
+		t.Error("Reactions の通りに反応しません")
+	}
+
+	// FollowHashtags と Lists は、Timelines の後に加え、SourceReactions で種類ごとの反応を決める
+	bot.Timelines = nil
+	bot.FollowHashtags = []string{"coffee"}
+	bot.Lists = []string{"friends"}
+	bot.SourceReactions = map[string][]string{"list": {"fav", "boost"}}
+	tls = bot.timelines()
+	if len(tls) != 3 || tls[0].Type != "home" || tls[1].name() != "#coffee" || tls[2].name() != "list:friends" {
+		t.Fatalf("FollowHashtags・Lists = %+v", tls)
+	}
+	if !tls[1].reacts("fav") || tls[1].reacts("boost") || !tls[2].reacts("boost") || tls[2].reacts("quote") {
+		t.Error("SourceReactions の通りに反応しません")
+	}
+}
+
+func TestValidateSourceReactions(t *testing.T) {
+	bot := validBot("a")
+	bot.FollowHashtags = []string{"#Coffee", " "}
+	bot.Timelines = []Timeline{{Type: "hashtag", Tag: "coffee"}}
+	bot.SourceReactions = map[string][]string{"hashtag": {"FAV", "reply"}, "federated": {"fav"}}
+	errs := validateBots([]*Persona{bot})
+	want := []string{
+		`a の SourceReactions："federated" は不正です。home・local・public・hashtag・list のいずれかを指定してください`,
+		`a の SourceReactions：hashtag の "reply" は不正です。fav・boost・quote から選んでください`,
+		`a の Timelines：#Coffee が二度指定されています`,
+	}
+	if len(errs) != len(want) {
+		t.Fatalf("エラーが%d件：\n%s", len(errs), errs.Error())
+	}
+	for i, e := range errs {
+		if e.Error() != want[i] {
+			t.Errorf("%d件目 = %q, want %q", i, e.Error(), want[i])
+		}
+	}
+	if len(bot.FollowHashtags) != 1 || bot.SourceReactions["hashtag"][0] != "fav" {
+		t.Errorf("表記が整っていません：%q %q", bot.FollowHashtags, bot.SourceReactions)
+	}
+}
+
+func TestResolveList(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	id := srv.AddList("alice", "friends")
+	ctx := context.Background()
+
+	for _, l := range []string{"friends", string(id)} {
+		tl, err := bot.resolveList(ctx, Timeline{Type: "list", List: l})
+		if err != nil || tl.List != string(id) {
+			t.Errorf("%s: List = %s, err = %v, want %s", l, tl.List, err, id)
+		}
+	}
+	if _, err := bot.resolveList(ctx, Timeline{Type: "list", List: "enemies"}); err == nil {
+		t.Error("ないリストでエラーになりません")
+	}
+}
+
+func TestRecentIDs(t *testing.T) {
+	var r recentIDs
+	if !r.add("1") || r.add("1") {
+		t.Error("同じIDを二度覚えました")
+	}
+	for i := 2; i <= recentIDsMax+1; i++ {
+		r.add(mastodon.ID(fmt.Sprint(i)))
+	}
+	if !r.add("1") {
+		t.Error("古いIDを忘れていません")
+	}
+	if r.add(mastodon.ID(fmt.Sprint(recentIDsMax + 1))) {
+		t.Error("新しいIDを忘れました")
+	}
+}
+
+func TestIntegrationHashtagTimeline(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.Keywords = []string{"tea"}
+		bot.Comments = []string{"_keyword1_!"}
+		bot.Timelines = []Timeline{{Type: "hashtag", Tag: "coffee", Keywords: []string{"coffee"}, Reactions: []string{"fav"}}}
+	})
+
+	stop := runBots(t, clk, db, 10, bot)
+	// 通知のためのホームタイムラインと、ハッシュタグ
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 2 }) {
+		stop()
+		t.Fatal("ストリーミングに接続しませんでした")
+	}
+
+	// 同じサーバのbotでも、Reactions が fav だけならブーストも引用もしない
+	friend := mastodon.Account{ID: "8", Username: "friend", Acct: "friend", Bot: true}
+	tag := []mastodon.Tag{{Name: "coffee"}}
+	hit := srv.PushPublic(mastodon.Status{Account: friend, Content: "<p>Fresh coffee beans arrived</p>", Tags: tag})
+	// このタイムラインの Keywords にない単語には反応しない
+	srv.PushPublic(mastodon.Status{Account: friend, Content: "<p>Green tea today</p>", Tags: tag})
+	// ハッシュタグのないトゥートは流れてこない
+	srv.PushPublic(mastodon.Status{Account: friend, Content: "<p>More coffee</p>"})
+
+	ok := srv.WaitFor(parseWait, func() bool { return len(srv.Favourited("alice")) >= 1 })
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	if !ok {
+		t.Fatal("ハッシュタグのトゥートに反応しませんでした")
+	}
+	if got := srv.Favourited("alice"); len(got) != 1 || got[0] != hit.ID {
+		t.Errorf("ふぁぼったのは %v, want [%s]", got, hit.ID)
+	}
+	if n, m := len(srv.Reblogged("alice")), len(srv.Posted("alice")); n != 0 || m != 0 {
+		t.Errorf("ブースト%d件、投稿%d件, want 0", n, m)
+	}
+}
+
+func TestIntegrationStrangers(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	db := unavailableDB(t)
+
+	bot := integrationBot(t, srv, clk, "alice", func(bot *Persona) {
+		bot.Keywords = []string{"coffee"}
+		bot.Comments = []string{"_keyword1_!"}
+		bot.Timelines = []Timeline{{Type: "local", Reactions: []string{"fav", "boost"}}}
+	})
+	friend := mastodon.Account{ID: "8", Username: "friend", Acct: "friend", Bot: true}
+	stranger := mastodon.Account{ID: "9", Username: "stranger", Acct: "stranger", Bot: true}
+	srv.SetFollowing("alice", friend.ID, true)
+
+	stop := runBots(t, clk, db, 10, bot)
+	if !srv.WaitFor(5*time.Second, func() bool { return srv.Streams("alice") == 2 }) {
+		stop()
+		t.Fatal("ストリーミングに接続しませんでした")
+	}
+	// フォローしていない相手は、同じサーバのbotでもふぁぼるだけ
+	st1 := srv.PushPublic(mastodon.Status{Account: stranger, Content: "<p>Fresh coffee beans arrived</p>"})
+	st2 := srv.PushPublic(mastodon.Status{Account: friend, Content: "<p>Cold brew coffee</p>"})
+
+	ok := srv.WaitFor(parseWait, func() bool { return len(srv.Favourited("alice")) == 2 && len(srv.Reblogged("alice")) == 1 })
+	time.Sleep(200 * time.Millisecond)
+	stop()
+
+	if !ok {
+		t.Fatalf("ふぁぼ %v、ブースト %v", srv.Favourited("alice"), srv.Reblogged("alice"))
+	}
+	if got := srv.Reblogged("alice"); len(got) != 1 || got[0] != st2.ID {
+		t.Errorf("ブーストしたのは %v, want [%s]（%s はフォローしていない）", got, st2.ID, st1.ID)
+	}
+}
+
+func TestFetchTimelineList(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", nil)
+
+	member := mastodon.Account{ID: "7", Username: "member", Acct: "member@example.com"}
+	other := mastodon.Account{ID: "9", Username: "other", Acct: "other@example.com"}
+	id := srv.AddList("alice", "friends", member.ID)
+	in := srv.PushPublic(mastodon.Status{Account: member, Content: "<p>in</p>"})
+	srv.PushPublic(mastodon.Status{Account: other, Content: "<p>out</p>"})
+
+	sts, err := bot.fetchTimeline(context.Background(), Timeline{Type: "list", List: string(id)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sts) != 1 || sts[0].ID != in.ID {
+		t.Errorf("リストのタイムライン = %v, want [%s]", sts, in.ID)
+	}
+}
+
+func TestRespondToUpdateOnceAfterMatch(t *testing.T) {
+	srv := mastotest.NewServer()
+	defer srv.Close()
+	clk := newFakeClock(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC))
+	bot := integrationBot(t, srv, clk, "alice", nil)
+	tea := Timeline{Type: "hashtag", Tag: "tea", Keywords: []string{"tea"}, Reactions: []string{"fav"}}
+	coffee := Timeline{Type: "hashtag", Tag: "coffee", Keywords: []string{"coffee"}, Reactions: []string{"fav"}}
+
+	friend := mastodon.Account{ID: "8", Username: "friend", Acct: "friend", Bot: true}
+	st := srv.AddStatus(mastodon.Status{Account: friend, Content: "<p>Fresh coffee beans arrived</p>"})
+	ev := &mastodon.UpdateEvent{Status: st}
+
+	// キーワードに合わなかったタイムラインで先に流れてきても、合うタイムラインでは反応する
+	for _, tl := range []Timeline{tea, coffee, coffee} {
+		if err := bot.respondToUpdate(context.Background(), tl, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := srv.Favourited("alice"); len(got) != 1 || got[0] != st.ID {
+		t.Errorf("ふぁぼったのは %v, want [%s]", got, st.ID)
+	}
+}
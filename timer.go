@@ -2,29 +2,33 @@ package mastobots
 
 import (
 	"context"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
 	"time"
 )
 
 // tickAfterWaitは、最初は指定時間後に送信し、あとは別に指定する間隔ごとに送信するチャンネルを返す
-func tickAfterWait(ctx context.Context, wait time.Duration, itvl time.Duration) (ch chan string) {
+func tickAfterWait(ctx context.Context, clk Clock, wait time.Duration, itvl time.Duration) (ch chan string) {
 	ch = make(chan string)
 
 	go func() {
 		defer close(ch)
-		t := time.NewTimer(wait)
+		t := clk.NewTimer(wait)
 		defer t.Stop()
 		select {
-		case <-t.C:
+		case <-t.Chan():
 			ch <- "first tick"
 		case <-ctx.Done():
 			return
 		}
 
-		tk := time.NewTicker(itvl)
+		tk := clk.NewTicker(itvl)
 
 		for {
 			select {
-			case <-tk.C:
+			case <-tk.Chan():
 				ch <- "routine tick"
 			case <-ctx.Done():
 				tk.Stop()
@@ -36,47 +40,79 @@ func tickAfterWait(ctx context.Context, wait time.Duration, itvl time.Duration)
 	return
 }
 
-// untilは、指定された時刻までのDurationを返す。hourが負数の時は、分だけが指定されたとみなす。
-func until(hour, min, sec int) (dur time.Duration) {
-	now := time.Now()
-	var add time.Duration
+// tickByScheduleは、スケジュールに合う時刻ごとに送信するチャンネルを返す。時刻はlocで判定し、jitterの範囲でランダムに遅らせる。
+func tickBySchedule(ctx context.Context, clk Clock, sched *cronSchedule, loc *time.Location, jitter time.Duration) (ch chan string) {
+	ch = make(chan string)
+
+	go func() {
+		defer close(ch)
+		next := clk.Now().In(loc)
+		for {
+			next = sched.next(next)
+			if next.IsZero() {
+				return
+			}
+			wait := next.Sub(clk.Now())
+			if jitter > 0 {
+				wait += time.Duration(rand.Int63n(int64(jitter)))
+			}
+
+			t := clk.NewTimer(wait)
+			select {
+			case <-t.Chan():
+				ch <- "scheduled tick: " + next.Format("01-02 15:04 MST")
+			case <-ctx.Done():
+				t.Stop()
+				return
+			}
+		}
+	}()
+
+	return
+}
+
+// untilは、nowからnowのタイムゾーンで指定された時刻までのDurationを返す。hourが負数の時は、分だけが指定されたとみなす。
+func until(now time.Time, hour, min, sec int) (dur time.Duration) {
+	loc := now.Location()
 	var t time.Time
 
 	if hour < 0 {
-		t = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), min, sec, 0, now.Location())
-		add = 60 * time.Minute
+		t = time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), min, sec, 0, loc)
+		if t.Before(now) {
+			t = t.Add(60 * time.Minute)
+		}
 	} else {
-		t = time.Date(now.Year(), now.Month(), now.Day(), hour, min, sec, 0, now.Location())
-		add = 24 * time.Hour
-	}
-
-	if t.Before(now) {
-		t = t.Add(add)
+		t = nextClock(now, hour, min, sec)
 	}
 
 	dur = t.Sub(now)
 	return
 }
 
-func getDayCycle(wakehour, wakemin, sleephour, sleepmin int) (sleep, active time.Duration) {
-	sleep = until(wakehour, wakemin, 0)
-	tillSleep := until(sleephour, sleepmin, 0)
-	active = tillSleep - sleep
-
-	if wakehour == sleephour && wakemin == sleepmin {
-		sleep = 0
-		active = 24 * time.Hour
-		return
+// nextClockは、now以降で最初に時計がhour:min:secを指す時刻を返す。夏時間の切り替え日も実際の時刻で数える。
+func nextClock(now time.Time, hour, min, sec int) (t time.Time) {
+	y, m, d := now.Date()
+	t = time.Date(y, m, d, hour, min, sec, 0, now.Location())
+	if t.Before(now) {
+		t = time.Date(y, m, d+1, hour, min, sec, 0, now.Location())
 	}
+	return
+}
 
-	if active < 0 {
-		active += 24 * time.Hour
+// locationOfは、タイムゾーン名に対応するLocationを返す。"GMT+9"のような表記も受け付け、不明ならサーバのローカルタイムとする。
+func locationOf(zone string) (loc *time.Location) {
+	if zone == "" {
+		return time.Local
 	}
-
-	if active > tillSleep {
-		sleep = 0
-		active = tillSleep
+	if strings.Contains(zone, "GMT") {
+		offset, _ := strconv.Atoi(strings.Replace(zone, "GMT", "", -1))
+		log.Printf("trace: GMTからのオフセット：%d", offset)
+		return time.FixedZone(zone, offset*60*60)
+	}
+	loc, err := time.LoadLocation(zone)
+	if err != nil {
+		log.Printf("info: タイムゾーン %s が読み込めませんでした：%s", zone, err)
+		loc = time.Local
 	}
-
 	return
 }
@@ -0,0 +1,109 @@
+package mastobots
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestUntilCrossesMidnight(t *testing.T) {
+	now := time.Date(2024, 12, 31, 23, 50, 0, 0, time.UTC)
+	if got := until(now, 0, 10, 0); got != 20*time.Minute {
+		t.Errorf("until(0:10) = %s, want 20m", got)
+	}
+	if got := until(now, 23, 40, 0); got != 23*time.Hour+50*time.Minute {
+		t.Errorf("until(23:40) = %s, want 23h50m", got)
+	}
+
+	now = time.Date(2024, 12, 31, 23, 58, 0, 0, time.UTC)
+	if got := until(now, -1, 5, 0); got != 7*time.Minute {
+		t.Errorf("until(*:05) = %s, want 7m", got)
+	}
+}
+
+func TestNextClockAcrossDST(t *testing.T) {
+	london := mustLoadLocation(t, "Europe/London")
+	cases := []struct {
+		name string
+		now  time.Time
+		want time.Duration
+	}{
+		{"夏時間の始まり", time.Date(2024, 3, 30, 13, 0, 0, 0, london), 22 * time.Hour},
+		{"夏時間の終わり", time.Date(2024, 10, 26, 13, 0, 0, 0, london), 24 * time.Hour},
+		{"切り替えのない日", time.Date(2024, 6, 1, 13, 0, 0, 0, london), 23 * time.Hour},
+	}
+	for _, c := range cases {
+		if got := nextClock(c.now, 12, 0, 0).Sub(c.now); got != c.want {
+			t.Errorf("%s: nextClock(12:00) まで %s, want %s", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTickByScheduleAcrossDST(t *testing.T) {
+	ny := mustLoadLocation(t, "America/New_York")
+	sched, err := parseCron("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := newFakeClock(time.Date(2024, 3, 10, 0, 30, 0, 0, ny))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tc := tickBySchedule(ctx, clk, sched, ny, 0)
+
+	// 1時の次は、実際には1時間後の夏時間の3時
+	steps := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{30 * time.Minute, "scheduled tick: 03-10 01:00 EST"},
+		{time.Hour, "scheduled tick: 03-10 03:00 EDT"},
+	}
+	for _, s := range steps {
+		clk.waitForTimers(t, 1)
+		clk.Advance(s.advance)
+		select {
+		case got := <-tc:
+			if got != s.want {
+				t.Errorf("got %q, want %q", got, s.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s が送信されませんでした", s.want)
+		}
+	}
+
+	cancel()
+	for range tc {
+	}
+}
+
+func TestTickAfterWait(t *testing.T) {
+	clk := newFakeClock(time.Date(2024, 1, 1, 23, 55, 0, 0, time.UTC))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tc := tickAfterWait(ctx, clk, 5*time.Minute, time.Hour)
+
+	steps := []struct {
+		advance time.Duration
+		want    string
+	}{
+		{5 * time.Minute, "first tick"},
+		{time.Hour, "routine tick"},
+		{time.Hour, "routine tick"},
+	}
+	for _, s := range steps {
+		clk.waitForTimers(t, 1)
+		clk.Advance(s.advance)
+		select {
+		case got := <-tc:
+			if got != s.want {
+				t.Errorf("got %q, want %q", got, s.want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s が送信されませんでした", s.want)
+		}
+	}
+
+	cancel()
+	for range tc {
+	}
+}
@@ -0,0 +1,192 @@
+package mastobots
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ConfigError は、設定ファイルの一つの項目の問題を格納する。Botが空なら全体の設定の問題。
+type ConfigError struct {
+	Bot     string
+	Key     string
+	Problem string
+}
+
+func (e ConfigError) Error() string {
+	if e.Bot == "" {
+		return fmt.Sprintf("%s：%s", e.Key, e.Problem)
+	}
+	return fmt.Sprintf("%s の %s：%s", e.Bot, e.Key, e.Problem)
+}
+
+// ConfigErrors は、設定ファイルの問題をまとめて格納する
+type ConfigErrors []ConfigError
+
+func (es ConfigErrors) Error() string {
+	lines := make([]string, 0, len(es))
+	for _, e := range es {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// add は、問題を一つ追加する
+func (es *ConfigErrors) add(bot, key, format string, args ...interface{}) {
+	*es = append(*es, ConfigError{Bot: bot, Key: key, Problem: fmt.Sprintf(format, args...)})
+}
+
+// merge は、errを問題として追加する。errがConfigErrorかConfigErrorsならそのまま、そうでなければkeyの問題とする。
+func (es *ConfigErrors) merge(bot, key string, err error) {
+	var ce ConfigError
+	var ces ConfigErrors
+	switch {
+	case err == nil:
+	case errors.As(err, &ces):
+		*es = append(*es, ces...)
+	case errors.As(err, &ce):
+		*es = append(*es, ce)
+	default:
+		es.add(bot, key, "%s", err)
+	}
+}
+
+// err は、問題があればConfigErrorsを、なければnilを返す
+func (es ConfigErrors) err() error {
+	if len(es) == 0 {
+		return nil
+	}
+	return es
+}
+
+// applyDefaults は、省略された項目や空の項目を既定の値にする。
+//   - Comments・RandomToots・Keywords・Hashtags の空の要素は取り除く（例の設定ファイルの「-」だけの行など）
+//   - Hashtags の先頭の「#」は取り除く
+//   - Timelines の Type・Reactions・Streaming は小文字にし、Tag の先頭の「#」は取り除く
+//   - ReactionPolicy の Sources・Authors・Actions・DailyCaps は小文字にする
+//   - 数値の項目を省略したら0。Interval は0だと定期トゥートできないので、Schedule がなければエラーにする
+func (bot *Persona) applyDefaults() {
+	bot.Comments = nonEmpty(bot.Comments)
+	bot.RandomToots = nonEmpty(bot.RandomToots)
+	bot.Keywords = nonEmpty(bot.Keywords)
+	for j, t := range bot.Hashtags {
+		bot.Hashtags[j] = strings.TrimPrefix(strings.TrimSpace(t), "#")
+	}
+	bot.Hashtags = nonEmpty(bot.Hashtags)
+	bot.applyTimelineDefaults()
+	bot.applyReactionPolicyDefaults()
+}
+
+// nonEmpty は、空白だけの要素を除いたスライスを返す
+func nonEmpty(ss []string) (res []string) {
+	for _, s := range ss {
+		if strings.TrimSpace(s) != "" {
+			res = append(res, s)
+		}
+	}
+	return
+}
+
+// validate は、botの設定のうち、他の項目と関係なく判定できる問題を洗い出す。nameはエラー表示用のbotの呼び名。
+// スケジュールやタイムゾーンなど、解析して初めて分かる問題はLoadConfigで追加する。
+func (bot *Persona) validate(name string) (errs ConfigErrors) {
+	if bot.Name == "" {
+		errs.add(name, "Name", "botの名前を指定してください")
+	}
+
+	if bot.Instance == "" {
+		errs.add(name, "Instance", "MastodonサーバのURLを指定してください")
+	} else if u, err := url.Parse(bot.Instance); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		errs.add(name, "Instance", "%q はURLではありません（https://example.com のように指定してください）", bot.Instance)
+	}
+	if bot.AccessToken == "" {
+		errs.add(name, "AccessToken", "アクセストークンを指定してください")
+	}
+
+	if len(bot.Comments) == 0 {
+		errs.add(name, "Comments", "トゥート本文を一つ以上指定してください")
+	}
+	if len(bot.RandomToots) == 0 && (bot.RandomFrequency > 0 || bot.RandomSchedule != "") {
+		errs.add(name, "RandomToots", "RandomFrequency か RandomSchedule を指定する時は、ランダムトゥートの内容を一つ以上指定してください")
+	}
+	if bot.RandomFrequency < 0 {
+		errs.add(name, "RandomFrequency", "%d は負です", bot.RandomFrequency)
+	} else if bot.RandomFrequency > 24*60 {
+		errs.add(name, "RandomFrequency", "%d は多すぎます（一日%d回まで）", bot.RandomFrequency, 24*60)
+	}
+
+	if bot.Schedule == "" {
+		if bot.Interval <= 0 {
+			errs.add(name, "Interval", "%d は不正です。1以上の分数を指定してください", bot.Interval)
+		}
+		if bot.FirstFire < 0 || bot.FirstFire > 59 {
+			errs.add(name, "FirstFire", "%d は不正です。0〜59の分を指定してください", bot.FirstFire)
+		}
+	}
+	if bot.Jitter < 0 {
+		errs.add(name, "Jitter", "%d は負です", bot.Jitter)
+	}
+	if bot.ItemPool < 0 {
+		errs.add(name, "ItemPool", "%d は負です", bot.ItemPool)
+	}
+
+	if len(bot.WeeklySchedule) == 0 && !bot.LivesWithSun {
+		for _, c := range []struct {
+			key      string
+			val, max int
+		}{
+			{"WakeHour", bot.WakeHour, 23},
+			{"WakeMin", bot.WakeMin, 59},
+			{"SleepHour", bot.SleepHour, 23},
+			{"SleepMin", bot.SleepMin, 59},
+		} {
+			if c.val < 0 || c.val > c.max {
+				errs.add(name, c.key, "%d は不正です。0〜%dで指定してください", c.val, c.max)
+			}
+		}
+	}
+
+	if bot.Latitude < -90 || bot.Latitude > 90 {
+		errs.add(name, "Latitude", "%v は不正です。-90〜90で指定してください", bot.Latitude)
+	}
+	if bot.Longitude < -180 || bot.Longitude > 180 {
+		errs.add(name, "Longitude", "%v は不正です。-180〜180で指定してください", bot.Longitude)
+	}
+	if bot.LivesWithSun {
+		if bot.Latitude == 0 && bot.Longitude == 0 {
+			errs.add(name, "Latitude", "LivesWithSun が true の時は、すみかの緯度経度を指定してください")
+		}
+		if _, err := twilightAngle(bot.Twilight); err != nil {
+			errs.add(name, "Twilight", "%s", err)
+		}
+	}
+	if bot.HolidayCalendar != "" && !slices.Contains(holidayCalendars, strings.ToLower(bot.HolidayCalendar)) {
+		errs.add(name, "HolidayCalendar", "%q は不正です。%s のいずれかを指定してください", bot.HolidayCalendar, strings.Join(holidayCalendars, "・"))
+	}
+	errs = append(errs, bot.validateTimelines(name)...)
+	errs = append(errs, bot.validateReactionPolicy(name)...)
+	return
+}
+
+// validateBots は、bot全体にまたがる問題と、各botの問題を洗い出す
+func validateBots(bots []*Persona) (errs ConfigErrors) {
+	if len(bots) == 0 {
+		errs.add("", "Personae", "botが一体も設定されていません")
+		return
+	}
+	seen := make(map[string]bool)
+	for i, bot := range bots {
+		bot.applyDefaults()
+		name := bot.Name
+		if name == "" {
+			name = fmt.Sprintf("%d番目のbot", i+1)
+		} else if seen[name] {
+			errs.add(name, "Name", "同じ名前のbotが複数います")
+		}
+		seen[name] = true
+		errs = append(errs, bot.validate(name)...)
+	}
+	return
+}
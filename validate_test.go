@@ -0,0 +1,93 @@
+package mastobots
+
+import (
+	"errors"
+	"testing"
+)
+
+func validBot(name string) *Persona {
+	return &Persona{
+		Name:        name,
+		Instance:    "https://example.com",
+		AccessToken: "token",
+		Comments:    []string{"_keyword1_！"},
+		Interval:    60,
+		WakeHour:    6,
+		SleepHour:   22,
+	}
+}
+
+func TestValidateBots(t *testing.T) {
+	ok := validBot("ok")
+	ok.RandomToots = []string{""}
+	ok.Hashtags = []string{"#news", " ", "bot"}
+
+	noComments := validBot("nocomments")
+	noComments.Comments = []string{""}
+
+	noRandom := validBot("norandom")
+	noRandom.RandomFrequency = 3
+
+	zeroInterval := validBot("zero")
+	zeroInterval.Interval = 0
+
+	scheduled := validBot("scheduled")
+	scheduled.Interval = 0
+	scheduled.Schedule = "0 8 * * *"
+
+	badInstance := validBot("badinstance")
+	badInstance.Instance = "example.com"
+
+	noName := validBot("")
+	dup := validBot("ok")
+
+	errs := validateBots([]*Persona{ok, noComments, noRandom, zeroInterval, scheduled, badInstance, noName, dup})
+	want := map[ConfigError]bool{
+		{"nocomments", "Comments", ""}:  true,
+		{"norandom", "RandomToots", ""}: true,
+		{"zero", "Interval", ""}:        true,
+		{"badinstance", "Instance", ""}: true,
+		{"7番目のbot", "Name", ""}:         true,
+		{"ok", "Name", ""}:              true,
+	}
+	for _, e := range errs {
+		k := ConfigError{Bot: e.Bot, Key: e.Key}
+		if !want[k] {
+			t.Errorf("余計なエラー：%s", e)
+		}
+		delete(want, k)
+	}
+	for k := range want {
+		t.Errorf("%s の %s のエラーがありません", k.Bot, k.Key)
+	}
+
+	if len(ok.RandomToots) != 0 {
+		t.Errorf("空のRandomTootsが残っています：%q", ok.RandomToots)
+	}
+	if len(ok.Hashtags) != 2 || ok.Hashtags[0] != "news" {
+		t.Errorf("Hashtags = %q, want [news bot]", ok.Hashtags)
+	}
+}
+
+func TestValidateBotsEmpty(t *testing.T) {
+	errs := validateBots(nil)
+	if len(errs) != 1 || errs[0].Key != "Personae" {
+		t.Errorf("validateBots(nil) = %v", errs)
+	}
+}
+
+func TestParseDayScheduleCollectsErrors(t *testing.T) {
+	bot := validBot("a")
+	bot.WeeklySchedule = map[string][]string{"mon": {"25:00-26:00"}, "funday": {"09:00-10:00"}}
+	bot.Holidays = []string{"2026/12/29"}
+	bot.Vacations = []Vacation{{From: "2026-08-16", To: "2026-08-10"}}
+
+	err := bot.parseDaySchedule()
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("parseDaySchedule() = %v, want ConfigErrors", err)
+	}
+	if len(errs) != 4 {
+		t.Errorf("エラーが%d件、want 4：\n%s", len(errs), errs)
+	}
+}